@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/supabase-community/postgrest-go"
+)
+
+const (
+	auditBookingCreate       = "booking.create"
+	auditBookingCancel       = "booking.cancel"
+	auditBookingLink         = "booking.link"
+	auditBookingReschedule   = "booking.reschedule"
+	auditBookingStatus       = "booking.status"
+	auditBookingPayment      = "booking.payment"
+	auditBookingRefund       = "booking.refund"
+	auditMasterCreate        = "master.create"
+	auditBlockCreate         = "block.create"
+	auditBlockDelete         = "block.delete"
+	auditClosedDaysImport    = "holiday.import"
+	auditClosedDayDelete     = "holiday.delete"
+	auditMasterNotifications = "master.notifications"
+	auditMasterUpdate        = "master.update"
+	auditRoleGrant           = "role.grant"
+	auditRoleRevoke          = "role.revoke"
+	auditSettingUpdate       = "setting.update"
+	auditPromoUpdate         = "promo.update"
+)
+
+const (
+	auditPageSize = 15
+	auditMaxText  = 3500
+)
+
+// AuditEntry is one row of the append-only audit_log table. ActorID 0 means
+// the bot itself (background jobs).
+type AuditEntry struct {
+	ID            int64           `json:"id"`
+	CreatedAt     time.Time       `json:"created_at"`
+	ActorID       int64           `json:"actor_id"`
+	Action        string          `json:"action"`
+	Entity        string          `json:"entity"`
+	EntityID      string          `json:"entity_id"`
+	SubjectUserID int64           `json:"subject_user_id"`
+	Before        json.RawMessage `json:"before"`
+	After         json.RawMessage `json:"after"`
+}
+
+type AuditFilter struct {
+	Entity   string
+	EntityID string
+	UserID   int64
+}
+
+// writeAudit records a state change. before and after are stored as JSON;
+// pass nil for the side that doesn't exist. Failures are logged and never
+// block the action itself.
+func writeAudit(actorID int64, action, entity, entityID string, subjectUserID int64, before, after interface{}) {
+	row := map[string]interface{}{
+		"actor_id":  actorID,
+		"action":    action,
+		"entity":    entity,
+		"entity_id": entityID,
+	}
+	if subjectUserID != 0 {
+		row["subject_user_id"] = subjectUserID
+	}
+	if before != nil {
+		row["before"] = before
+	}
+	if after != nil {
+		row["after"] = after
+	}
+
+	if _, _, err := supabaseClient.From("audit_log").Insert(row, false, "", "", "").Execute(); err != nil {
+		slog.Error("failed to write audit log", "action", action, "entity", entity, "entity_id", entityID, "err", err)
+	}
+}
+
+func auditSlot(actorID int64, action string, before, after *Slot) {
+	slot := after
+	if slot == nil {
+		slot = before
+	}
+	subject, _ := strconv.ParseInt(slot.UserID, 10, 64)
+	var b, a interface{}
+	if before != nil {
+		b = before
+	}
+	if after != nil {
+		a = after
+	}
+	writeAudit(actorID, action, "slot", strconv.Itoa(slot.ID), subject, b, a)
+}
+
+func getAuditLog(filter AuditFilter, limit int) ([]AuditEntry, error) {
+	query := supabaseClient.From("audit_log").Select("*", "exact", false)
+	if filter.Entity != "" {
+		query = query.Eq("entity", filter.Entity)
+	}
+	if filter.EntityID != "" {
+		query = query.Eq("entity_id", filter.EntityID)
+	}
+	if filter.UserID != 0 {
+		id := strconv.FormatInt(filter.UserID, 10)
+		query = query.Or("actor_id.eq."+id+",subject_user_id.eq."+id, "")
+	}
+	data, _, err := query.
+		Order("id", &postgrest.OrderOpts{Ascending: false}).
+		Limit(limit, "").
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []AuditEntry
+	err = json.Unmarshal(data, &results)
+	return results, err
+}
+
+// auditChanges lists the fields that differ between before and after as
+// "field: old → new".
+func auditChanges(before, after json.RawMessage) []string {
+	var b, a map[string]interface{}
+	json.Unmarshal(before, &b)
+	json.Unmarshal(after, &a)
+
+	keys := make(map[string]bool)
+	for k := range b {
+		keys[k] = true
+	}
+	for k := range a {
+		keys[k] = true
+	}
+	var changes []string
+	for k := range keys {
+		if reflect.DeepEqual(b[k], a[k]) {
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: %s → %s", k, auditValue(b[k]), auditValue(a[k])))
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+func auditHasValue(raw json.RawMessage) bool {
+	return len(raw) > 0 && string(raw) != "null"
+}
+
+func auditValue(v interface{}) string {
+	if v == nil || v == "" {
+		return "—"
+	}
+	return fmt.Sprint(v)
+}
+
+func formatAuditEntries(entries []AuditEntry) string {
+	if len(entries) == 0 {
+		return "Записей в журнале нет"
+	}
+	var b strings.Builder
+	for _, e := range entries {
+		actor := "бот"
+		if e.ActorID != 0 {
+			actor = strconv.FormatInt(e.ActorID, 10)
+		}
+		fmt.Fprintf(&b, "%s · %s · %s %s #%s\n", e.CreatedAt.In(tz).Format("02.01 15:04"), actor, e.Action, e.Entity, e.EntityID)
+		// Creations and deletions would list every field; only show diffs
+		if auditHasValue(e.Before) && auditHasValue(e.After) {
+			for _, c := range auditChanges(e.Before, e.After) {
+				b.WriteString("   " + c + "\n")
+			}
+		}
+	}
+	text := b.String()
+	if len(text) > auditMaxText {
+		text = text[:strings.LastIndex(text[:auditMaxText], "\n")+1] + "…\n"
+	}
+	return text
+}
+
+const auditUsage = "/audit — последние действия\n/audit booking <id> — история записи\n/audit user <telegram_id> — действия пользователя и с его записями"
+
+func parseAuditArgs(args string) (AuditFilter, error) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return AuditFilter{}, nil
+	}
+	if len(fields) != 2 {
+		return AuditFilter{}, fmt.Errorf("expected <booking|user> <id>")
+	}
+	id, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return AuditFilter{}, err
+	}
+	switch fields[0] {
+	case "booking":
+		return AuditFilter{Entity: "slot", EntityID: fields[1]}, nil
+	case "user":
+		return AuditFilter{UserID: id}, nil
+	}
+	return AuditFilter{}, fmt.Errorf("unknown filter %q", fields[0])
+}
+
+// auditCommand handles "/audit [booking <id> | user <id>]".
+func auditCommand(msg *tgbotapi.Message) {
+	filter, err := parseAuditArgs(msg.CommandArguments())
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Неверный фильтр\n\n"+auditUsage))
+		return
+	}
+	entries, err := getAuditLog(filter, auditPageSize)
+	if err != nil {
+		slog.Error("failed to load audit log", "err", err)
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Не удалось загрузить журнал"))
+		return
+	}
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "📜 Журнал действий\n\n"+formatAuditEntries(entries)))
+}
+
+func showAuditLog(cb *tgbotapi.CallbackQuery) {
+	text := "📜 Журнал действий\n\n"
+	entries, err := getAuditLog(AuditFilter{}, auditPageSize)
+	if err != nil {
+		slog.Error("failed to load audit log", "err", err)
+		text += "❌ Не удалось загрузить журнал"
+	} else {
+		text += formatAuditEntries(entries)
+	}
+	text += "\n" + auditUsage
+
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("🔄 Обновить", "admin_audit")},
+		{tgbotapi.NewInlineKeyboardButtonData("← Назад", "admin_back")},
+	}
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, text)
+	editMsg.ReplyMarkup = markup
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// The availability engine decides which dates, times and masters the booking
+// flows offer. Everything that makes time unavailable — bookings, blocks and
+// the centre's closed or shortened days — is checked here so the client and
+// staff flows stay consistent.
+
+const bookingWindowDays = 30
+
+// calendar is everything that limits availability at a location over a range
+// of dates, loaded once per screen. Only masters who perform the package are
+// considered; an empty package key means any. A time is free only if the
+// whole procedure, not just its first hour, fits.
+type calendar struct {
+	location Location
+	duration time.Duration
+	blocks   []SlotBlock
+	closed   map[string]ClosedDay
+	masters  map[string]Master
+	now      time.Time
+}
+
+func loadCalendar(loc Location, pkgKey, from, to string) calendar {
+	return calendar{
+		location: loc,
+		duration: packageDuration(packages[pkgKey]),
+		blocks:   loadBlocks(from, to),
+		closed:   loadClosedDays(from, to, loc.ID),
+		masters:  mastersAt(loc.ID, pkgKey),
+		now:      time.Now(),
+	}
+}
+
+// bookingDates returns the days in the booking window that still have at
+// least one open time at loc for the package.
+func bookingDates(loc Location, pkgKey string) []time.Time {
+	today := loc.today()
+	cal := loadCalendar(loc, pkgKey, today.Format("2006-01-02"), today.AddDate(0, 0, bookingWindowDays-1).Format("2006-01-02"))
+
+	var dates []time.Time
+	for i := 0; i < bookingWindowDays; i++ {
+		date := today.AddDate(0, 0, i)
+		if len(cal.openTimes(date.Format("2006-01-02"))) > 0 {
+			dates = append(dates, date)
+		}
+	}
+	return dates
+}
+
+// availableTimes returns the start times of date that loc is open and at
+// least one of its masters who perform the package isn't blocked.
+func availableTimes(loc Location, pkgKey, date string) []string {
+	return loadCalendar(loc, pkgKey, date, date).openTimes(date)
+}
+
+func (c calendar) openTimes(date string) []string {
+	var times []string
+	for _, t := range bookingTimes {
+		for id := range c.masters {
+			if c.masterOpen(date, t, id) {
+				times = append(times, t)
+				break
+			}
+		}
+	}
+	return times
+}
+
+// centreOpen applies the location's working hours and the closed-days
+// calendar: closed days have no times, shortened days only those that end by
+// closing time.
+func (c calendar) centreOpen(date, slotTime string) bool {
+	if !withinHours(slotTime, c.duration, c.location.Opens, c.location.Closes) {
+		return false
+	}
+	day, ok := c.closed[date]
+	if !ok {
+		return true
+	}
+	return day.Opens != "" && withinHours(slotTime, c.duration, day.Opens, day.Closes)
+}
+
+// withinHours reports whether a procedure of length starting at slotTime
+// fits between opens and closes; empty bounds are open.
+func withinHours(slotTime string, length time.Duration, opens, closes string) bool {
+	start, err := time.Parse("15:04", slotTime)
+	if err != nil {
+		return false
+	}
+	end := start.Add(length)
+	return (opens == "" || slotTime >= opens) && (closes == "" || end.Day() == start.Day() && end.Format("15:04") <= closes)
+}
+
+// upcoming reports whether the slot starts after now in the location's
+// timezone. Wall times skipped by a DST change never are.
+func (c calendar) upcoming(date, slotTime string) bool {
+	start, ok := localTime(c.location.timezone(), date, slotTime)
+	return ok && start.After(c.now)
+}
+
+func (c calendar) masterOpen(date, slotTime, masterID string) bool {
+	if !c.upcoming(date, slotTime) || !c.centreOpen(date, slotTime) {
+		return false
+	}
+	for _, b := range c.blocks {
+		if (b.MasterID == "" || b.MasterID == masterID) && b.appliesAt(c.location.ID) && b.appliesOn(date) && b.coversTime(slotTime, c.duration) {
+			return false
+		}
+	}
+	return true
+}
+
+// availableMasters returns the names of loc's masters who perform the package
+// and are neither booked nor blocked for its whole length from date and time.
+func availableMasters(loc Location, pkgKey, date, time string) []string {
+	return availableMastersExcept(loc, pkgKey, date, time, 0)
+}
+
+// availableMastersExcept ignores the booking with id except, so a booking
+// being moved doesn't overlap itself.
+func availableMastersExcept(loc Location, pkgKey, date, slotTime string, except int) []string {
+	cal := loadCalendar(loc, pkgKey, date, date)
+	start, ok := localTime(loc.timezone(), date, slotTime)
+	if !ok {
+		return nil
+	}
+	bookedMasters := getBookedMasters(loc.ID, start, start.Add(cal.duration), except)
+
+	var available []string
+	for id, master := range cal.masters {
+		if !bookedMasters[master.Name] && cal.masterOpen(date, slotTime, id) {
+			available = append(available, master.Name)
+		}
+	}
+	sort.Strings(available)
+
+	slog.Debug("master availability", "location", loc.ID, "package", pkgKey, "date", date, "time", slotTime, "total", len(cal.masters), "booked", len(bookedMasters), "blocks", len(cal.blocks), "available", len(available))
+	return available
+}
+
+// masterAvailable re-checks a picked master right before booking with the
+// same rules as the pickers, since the screen may be minutes old.
+func masterAvailable(loc Location, pkgKey, date, slotTime, master string) bool {
+	return containsString(availableMasters(loc, pkgKey, date, slotTime), master)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLongPackageOverlaps(t *testing.T) {
+	newTestBot(t)
+	packages["long"] = Package{Key: "long", Name: "Долгая", Price: 7000, Duration: 120}
+	loc := locationByID("main")
+	date := time.Now().In(tz).AddDate(0, 0, 5).Format("2006-01-02")
+	if _, err := bookSlotForClient(date, "12:00", "Ахмед", "Клиент", "+79990000000", "Долгая", "phone", "main", 7000); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pkg, time string
+		free      bool
+	}{
+		{"complex", "11:00", true},
+		{"complex", "12:00", false},
+		{"complex", "13:00", false}, // the two-hour booking runs until 14:00
+		{"complex", "14:00", true},
+		{"long", "10:00", true},
+		{"long", "11:00", false}, // would run into the 12:00 booking
+		{"long", "14:00", true},
+		{"long", "20:00", false}, // the centre closes at 21:00
+	}
+	for _, tt := range tests {
+		if got := masterAvailable(loc, tt.pkg, date, tt.time, "Ахмед"); got != tt.free {
+			t.Errorf("%s at %s: available = %v, want %v", tt.pkg, tt.time, got, tt.free)
+		}
+	}
+	times := availableTimes(loc, "long", date)
+	if want := []string{"09:00", "10:00", "11:00", "12:00", "13:00", "14:00", "15:00", "16:00", "17:00", "18:00", "19:00"}; !reflect.DeepEqual(times, want) {
+		t.Errorf("long package times = %q, want %q", times, want)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/supabase-community/postgrest-go"
+)
+
+// SlotBlock makes time unavailable for one master, or for a whole centre
+// when MasterID is empty: the one in LocationID, or every centre when that is
+// empty too. It applies from StartsOn to EndsOn (open-ended when EndsOn is
+// empty), only on Weekdays if set (0 = Sunday), and to [StartTime, EndTime)
+// or the whole day when the times are empty.
+type SlotBlock struct {
+	ID         int    `json:"id,omitempty"`
+	MasterID   string `json:"master_id,omitempty"`
+	LocationID string `json:"location_id,omitempty"`
+	StartsOn   string `json:"starts_on"`
+	EndsOn     string `json:"ends_on,omitempty"`
+	StartTime  string `json:"start_time,omitempty"`
+	EndTime    string `json:"end_time,omitempty"`
+	Weekdays   []int  `json:"weekdays,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	CreatedBy  int64  `json:"created_by,omitempty"`
+}
+
+var weekdayNames = []string{"вс", "пн", "вт", "ср", "чт", "пт", "сб"}
+
+func (b SlotBlock) appliesOn(date string) bool {
+	if date < b.StartsOn || (b.EndsOn != "" && date > b.EndsOn) {
+		return false
+	}
+	if len(b.Weekdays) == 0 {
+		return true
+	}
+	d, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return false
+	}
+	for _, wd := range b.Weekdays {
+		if time.Weekday(wd) == d.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+func (b SlotBlock) appliesAt(locationID string) bool {
+	return b.LocationID == "" || b.LocationID == locationID
+}
+
+// coversTime reports whether the block overlaps [slotTime, slotTime+length),
+// so a 10:30–11:00 block also takes the 10:00 slot.
+func (b SlotBlock) coversTime(slotTime string, length time.Duration) bool {
+	if b.StartTime == "" {
+		return true
+	}
+	start, err := time.Parse("15:04", slotTime)
+	if err != nil {
+		return false
+	}
+	end := start.Add(length).Format("15:04")
+	if start.Add(length).Day() != start.Day() {
+		end = "24:00"
+	}
+	return slotTime < b.EndTime && end > b.StartTime
+}
+
+func (b SlotBlock) String() string {
+	who := "весь центр"
+	if multipleLocations() {
+		who = "все центры"
+	}
+	if b.LocationID != "" {
+		who = "центр " + locationByID(b.LocationID).Name
+	}
+	if b.MasterID != "" {
+		who = b.MasterID
+		if m, ok := getMaster(b.MasterID); ok {
+			who = m.Name
+		}
+	}
+	when := b.StartsOn
+	switch {
+	case b.EndsOn == "":
+		when += " и далее"
+	case b.EndsOn != b.StartsOn:
+		when += "…" + b.EndsOn
+	}
+	if len(b.Weekdays) > 0 {
+		var days []string
+		for _, wd := range b.Weekdays {
+			days = append(days, weekdayNames[wd])
+		}
+		when += " (" + strings.Join(days, ",") + ")"
+	}
+	if b.StartTime == "" {
+		when += ", весь день"
+	} else {
+		when += ", " + b.StartTime + "–" + b.EndTime
+	}
+	text := fmt.Sprintf("#%d %s: %s", b.ID, who, when)
+	if b.Reason != "" {
+		text += " — " + b.Reason
+	}
+	return text
+}
+
+// loadBlocks returns the blocks that overlap [from, to]. Errors are logged
+// and treated as "no blocks" so a database hiccup doesn't close the centre.
+func loadBlocks(from, to string) []SlotBlock {
+	blocks, err := getBlocks(from, to, "")
+	if err != nil {
+		slog.Error("failed to load slot blocks", "from", from, "to", to, "err", err)
+	}
+	return blocks
+}
+
+func getBlocks(from, to, masterID string) ([]SlotBlock, error) {
+	// postgrest-go keeps a single or=, so the conditions are nested in one and=()
+	conditions := "starts_on.lte." + to + ",or(ends_on.is.null,ends_on.gte." + from + ")"
+	if masterID != "" {
+		conditions += ",or(master_id.is.null,master_id.eq." + masterID + ")"
+	}
+	data, _, err := supabaseClient.From("slot_blocks").Select("*", "exact", false).
+		And(conditions, "").
+		Order("starts_on", &postgrest.OrderOpts{Ascending: true}).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []SlotBlock
+	err = json.Unmarshal(data, &results)
+	return results, err
+}
+
+func getBlock(id int) (SlotBlock, error) {
+	var block SlotBlock
+	data, _, err := supabaseClient.From("slot_blocks").
+		Select("*", "exact", false).
+		Eq("id", strconv.Itoa(id)).
+		Single().
+		Execute()
+	if err != nil {
+		return block, err
+	}
+	err = json.Unmarshal(data, &block)
+	return block, err
+}
+
+func createBlock(b SlotBlock) (SlotBlock, error) {
+	data, _, err := supabaseClient.From("slot_blocks").Insert(b, false, "", "", "").Execute()
+	if err != nil {
+		return b, err
+	}
+	var results []SlotBlock
+	if err := json.Unmarshal(data, &results); err == nil && len(results) > 0 {
+		return results[0], nil
+	}
+	return b, nil
+}
+
+func deleteBlock(id int) error {
+	_, _, err := supabaseClient.From("slot_blocks").
+		Delete("", "").
+		Eq("id", strconv.Itoa(id)).
+		Execute()
+	return err
+}
+
+const blockUsage = `Блокировка времени:
+/block <master_id|all|all@центр> <дата>[..<дата>] [ЧЧ:ММ[-ЧЧ:ММ]] [пн,вт,...] [причина]
+
+Примеры:
+/block all 31.12.2026 Новый год
+/block deni 20.10.2026 13:00 обед
+/block deni 20.10.2026..25.10.2026 отпуск
+/block deni 20.10.2026.. 13:00-14:00 пн,вт,ср,чт,пт обед
+/block all 20.10.2026 18:00-21:00 санобработка
+/block all@center2 20.10.2026 ремонт
+
+all — все центры, all@центр — один центр (id из таблицы locations).
+
+Без времени блокируется весь день, одно время — один слот. Дата с «..» без конца и дни недели задают повторяющуюся блокировку.
+
+/blocks — список блокировок
+/unblock <id> — снять блокировку`
+
+// parseBlockArgs parses the /block arguments described in blockUsage.
+func parseBlockArgs(args string) (SlotBlock, error) {
+	fields := strings.Fields(args)
+	if len(fields) < 2 {
+		return SlotBlock{}, fmt.Errorf("too few arguments")
+	}
+
+	var b SlotBlock
+	target, locationID, scoped := strings.Cut(strings.ToLower(fields[0]), "@")
+	switch {
+	case scoped && target == "all":
+		if _, ok := getLocation(locationID); !ok {
+			return b, fmt.Errorf("unknown location %q", locationID)
+		}
+		b.LocationID = locationID
+	case scoped:
+		return b, fmt.Errorf("only all can be limited to a location")
+	case target != "all":
+		if _, ok := getMaster(target); !ok {
+			return b, fmt.Errorf("unknown master %q", fields[0])
+		}
+		b.MasterID = target
+	}
+
+	from, to, isRange := strings.Cut(fields[1], "..")
+	start, err := parseBlockDate(from)
+	if err != nil {
+		return b, err
+	}
+	b.StartsOn = start
+	b.EndsOn = start
+	if isRange {
+		b.EndsOn = ""
+		if to != "" {
+			if b.EndsOn, err = parseBlockDate(to); err != nil {
+				return b, err
+			}
+			if b.EndsOn < b.StartsOn {
+				return b, fmt.Errorf("range ends before it starts")
+			}
+		}
+	}
+
+	rest := fields[2:]
+	if len(rest) > 0 && strings.Contains(rest[0], ":") {
+		if b.StartTime, b.EndTime, err = parseBlockTimes(rest[0]); err != nil {
+			return b, err
+		}
+		rest = rest[1:]
+	}
+	if len(rest) > 0 {
+		if days, ok := parseWeekdays(rest[0]); ok {
+			b.Weekdays = days
+			rest = rest[1:]
+		}
+	}
+	if b.EndsOn == "" && len(b.Weekdays) == 0 {
+		return b, fmt.Errorf("open-ended blocks need weekdays")
+	}
+	b.Reason = strings.Join(rest, " ")
+	return b, nil
+}
+
+func parseBlockDate(s string) (string, error) {
+	for _, layout := range []string{"02.01.2006", "2006-01-02"} {
+		if d, err := time.Parse(layout, s); err == nil {
+			return d.Format("2006-01-02"), nil
+		}
+	}
+	return "", fmt.Errorf("bad date %q", s)
+}
+
+// parseBlockTimes accepts "13:00" (one slot) or "13:00-15:00".
+func parseBlockTimes(s string) (string, string, error) {
+	from, to, isRange := strings.Cut(s, "-")
+	start, err := time.Parse("15:04", from)
+	if err != nil {
+		return "", "", fmt.Errorf("bad time %q", from)
+	}
+	end := start.Add(time.Hour)
+	if isRange {
+		if end, err = time.Parse("15:04", to); err != nil {
+			return "", "", fmt.Errorf("bad time %q", to)
+		}
+		if !end.After(start) {
+			return "", "", fmt.Errorf("time range ends before it starts")
+		}
+	}
+	return start.Format("15:04"), end.Format("15:04"), nil
+}
+
+func parseWeekdays(s string) ([]int, bool) {
+	var days []int
+	for _, name := range strings.Split(strings.ToLower(s), ",") {
+		found := false
+		for i, wd := range weekdayNames {
+			if name == wd {
+				days = append(days, i)
+				found = true
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return days, true
+}
+
+// canEditBlocks reports whether the user may manage blocks of masterID ("" is
+// the whole centre): staff with the permission manage all, masters only their own.
+func canEditBlocks(userID int64, masterID string) bool {
+	if can(userID, permManageBlocks) {
+		return true
+	}
+	own := masterIDOf(userID)
+	return own != "" && own == masterID
+}
+
+// blockCommand handles "/block ...".
+func blockCommand(msg *tgbotapi.Message) {
+	b, err := parseBlockArgs(msg.CommandArguments())
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Не удалось разобрать блокировку\n\n"+blockUsage))
+		return
+	}
+	if !canEditBlocks(msg.From.ID, b.MasterID) {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "Недостаточно прав"))
+		return
+	}
+	b.CreatedBy = msg.From.ID
+
+	created, err := createBlock(b)
+	if err != nil {
+		slog.Error("failed to create slot block", "master_id", b.MasterID, "err", err)
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Ошибка при сохранении блокировки"))
+		return
+	}
+	writeAudit(msg.From.ID, auditBlockCreate, "slot_block", strconv.Itoa(created.ID), 0, nil, created)
+
+	text := "⛔ Блокировка добавлена\n\n" + created.String()
+	if booked := bookingsUnderBlock(created); len(booked) > 0 {
+		text += "\n\n⚠️ На это время уже есть записи — перенесите или отмените их в расписании:"
+		for _, slot := range booked {
+			text += fmt.Sprintf("\n#%d %s %s %s — %s", slot.ID, slot.Date, slot.Time, slot.MasterName, slot.ClientName)
+		}
+	}
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, text))
+}
+
+// bookingsUnderBlock lists existing bookings a new block overlaps; blocks
+// only stop new bookings, they never cancel anything.
+func bookingsUnderBlock(b SlotBlock) []Slot {
+	to := b.EndsOn
+	if to == "" {
+		to = time.Now().In(tz).AddDate(0, 0, bookingWindowDays).Format("2006-01-02")
+	}
+	slots, err := getSlots(SlotFilter{From: b.StartsOn, To: to, Status: "booked"})
+	if err != nil {
+		slog.Error("failed to check bookings under block", "err", err)
+		return nil
+	}
+	var booked []Slot
+	for _, slot := range slots {
+		_, pkg := resolvePackage(slot.PackageName)
+		if !b.appliesOn(slot.Date) || !b.coversTime(slot.Time, packageDuration(pkg)) {
+			continue
+		}
+		if !b.appliesAt(slotLocation(slot).ID) {
+			continue
+		}
+		if b.MasterID == "" || resolveMaster(slot).ID == b.MasterID {
+			booked = append(booked, slot)
+		}
+	}
+	return booked
+}
+
+// unblockCommand handles "/unblock <id>".
+func unblockCommand(msg *tgbotapi.Message) {
+	id, err := strconv.Atoi(strings.TrimSpace(msg.CommandArguments()))
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, blockUsage))
+		return
+	}
+	if text, ok := removeBlock(msg.From.ID, id); ok {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "✅ Блокировка снята\n\n"+text))
+	} else {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, text))
+	}
+}
+
+func removeBlock(userID int64, id int) (string, bool) {
+	block, err := getBlock(id)
+	if err != nil {
+		return "❌ Блокировка не найдена", false
+	}
+	if !canEditBlocks(userID, block.MasterID) {
+		return "Недостаточно прав", false
+	}
+	if err := deleteBlock(id); err != nil {
+		slog.Error("failed to delete slot block", "block_id", id, "err", err)
+		return "❌ Ошибка при удалении блокировки", false
+	}
+	writeAudit(userID, auditBlockDelete, "slot_block", strconv.Itoa(id), 0, block, nil)
+	return block.String(), true
+}
+
+// blocksText lists upcoming blocks; masterID limits it to that master and
+// centre-wide blocks.
+func blocksText(masterID string) string {
+	from := time.Now().In(tz).Format("2006-01-02")
+	to := time.Now().In(tz).AddDate(1, 0, 0).Format("2006-01-02")
+	blocks, err := getBlocks(from, to, masterID)
+	if err != nil {
+		slog.Error("failed to load slot blocks", "err", err)
+		return "❌ Не удалось загрузить блокировки"
+	}
+	if len(blocks) == 0 {
+		return "⛔ Блокировок нет"
+	}
+	text := "⛔ Блокировки\n"
+	for _, b := range blocks {
+		text += "\n" + b.String()
+	}
+	return text
+}
+
+func blocksCommand(msg *tgbotapi.Message) {
+	masterID := ""
+	if !can(msg.From.ID, permManageBlocks) {
+		masterID = masterIDOf(msg.From.ID)
+	}
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, blocksText(masterID)))
+}
+
+func showAdminBlocks(cb *tgbotapi.CallbackQuery) {
+	from := time.Now().In(tz).Format("2006-01-02")
+	blocks, _ := getBlocks(from, time.Now().In(tz).AddDate(1, 0, 0).Format("2006-01-02"), "")
+
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	for _, b := range blocks {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("❌ Снять #%d", b.ID), fmt.Sprintf("admin_block_del_%d", b.ID)),
+		})
+	}
+	markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("← Назад", "admin_back"),
+	})
+
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, blocksText("")+"\n\n"+blockUsage)
+	editMsg.ReplyMarkup = markup
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
+
+func adminDeleteBlock(cb *tgbotapi.CallbackQuery, data string) {
+	id, _ := strconv.Atoi(strings.TrimPrefix(data, "admin_block_del_"))
+	text, ok := removeBlock(cb.From.ID, id)
+	if !ok {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: text, ShowAlert: true})
+		return
+	}
+	showAdminBlocks(cb)
+}
+
+func showMasterBlocks(cb *tgbotapi.CallbackQuery, data string) {
+	masterID := strings.TrimPrefix(data, "master_blocks_")
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("← Назад", "master_back_"+masterID)},
+	}
+
+	text := blocksText(masterID) + "\n\n" + strings.ReplaceAll(blockUsage, "<master_id|all>", masterID)
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, text)
+	editMsg.ReplyMarkup = markup
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
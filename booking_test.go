@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const testOwnerID = 500
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+	os.Exit(m.Run())
+}
+
+// testBot wires the handlers to a FakeBotAPI and an in-memory database with
+// one centre, one master, one package and one blocking health question.
+type testBot struct {
+	t   *testing.T
+	api *FakeBotAPI
+	db  *fakePostgREST
+
+	handled int // calls made before the latest update
+}
+
+func newTestBot(t *testing.T) *testBot {
+	t.Helper()
+	cfg = &Config{
+		Timezone:      "Europe/Moscow",
+		Admins:        []int64{testOwnerID},
+		Workers:       4,
+		PaymentHold:   15 * time.Minute,
+		FeedbackDelay: 3 * time.Hour,
+	}
+	var err error
+	if tz, err = time.LoadLocation(cfg.Timezone); err != nil {
+		t.Fatal(err)
+	}
+
+	db := newFakePostgREST()
+	t.Cleanup(db.Close)
+	db.seed("locations", map[string]interface{}{
+		"id": "main", "name": "HGN Москва", "address": "Мичуринский проспект, 19к1",
+		"timezone": "Europe/Moscow", "opens": "09:00", "closes": "21:00", "active": true,
+	})
+	db.seed("masters", map[string]interface{}{"id": "m1", "name": "Ахмед", "code": "1111", "gender": "male", "active": true})
+	db.seed("packages", map[string]interface{}{"key": "complex", "name": "Комплекс", "price": 5000, "desc": "Общеоздоровительная хиджама", "duration_minutes": 60})
+	db.seed("health_questions", map[string]interface{}{
+		"position": 1, "question": "Есть ли у вас кардиостимулятор?", "kind": questionYesNo,
+		"trigger_answer": "yes", "action": healthBlock, "advice": "Проконсультируйтесь с кардиологом.",
+	})
+	cfg.SupabaseURL, cfg.SupabaseKey = db.URL(), "test-key"
+	initDB()
+
+	fake, err := NewFakeBotAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fake.Close() })
+	if api, err = tgbotapi.NewBotAPIWithAPIEndpoint("test-token", fake.Endpoint()); err != nil {
+		t.Fatal(err)
+	}
+	bot = api
+	fake.Reset()
+
+	setMasters(loadMastersFromDB())
+	setLocations(loadLocationsFromDB())
+	packages = loadPackagesFromDB()
+	loadRolesFromDB()
+	loyaltyMu.Lock()
+	loyaltyRules = LoyaltyRules{}
+	loyaltyMu.Unlock()
+	loadAllSessions()
+	payments = nil
+	return &testBot{t: t, api: fake, db: db}
+}
+
+// handle runs update through the bot as the dispatcher would.
+func (b *testBot) handle(update tgbotapi.Update) {
+	b.handled = len(b.api.Calls())
+	handleUpdate(context.Background(), update)
+}
+
+// last returns the bot's latest call of method.
+func (b *testBot) last(method string) FakeCall {
+	b.t.Helper()
+	call, ok := b.api.Last(method)
+	if !ok {
+		b.t.Fatalf("no %s call; calls: %v", method, b.api.Calls())
+	}
+	return call
+}
+
+func (b *testBot) expectText(call FakeCall, want string) {
+	b.t.Helper()
+	if call.Text() != want {
+		b.t.Errorf("%s text = %q, want %q", call.Method, call.Text(), want)
+	}
+}
+
+func (b *testBot) expectKeyboard(call FakeCall, want [][]string) {
+	b.t.Helper()
+	if got := call.InlineKeyboard(); !reflect.DeepEqual(got, want) {
+		b.t.Errorf("%s keyboard = %q, want %q", call.Method, got, want)
+	}
+}
+
+// expectAnswer checks that the latest update answered its callback with
+// text, whatever else it answered.
+func (b *testBot) expectAnswer(want string) {
+	b.t.Helper()
+	var got []string
+	for _, c := range b.api.Calls()[b.handled:] {
+		if c.Method == "answerCallbackQuery" {
+			if c.Params.Get("text") == want {
+				return
+			}
+			got = append(got, c.Params.Get("text"))
+		}
+	}
+	b.t.Errorf("callback answers = %q, want %q", got, want)
+}
+
+// bookUntilConfirmation scripts the client from /start to the confirmation
+// screen, picking the fifth offered day so the booking can still be
+// cancelled, and returns the chosen date, time and the message being edited.
+func (b *testBot) bookUntilConfirmation(u *FakeUser) (date, slotTime string, messageID int) {
+	b.t.Helper()
+	b.handle(u.Text("/start"))
+	start := b.last("sendMessage")
+	b.expectText(start, "HGN · Доступ активирован\nРегистрация не требуется")
+	if got, want := start.ReplyKeyboard(), [][]string{{"📍 Записаться на Хиджаму"}, {"📋 Мои записи", "👤 Профиль"}, {"Другие возможности"}}; !reflect.DeepEqual(got, want) {
+		b.t.Errorf("main menu = %q, want %q", got, want)
+	}
+
+	b.handle(u.Text("📍 Записаться на Хиджаму"))
+	services := b.last("sendMessage")
+	b.expectText(services, "Выберите услугу:")
+	b.expectKeyboard(services, [][]string{{"Комплекс — 5000 ₽|package_complex"}})
+	messageID = services.MessageID
+
+	b.handle(u.Press(messageID, "package_complex"))
+	edit := b.last("editMessageText")
+	b.expectText(edit, "Комплекс\n\nОбщеоздоровительная хиджама\n\nСтоимость: 5000 ₽\n\nВыберите пол:")
+	b.expectKeyboard(edit, [][]string{{"Мужчина|gender_male", "Женщина|gender_female"}, {"← Назад|back_packages"}})
+
+	b.handle(u.Press(messageID, "gender_male"))
+	edit = b.last("editMessageText")
+	b.expectText(edit, "Вам есть 18 лет?")
+	b.expectKeyboard(edit, [][]string{{"Да, 18+|age_yes"}, {"Нет|age_no"}})
+
+	b.handle(u.Press(messageID, "age_yes"))
+	edit = b.last("editMessageText")
+	b.expectText(edit, "🩺 Анкета о здоровье (1 из 1)\n\nЕсть ли у вас кардиостимулятор?")
+	b.expectKeyboard(edit, [][]string{{"Да|health_yes", "Нет|health_no"}, {"← Назад|back_to_gender"}})
+
+	b.handle(u.Press(messageID, "health_no"))
+	edit = b.last("editMessageText")
+	b.expectText(edit, "Прежде чем начать запись, укажите свое имя:")
+	b.expectKeyboard(edit, [][]string{{"← Назад|back_to_gender"}})
+
+	b.handle(u.Text("Иван"))
+	b.expectText(b.last("sendMessage"), "Укажите ваш номер телефона:")
+
+	b.handle(u.Text("+79991234567"))
+	dates := b.last("sendMessage")
+	b.expectText(dates, "Выберите дату:\n⭐ — 17, 19 и 21 число по хиджре, рекомендованные дни для хиджамы")
+	rows := dates.InlineKeyboard()
+	if len(rows) < 7 {
+		b.t.Fatalf("date picker rows = %q, want five days, paging and the Sunnah toggle", rows)
+	}
+	if got := rows[len(rows)-1]; !reflect.DeepEqual(got, []string{"⭐ Только дни сунны|sunnah_only_on"}) {
+		b.t.Errorf("last date picker row = %q", got)
+	}
+	_, dateData, _ := strings.Cut(rows[4][0], "|")
+	date = strings.TrimPrefix(dateData, "date_")
+	messageID = dates.MessageID
+
+	b.handle(u.Press(messageID, dateData))
+	times := b.last("editMessageText")
+	b.expectText(times, "Доступное время на "+date+":")
+	var wantTimes [][]string
+	for _, t := range bookingTimes {
+		wantTimes = append(wantTimes, []string{t + "|time_" + date + "_" + t})
+	}
+	b.expectKeyboard(times, append(wantTimes, []string{"← Назад|back_to_date"}))
+	slotTime = "10:00"
+
+	b.handle(u.Press(messageID, "time_"+date+"_"+slotTime))
+	edit = b.last("editMessageText")
+	b.expectText(edit, fmt.Sprintf("Выберите мастера на %s %s:", date, slotTime))
+	b.expectKeyboard(edit, [][]string{{"Ахмед|master_Ахмед"}, {"← Назад|back_to_time"}})
+
+	b.handle(u.Press(messageID, "master_Ахмед"))
+	edit = b.last("editMessageText")
+	confirmation := fmt.Sprintf("Подтвердите запись:\n\n📅 %s\n🕐 %s\n👨⚕️ Ахмед\n💼 Комплекс\n💰 5000 ₽\n\nЦентр: HGN Москва\nАдрес: Мичуринский проспект, 19к1", date, slotTime)
+	if amount := prepaymentFor(packages["complex"], 5000); amount > 0 {
+		confirmation += fmt.Sprintf("\n\n💳 Предоплата %d ₽ онлайн, время держится %d мин.", amount, int(cfg.PaymentHold.Minutes()))
+	}
+	b.expectText(edit, confirmation)
+	b.expectKeyboard(edit, [][]string{{"✅ Подтвердить|confirm_booking"}, {"🎟 Ввести промокод|promo_enter"}, {"← Назад|back_to_master"}})
+	return date, slotTime, messageID
+}
+
+func TestBookAndCancel(t *testing.T) {
+	b := newTestBot(t)
+	client := &FakeUser{ID: 1001, UserName: "ivan"}
+	date, slotTime, messageID := b.bookUntilConfirmation(client)
+
+	b.handle(client.Press(messageID, "confirm_booking"))
+	b.expectText(b.last("editMessageText"), fmt.Sprintf("✅ Запись подтверждена!\n\n📅 %s\n🕐 %s\n👨⚕️ Ахмед\n\nЦентр: HGN Москва\nАдрес: Мичуринский проспект, 19к1", date, slotTime))
+	b.expectAnswer("Запись успешна!")
+	doc := b.last("sendDocument")
+	if want := "document:hijama_" + date + ".ics"; !reflect.DeepEqual(doc.Files, []string{want}) {
+		b.t.Errorf("calendar file = %q, want %q", doc.Files, want)
+	}
+	notify := b.last("sendMessage")
+	if notify.ChatID() != testOwnerID || !strings.HasPrefix(notify.Text(), "🔔 Новая запись!\n\n📍 HGN Москва\n👨⚕️ Ахмед\n📅 "+date+"\n🕐 "+slotTime) {
+		t.Errorf("staff notification to %d: %q", notify.ChatID(), notify.Text())
+	}
+
+	booked := b.db.rows("slots", map[string]string{"status": "booked"})
+	if len(booked) != 1 {
+		t.Fatalf("booked slots = %v, want one", booked)
+	}
+	slotID, _ := fakeValue(booked[0]["id"])
+	if booked[0]["user_id"] != "1001" || booked[0]["client_name"] != "Иван" || booked[0]["date"] != date || booked[0]["time"] != slotTime {
+		t.Errorf("booked slot = %v", booked[0])
+	}
+	if hasUserSession(client.ID) {
+		t.Error("session kept after booking")
+	}
+
+	b.handle(client.Text("📋 Мои записи"))
+	mine := b.last("sendMessage")
+	b.expectText(mine, fmt.Sprintf("📋 Ваша запись:\n\n📅 %s\n🕐 %s\n👨‍⚕️ Ахмед\n\nЦентр: HGN Москва\nАдрес: Мичуринский проспект, 19к1\n\n⚠️ Отмена возможна за 2 часа до процедуры", date, slotTime))
+	b.expectKeyboard(mine, [][]string{{"❌ Отменить запись|cancel_booking_" + slotID}})
+
+	b.handle(client.Press(mine.MessageID, "cancel_booking_"+slotID))
+	b.expectText(b.last("editMessageText"), "✅ Запись отменена")
+	b.expectAnswer("Запись отменена")
+	notify = b.last("sendMessage")
+	if notify.ChatID() != testOwnerID || !strings.HasPrefix(notify.Text(), "❌ Отмена записи\n\n👨⚕️ Ахмед\n📅 "+date+"\n🕐 "+slotTime) {
+		t.Errorf("staff notification to %d: %q", notify.ChatID(), notify.Text())
+	}
+	if got := b.db.rows("slots", map[string]string{"id": slotID, "status": "cancelled"}); len(got) != 1 {
+		t.Errorf("slot %s not cancelled", slotID)
+	}
+}
+
+func TestConfirmTakenSlot(t *testing.T) {
+	b := newTestBot(t)
+	client := &FakeUser{ID: 1002, UserName: "oleg"}
+	date, slotTime, messageID := b.bookUntilConfirmation(client)
+	// Someone else booked the time while the confirmation screen was open
+	taken := map[string]interface{}{"date": date, "time": slotTime, "master_id": "m1", "master_name": "Ахмед", "status": "booked", "location_id": "main"}
+	setSlotInstants(taken, slotFromRow(taken))
+	b.db.seed("slots", taken)
+
+	b.handle(client.Press(messageID, "confirm_booking"))
+	b.expectAnswer("Это время уже занято, выберите другое")
+	edit := b.last("editMessageText")
+	b.expectText(edit, fmt.Sprintf("Выберите мастера на %s %s:", date, slotTime))
+	b.expectKeyboard(edit, [][]string{{"← Назад|back_to_time"}})
+	if got := b.db.rows("slots", map[string]string{"user_id": "1002"}); len(got) != 0 {
+		t.Errorf("slot booked over another booking: %v", got)
+	}
+}
+
+func TestHealthQuestionStopsBooking(t *testing.T) {
+	b := newTestBot(t)
+	client := &FakeUser{ID: 1003, UserName: "anna"}
+	b.handle(client.Text("📍 Записаться на Хиджаму"))
+	messageID := b.last("sendMessage").MessageID
+	b.handle(client.Press(messageID, "package_complex"))
+	b.handle(client.Press(messageID, "gender_female"))
+	b.handle(client.Press(messageID, "age_yes"))
+
+	b.handle(client.Press(messageID, "health_yes"))
+	edit := b.last("editMessageText")
+	b.expectText(edit, "⛔ По вашим ответам хиджаму сейчас делать нельзя без консультации врача.\n\nПроконсультируйтесь с кардиологом.\n\nЕсли врач разрешит процедуру, запишитесь снова или свяжитесь с центром.")
+	b.expectKeyboard(edit, nil)
+	if hasUserSession(client.ID) {
+		t.Error("session kept after a blocking answer")
+	}
+
+	// A stale confirmation button can't skip the questionnaire
+	session := getSession(client.ID)
+	for k, v := range map[string]string{"package": "complex", "gender": "female", "location": "main", "master": "Ахмед", "date": time.Now().AddDate(0, 0, 3).Format("2006-01-02"), "time": "10:00"} {
+		session.Data[k] = v
+	}
+	setSession(client.ID, session)
+	b.handle(client.Press(messageID, "confirm_booking"))
+	b.expectAnswer("Сначала заполните анкету о здоровье — начните запись заново")
+	if got := b.db.rows("slots", nil); len(got) != 0 {
+		t.Errorf("booked without the questionnaire: %v", got)
+	}
+}
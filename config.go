@@ -4,7 +4,9 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/joho/godotenv"
 )
 
@@ -16,6 +18,18 @@ type Config struct {
 	DevPassword    string
 	SupabaseURL    string
 	SupabaseKey    string
+	HTTPAddr       string
+	PublicURL      string
+	ICSSecret      string
+	WebhookURL     string
+	WebhookSecret  string
+	Workers        int
+	StopTimeout    time.Duration
+	APIEndpoint    string
+	LogFormat      string
+	PaymentToken   string
+	PaymentHold    time.Duration
+	FeedbackDelay  time.Duration
 }
 
 func loadConfig() (*Config, error) {
@@ -26,14 +40,44 @@ func loadConfig() (*Config, error) {
 
 	cfg := &Config{
 		Token:          os.Getenv("BOT_TOKEN"),
-		Timezone:       "Europe/Moscow",
-		DevPassword:    getEnv("DEV_PASSWORD", "4116"),
-		Debug:          false,
+		Timezone:       getEnv("TIMEZONE", "Europe/Moscow"),
+		DevPassword:    os.Getenv("DEV_PASSWORD"),
+		Debug:          os.Getenv("DEBUG") == "true",
 		SupabaseURL:    os.Getenv("SUPABASE_URL"),
 		SupabaseKey:    os.Getenv("SUPABASE_KEY"),
+		HTTPAddr:       os.Getenv("HTTP_ADDR"),
+		PublicURL:      strings.TrimRight(os.Getenv("PUBLIC_URL"), "/"),
+		ICSSecret:      os.Getenv("ICS_SECRET"),
+		WebhookURL:     os.Getenv("WEBHOOK_URL"),
+		WebhookSecret:  os.Getenv("WEBHOOK_SECRET"),
+		Workers:        8,
+		StopTimeout:    25 * time.Second,
+		APIEndpoint:    getEnv("TELEGRAM_API_ENDPOINT", tgbotapi.APIEndpoint),
+		LogFormat:      getEnv("LOG_FORMAT", "text"),
+		PaymentToken:   os.Getenv("PAYMENT_PROVIDER_TOKEN"),
+		PaymentHold:    15 * time.Minute,
+		FeedbackDelay:  3 * time.Hour,
 	}
 
-	// Load admins
+	if n, err := strconv.Atoi(os.Getenv("WORKERS")); err == nil && n > 0 {
+		cfg.Workers = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("STOP_TIMEOUT")); err == nil && d > 0 {
+		cfg.StopTimeout = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("PAYMENT_HOLD")); err == nil && d > 0 {
+		cfg.PaymentHold = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("FEEDBACK_DELAY")); err == nil && d > 0 {
+		cfg.FeedbackDelay = d
+	}
+
+	// Webhook mode needs the HTTP server
+	if cfg.WebhookURL != "" && cfg.HTTPAddr == "" {
+		cfg.HTTPAddr = ":8080"
+	}
+
+	// Bootstrap owners; all other roles live in the user_roles table
 	adminsStr := os.Getenv("ADMINS")
 	if adminsStr != "" {
 		parts := strings.Split(adminsStr, ",")
@@ -42,8 +86,6 @@ func loadConfig() (*Config, error) {
 				cfg.Admins = append(cfg.Admins, id)
 			}
 		}
-	} else {
-		cfg.Admins = []int64{348038520, 1831673006, 7401260307, 6064116707}
 	}
 
 	return cfg, nil
@@ -2,20 +2,29 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"strings"
 	"time"
 
+	"github.com/supabase-community/postgrest-go"
 	"github.com/supabase-community/supabase-go"
 )
 
 type Master struct {
-	ID      string `json:"id"`
-	Name    string `json:"name"`
-	Code    string `json:"code"`
-	Contact string `json:"contact"`
-	Gender  string `json:"gender"`
-	Active  bool   `json:"active"`
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Code       string `json:"code"`
+	Contact    string `json:"contact"`
+	Gender     string `json:"gender"`
+	Active     bool   `json:"active"`
+	LocationID string `json:"location_id"`
+
+	PhotoFileID string   `json:"photo_file_id"`
+	Bio         string   `json:"bio"`
+	Experience  int      `json:"experience_years"`
+	Packages    []string `json:"packages"`
 }
 
 type UserSession struct {
@@ -28,17 +37,48 @@ type UserSession struct {
 }
 
 type Slot struct {
-	ID         int       `json:"id"`
-	Date       string    `json:"date"`
-	Time       string    `json:"time"`
-	Gender     string    `json:"gender"`
-	MasterID   string    `json:"master_id"`
-	MasterName string    `json:"master_name"`
-	Status     string    `json:"status"`
-	UserID     string    `json:"user_id"`
-	Username   string    `json:"username"`
-	BookedAt   time.Time `json:"booked_at"`
-	Source     string    `json:"source"`
+	ID          int       `json:"id"`
+	Date        string    `json:"date"`
+	Time        string    `json:"time"`
+	Gender      string    `json:"gender"`
+	MasterID    string    `json:"master_id"`
+	MasterName  string    `json:"master_name"`
+	Status      string    `json:"status"`
+	UserID      string    `json:"user_id"`
+	Username    string    `json:"username"`
+	ClientName  string    `json:"client_name"`
+	ClientPhone string    `json:"client_phone"`
+	PackageName string    `json:"package_name"`
+	BookedAt    time.Time `json:"booked_at"`
+	CancelledAt time.Time `json:"cancelled_at"`
+	Source      string    `json:"source"`
+	LocationID  string    `json:"location_id"`
+	StartsAt    time.Time `json:"starts_at"`
+	EndsAt      time.Time `json:"ends_at"`
+	Price       int       `json:"price"`
+	Discount    int       `json:"discount"`
+	PromoCode   string    `json:"promo_code"`
+
+	VisitDiscount int `json:"visit_discount"`
+	PointsSpent   int `json:"points_spent"`
+
+	PaymentStatus    string    `json:"payment_status"`
+	PaymentAmount    int       `json:"payment_amount"`
+	PaymentChargeID  string    `json:"payment_charge_id"`
+	ProviderChargeID string    `json:"provider_charge_id"`
+	HoldExpiresAt    time.Time `json:"hold_expires_at"`
+	PaidAt           time.Time `json:"paid_at"`
+
+	HealthAnswers []HealthAnswer `json:"health_answers"`
+	HealthFlag    bool           `json:"health_flag"`
+}
+
+type SlotFilter struct {
+	From        string
+	To          string
+	MasterName  string
+	Status      string
+	PackageName string
 }
 
 var supabaseClient *supabase.Client
@@ -48,9 +88,9 @@ func initDB() {
 	var err error
 	supabaseClient, err = supabase.NewClient(cfg.SupabaseURL, cfg.SupabaseKey, nil)
 	if err != nil {
-		log.Fatal("Failed to initialize Supabase client:", err)
+		fatal("failed to initialize Supabase client", "err", err)
 	}
-	log.Println("Supabase client initialized")
+	slog.Info("Supabase client initialized")
 }
 
 func loadMastersFromDB() map[string]Master {
@@ -58,25 +98,24 @@ func loadMastersFromDB() map[string]Master {
 	
 	data, _, err := supabaseClient.From("masters").Select("*", "exact", false).Execute()
 	if err != nil {
-		log.Printf("Error loading masters: %v", err)
+		slog.Error("failed to load masters", "err", err)
 		return masters
 	}
 	
 	var results []Master
 	err = json.Unmarshal(data, &results)
 	if err != nil {
-		log.Printf("Error unmarshaling masters: %v", err)
+		slog.Error("failed to decode masters", "err", err)
 		return masters
 	}
 	
-	log.Printf("Loaded %d masters from DB", len(results))
 	for _, m := range results {
-		log.Printf("Master: %s, Active: %v", m.Name, m.Active)
+		slog.Debug("master loaded", "master", m.Name, "active", m.Active)
 		if m.Active {
 			masters[m.ID] = m
 		}
 	}
-	log.Printf("Active masters: %d", len(masters))
+	slog.Info("masters loaded", "total", len(results), "active", len(masters))
 	return masters
 }
 
@@ -85,7 +124,7 @@ func loadPackagesFromDB() map[string]Package {
 	
 	data, _, err := supabaseClient.From("packages").Select("*", "exact", false).Execute()
 	if err != nil {
-		log.Printf("Error loading packages: %v", err)
+		slog.Error("failed to load packages", "err", err)
 		return packages
 	}
 	
@@ -98,18 +137,26 @@ func loadPackagesFromDB() map[string]Package {
 	return packages
 }
 
-func getBookedMasters(date, time string) map[string]bool {
+// getBookedMasters returns the masters whose bookings at the location overlap
+// [start, end), comparing starts_at/ends_at so procedures longer than a slot
+// and DST changes are accounted for. Bookings at other centres count only for
+// masters who work at every centre, so a namesake elsewhere doesn't take the
+// slot. The booking with id except, if any, is ignored.
+func getBookedMasters(locationID string, start, end time.Time, except int) map[string]bool {
 	booked := make(map[string]bool)
 	
-	data, _, err := supabaseClient.From("slots").
-		Select("master_name", "exact", false).
-		Eq("date", date).
-		Eq("time", time).
+	query := supabaseClient.From("slots").
+		Select("id,master_name,master_id,location_id", "exact", false).
 		Eq("status", "booked").
-		Execute()
+		Lt("starts_at", dbTimestamp(end)).
+		Gt("ends_at", dbTimestamp(start))
+	if except != 0 {
+		query = query.Neq("id", fmt.Sprintf("%d", except))
+	}
+	data, _, err := query.Execute()
 	
 	if err != nil {
-		log.Printf("Error getting booked masters: %v", err)
+		slog.Error("failed to get booked masters", "start", start, "end", end, "err", err)
 		return booked
 	}
 	
@@ -117,13 +164,14 @@ func getBookedMasters(date, time string) map[string]bool {
 	json.Unmarshal(data, &results)
 	
 	for _, slot := range results {
-		booked[slot.MasterName] = true
+		if slotLocation(slot).ID == locationID || resolveMaster(slot).LocationID == "" {
+			booked[slot.MasterName] = true
+		}
 	}
 	return booked
 }
 
 func bookSlot(date, slotTime, gender, master string, userID int64, username string) error {
-	moscowTime := time.Now().In(tz)
 	slot := map[string]interface{}{
 		"date":        date,
 		"time":        slotTime,
@@ -132,20 +180,19 @@ func bookSlot(date, slotTime, gender, master string, userID int64, username stri
 		"status":      "booked",
 		"user_id":     fmt.Sprintf("%d", userID),
 		"username":    username,
-		"booked_at":   moscowTime.Format("2006-01-02 15:04:05"),
+		"booked_at":   dbTimestamp(time.Now()),
 		"source":      "bot",
 	}
 	
-	log.Printf("Booking slot: %+v", slot)
+	slog.Info("booking slot", "date", date, "time", slotTime, "master", master, "user_id", userID)
 	_, _, err := supabaseClient.From("slots").Insert(slot, false, "", "", "").Execute()
 	if err != nil {
-		log.Printf("Error booking slot: %v", err)
+		slog.Error("failed to book slot", "date", date, "time", slotTime, "master", master, "err", err)
 	}
 	return err
 }
 
 func bookSlotWithContact(date, slotTime, gender, master string, userID int64, username, clientName, clientPhone string) error {
-	moscowTime := time.Now().In(tz)
 	slot := map[string]interface{}{
 		"date":         date,
 		"time":         slotTime,
@@ -156,40 +203,137 @@ func bookSlotWithContact(date, slotTime, gender, master string, userID int64, us
 		"username":     username,
 		"client_name":  clientName,
 		"client_phone": clientPhone,
-		"booked_at":    moscowTime.Format("2006-01-02 15:04:05"),
+		"booked_at":    dbTimestamp(time.Now()),
 		"source":       "bot",
 	}
 	
-	log.Printf("Booking slot: %+v", slot)
+	slog.Info("booking slot", "date", date, "time", slotTime, "master", master, "user_id", userID)
 	_, _, err := supabaseClient.From("slots").Insert(slot, false, "", "", "").Execute()
 	if err != nil {
-		log.Printf("Error booking slot: %v", err)
+		slog.Error("failed to book slot", "date", date, "time", slotTime, "master", master, "err", err)
 	}
 	return err
 }
 
-func bookSlotWithPackage(date, slotTime, gender, master string, userID int64, username, clientName, clientPhone, packageName string) error {
-	moscowTime := time.Now().In(tz)
+func bookSlotWithPackage(date, slotTime, gender, master string, userID int64, username, clientName, clientPhone, packageName, locationID string, quote Quote) (Slot, error) {
 	slot := map[string]interface{}{
-		"date":          date,
-		"time":          slotTime,
-		"gender":        gender,
-		"master_name":   master,
-		"status":        "booked",
-		"user_id":       fmt.Sprintf("%d", userID),
-		"username":      username,
-		"client_name":   clientName,
-		"client_phone":  clientPhone,
-		"package_name":  packageName,
-		"booked_at":     moscowTime.Format("2006-01-02 15:04:05"),
-		"source":        "bot",
+		"date":           date,
+		"time":           slotTime,
+		"gender":         gender,
+		"master_name":    master,
+		"status":         "booked",
+		"user_id":        fmt.Sprintf("%d", userID),
+		"username":       username,
+		"client_name":    clientName,
+		"client_phone":   clientPhone,
+		"package_name":   packageName,
+		"booked_at":      dbTimestamp(time.Now()),
+		"source":         "bot",
+		"location_id":    locationID,
+		"price":          quote.Price,
+		"discount":       quote.Discount,
+		"visit_discount": quote.VisitDiscount,
+		"points_spent":   quote.Points,
+	}
+	if quote.PromoCode != "" {
+		slot["promo_code"] = quote.PromoCode
+	}
+	if m := resolveMaster(Slot{MasterName: master, LocationID: locationID}); m.ID != "" {
+		slot["master_id"] = m.ID
 	}
 	
-	log.Printf("Booking slot: %+v", slot)
-	_, _, err := supabaseClient.From("slots").Insert(slot, false, "", "", "").Execute()
+	slog.Info("booking slot", "date", date, "time", slotTime, "master", master, "user_id", userID)
+	return insertSlot(slot)
+}
+
+// bookSlotForClient books a slot taken by staff for a client without
+// Telegram; source is "phone" or "walk_in".
+func bookSlotForClient(date, slotTime, master, clientName, clientPhone, packageName, source, locationID string, price int) (Slot, error) {
+	slot := map[string]interface{}{
+		"date":         date,
+		"time":         slotTime,
+		"gender":       "any",
+		"master_name":  master,
+		"status":       "booked",
+		"client_name":  clientName,
+		"client_phone": clientPhone,
+		"package_name": packageName,
+		"booked_at":    dbTimestamp(time.Now()),
+		"source":       source,
+		"location_id":  locationID,
+		"price":        price,
+	}
+	if m := resolveMaster(Slot{MasterName: master, LocationID: locationID}); m.ID != "" {
+		slot["master_id"] = m.ID
+	}
+
+	slog.Info("booking slot for client", "date", date, "time", slotTime, "master", master, "source", source)
+	return insertSlot(slot)
+}
+
+// errSlotTaken is returned when the master already has a booking at that
+// time; the unique index on booked slots settles concurrent bookings.
+var errSlotTaken = errors.New("slot already booked")
+
+// isUniqueViolation reports whether err is a PostgreSQL unique_violation as
+// postgrest-go formats it: "(23505) duplicate key value ...".
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "(23505)")
+}
+
+func insertSlot(slot map[string]interface{}) (Slot, error) {
+	setSlotInstants(slot, slotFromRow(slot))
+	data, _, err := supabaseClient.From("slots").Insert(slot, false, "", "", "").Execute()
+	if isUniqueViolation(err) {
+		slog.Info("slot already booked", "date", slot["date"], "time", slot["time"], "master", slot["master_name"])
+		return Slot{}, errSlotTaken
+	}
 	if err != nil {
-		log.Printf("Error booking slot: %v", err)
+		slog.Error("failed to book slot", "date", slot["date"], "time", slot["time"], "master", slot["master_name"], "err", err)
+		return Slot{}, err
+	}
+
+	var results []Slot
+	if err := json.Unmarshal(data, &results); err != nil || len(results) == 0 {
+		return slotFromRow(slot), nil
 	}
+	return results[0], nil
+}
+
+func slotFromRow(row map[string]interface{}) Slot {
+	slot := Slot{}
+	slot.Date, _ = row["date"].(string)
+	slot.Time, _ = row["time"].(string)
+	slot.MasterName, _ = row["master_name"].(string)
+	slot.PackageName, _ = row["package_name"].(string)
+	slot.ClientName, _ = row["client_name"].(string)
+	slot.LocationID, _ = row["location_id"].(string)
+	return slot
+}
+
+// getUnlinkedBookings returns upcoming bookings made by staff that are not
+// yet tied to a Telegram account.
+func getUnlinkedBookings() ([]Slot, error) {
+	data, _, err := supabaseClient.From("slots").
+		Select("*", "exact", false).
+		Is("user_id", "null").
+		Eq("status", "booked").
+		Gte("date", time.Now().In(tz).Format("2006-01-02")).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Slot
+	err = json.Unmarshal(data, &results)
+	return results, err
+}
+
+func linkBooking(slotID int, userID int64, username string) error {
+	_, _, err := supabaseClient.From("slots").
+		Update(map[string]interface{}{"user_id": fmt.Sprintf("%d", userID), "username": username}, "", "").
+		Eq("id", fmt.Sprintf("%d", slotID)).
+		Execute()
 	return err
 }
 
@@ -209,11 +353,81 @@ func getUserBookings(userID int64) ([]Slot, error) {
 	return results, nil
 }
 
+// slotsPage is how many rows getSlots asks for at once; Supabase returns at
+// most 1000 rows per request (max-rows).
+const slotsPage = 1000
+
+func getSlots(filter SlotFilter) ([]Slot, error) {
+	var results []Slot
+	for {
+		query := supabaseClient.From("slots").Select("*", "exact", false)
+		// postgrest-go keeps one filter per column, so both date bounds go into a single and=()
+		var dateRange []string
+		if filter.From != "" {
+			dateRange = append(dateRange, "date.gte."+filter.From)
+		}
+		if filter.To != "" {
+			dateRange = append(dateRange, "date.lte."+filter.To)
+		}
+		if len(dateRange) > 0 {
+			query = query.And(strings.Join(dateRange, ","), "")
+		}
+		if filter.MasterName != "" {
+			query = query.Eq("master_name", filter.MasterName)
+		}
+		if filter.Status != "" {
+			query = query.Eq("status", filter.Status)
+		}
+		if filter.PackageName != "" {
+			query = query.Eq("package_name", filter.PackageName)
+		}
+
+		data, total, err := query.
+			Order("date", &postgrest.OrderOpts{Ascending: true}).
+			Order("time", &postgrest.OrderOpts{Ascending: true}).
+			Order("id", &postgrest.OrderOpts{Ascending: true}).
+			Range(len(results), len(results)+slotsPage-1, "").
+			Execute()
+		if err != nil {
+			return nil, err
+		}
+
+		var page []Slot
+		if err := json.Unmarshal(data, &page); err != nil {
+			return nil, err
+		}
+		results = append(results, page...)
+		// The server may cap pages below slotsPage, so stop on the total count
+		if len(page) == 0 || int64(len(results)) >= total {
+			return results, nil
+		}
+	}
+}
+
+// getRecentSlots returns the latest slots by orderBy (booked_at, cancelled_at), optionally only with the given status.
+func getRecentSlots(orderBy, status string, limit int) ([]Slot, error) {
+	query := supabaseClient.From("slots").Select("*", "exact", false)
+	if status != "" {
+		query = query.Eq("status", status)
+	}
+	data, _, err := query.
+		Not(orderBy, "is", "null").
+		Order(orderBy, &postgrest.OrderOpts{Ascending: false}).
+		Limit(limit, "").
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Slot
+	err = json.Unmarshal(data, &results)
+	return results, err
+}
+
 func cancelBooking(slotID int) error {
-	moscowTime := time.Now().In(tz)
 	update := map[string]interface{}{
 		"status":       "cancelled",
-		"cancelled_at": moscowTime.Format("2006-01-02 15:04:05"),
+		"cancelled_at": dbTimestamp(time.Now()),
 	}
 	
 	_, _, err := supabaseClient.From("slots").
@@ -224,6 +438,36 @@ func cancelBooking(slotID int) error {
 	return err
 }
 
+func setSlotStatus(slotID int, status string) error {
+	_, _, err := supabaseClient.From("slots").
+		Update(map[string]interface{}{"status": status}, "", "").
+		Eq("id", fmt.Sprintf("%d", slotID)).
+		Execute()
+	return err
+}
+
+func rescheduleSlot(slot Slot, date, slotTime, master, masterID string) error {
+	update := map[string]interface{}{
+		"date":        date,
+		"time":        slotTime,
+		"master_name": master,
+		"master_id":   nil,
+	}
+	if masterID != "" {
+		update["master_id"] = masterID
+	}
+	slot.Date, slot.Time = date, slotTime
+	setSlotInstants(update, slot)
+	_, _, err := supabaseClient.From("slots").
+		Update(update, "", "").
+		Eq("id", fmt.Sprintf("%d", slot.ID)).
+		Execute()
+	if isUniqueViolation(err) {
+		return errSlotTaken
+	}
+	return err
+}
+
 func getBookingByID(slotID int) (*Slot, error) {
 	data, _, err := supabaseClient.From("slots").
 		Select("*", "exact", false).
@@ -241,32 +485,59 @@ func getBookingByID(slotID int) (*Slot, error) {
 }
 
 func canCancelBooking(slot Slot) bool {
-	slotDateTime, err := time.Parse("2006-01-02 15:04", slot.Date+" "+slot.Time)
+	return canCancelAt(slot, time.Now())
+}
+
+// canCancelAt applies the cancellation rule at now: the start must be more
+// than cancelBefore of real time away, whatever the clocks did in between.
+func canCancelAt(slot Slot, now time.Time) bool {
+	start, err := slotStartTime(slot)
 	if err != nil {
 		return false
 	}
-	
-	now := time.Now().In(tz)
-	twoHoursBefore := slotDateTime.Add(-2 * time.Hour)
-	
-	return now.Before(twoHoursBefore)
+	return now.Before(start.Add(-cancelBefore))
 }
 
 func loadUserSession(userID int64) (*UserSession, error) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
 	if session, ok := userSessions[userID]; ok {
-		return session, nil
+		return session.clone(), nil
 	}
 	return &UserSession{Data: make(map[string]interface{})}, nil
 }
 
 func saveUserSession(userID int64, session *UserSession) {
-	userSessions[userID] = session
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	userSessions[userID] = session.clone()
 }
 
 func deleteUserSession(userID int64) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
 	delete(userSessions, userID)
 }
 
+func hasUserSession(userID int64) bool {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	_, ok := userSessions[userID]
+	return ok
+}
+
 func loadAllSessions() {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
 	userSessions = make(map[int64]*UserSession)
 }
+
+// clone copies the session so that callers never share its Data map.
+func (s *UserSession) clone() *UserSession {
+	c := *s
+	c.Data = make(map[string]interface{}, len(s.Data))
+	for k, v := range s.Data {
+		c.Data[k] = v
+	}
+	return &c
+}
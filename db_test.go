@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestInsertSlotTaken races inserts past the availability checks: the unique
+// index lets one through and the rest get errSlotTaken.
+func TestInsertSlotTaken(t *testing.T) {
+	newTestBot(t)
+	date := time.Now().In(tz).AddDate(0, 0, 5).Format("2006-01-02")
+
+	const inserts = 10
+	errs := make([]error, inserts)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = bookSlotForClient(date, "10:00", "Ахмед", "Клиент", "+79990000000", "Комплекс", "phone", "main", 5000)
+		}(i)
+	}
+	wg.Wait()
+
+	var booked, taken int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			booked++
+		case errors.Is(err, errSlotTaken):
+			taken++
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if booked != 1 || taken != inserts-1 {
+		t.Errorf("booked %d, taken %d; want 1 and %d", booked, taken, inserts-1)
+	}
+}
+
+// TestNamesakesBookSameTime books two masters with the same name at different
+// centres for the same time; the unique index keys on master_id.
+func TestNamesakesBookSameTime(t *testing.T) {
+	b := newTestBot(t)
+	b.db.seed("locations", map[string]interface{}{"id": "south", "name": "HGN Юг", "timezone": "Europe/Moscow", "opens": "09:00", "closes": "21:00", "active": true})
+	b.db.set("masters", "m1", map[string]interface{}{"location_id": "main"})
+	b.db.seed("masters", map[string]interface{}{"id": "m2", "name": "Ахмед", "code": "2222", "gender": "male", "active": true, "location_id": "south"})
+	setMasters(loadMastersFromDB())
+	setLocations(loadLocationsFromDB())
+	date := time.Now().In(tz).AddDate(0, 0, 5).Format("2006-01-02")
+
+	for _, loc := range []string{"main", "south"} {
+		if _, err := bookSlotForClient(date, "10:00", "Ахмед", "Клиент", "+79990000000", "Комплекс", "phone", loc, 5000); err != nil {
+			t.Errorf("booking at %s: %v", loc, err)
+		}
+	}
+	if _, err := bookSlotForClient(date, "10:00", "Ахмед", "Клиент", "+79990000001", "Комплекс", "phone", "south", 5000); !errors.Is(err, errSlotTaken) {
+		t.Errorf("second booking at south = %v, want errSlotTaken", err)
+	}
+	if got := b.db.rows("slots", map[string]string{"master_id": "m2"}); len(got) != 1 {
+		t.Errorf("bookings of m2 = %v", got)
+	}
+}
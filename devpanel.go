@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// version is set at build time: go build -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
+var startedAt = time.Now()
+
+const (
+	devUnlockTTL      = 30 * time.Minute
+	devMaxAttempts    = 5
+	devLockout        = 15 * time.Minute
+	devPanelRows      = 5
+	recentErrorsLimit = 20
+)
+
+var (
+	devUnlockMu sync.Mutex
+	devUnlocked = make(map[int64]time.Time)
+	devFailures = make(map[int64]int)
+	devLocked   = make(map[int64]time.Time)
+)
+
+func isDevUnlocked(userID int64) bool {
+	devUnlockMu.Lock()
+	defer devUnlockMu.Unlock()
+	return time.Now().Before(devUnlocked[userID])
+}
+
+func unlockDev(userID int64) {
+	devUnlockMu.Lock()
+	defer devUnlockMu.Unlock()
+	devUnlocked[userID] = time.Now().Add(devUnlockTTL)
+	delete(devFailures, userID)
+}
+
+func isDevLocked(userID int64) bool {
+	devUnlockMu.Lock()
+	defer devUnlockMu.Unlock()
+	return time.Now().Before(devLocked[userID])
+}
+
+// failDevPassword counts a wrong password and locks the user out after
+// devMaxAttempts in a row.
+func failDevPassword(userID int64) (locked bool) {
+	devUnlockMu.Lock()
+	defer devUnlockMu.Unlock()
+	devFailures[userID]++
+	if devFailures[userID] < devMaxAttempts {
+		return false
+	}
+	delete(devFailures, userID)
+	devLocked[userID] = time.Now().Add(devLockout)
+	return true
+}
+
+type capturedError struct {
+	At      time.Time
+	Message string
+}
+
+var (
+	recentErrorsMu sync.Mutex
+	recentErrors   []capturedError
+)
+
+func captureError(e capturedError) {
+	recentErrorsMu.Lock()
+	defer recentErrorsMu.Unlock()
+	recentErrors = append(recentErrors, e)
+	if len(recentErrors) > recentErrorsLimit {
+		recentErrors = recentErrors[len(recentErrors)-recentErrorsLimit:]
+	}
+}
+
+func lastErrors(n int) []capturedError {
+	recentErrorsMu.Lock()
+	defer recentErrorsMu.Unlock()
+	if len(recentErrors) < n {
+		n = len(recentErrors)
+	}
+	out := make([]capturedError, n)
+	copy(out, recentErrors[len(recentErrors)-n:])
+	return out
+}
+
+// errorCapture keeps error-level log records for the developer panel.
+type errorCapture struct {
+	slog.Handler
+	attrs []slog.Attr
+}
+
+func (h *errorCapture) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelError {
+		var b strings.Builder
+		b.WriteString(r.Message)
+		for _, a := range h.attrs {
+			writeCapturedAttr(&b, "", a)
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			writeCapturedAttr(&b, "", a)
+			return true
+		})
+		captureError(capturedError{At: r.Time, Message: b.String()})
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+// writeCapturedAttr resolves LogValuers and walks groups the way the slog
+// handlers do, so values like Slot are masked before they are kept.
+func writeCapturedAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			writeCapturedAttr(b, prefix, ga)
+		}
+		return
+	}
+	a = redactAttr(nil, a)
+	fmt.Fprintf(b, " %s%s=%v", prefix, a.Key, a.Value)
+}
+
+func (h *errorCapture) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &errorCapture{Handler: h.Handler.WithAttrs(attrs), attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h *errorCapture) WithGroup(name string) slog.Handler {
+	return &errorCapture{Handler: h.Handler.WithGroup(name), attrs: h.attrs}
+}
+
+func buildInfo() string {
+	info := "версия " + version
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info += ", " + bi.GoVersion
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if len(s.Value) > 7 {
+				s.Value = s.Value[:7]
+			}
+			info += ", commit " + s.Value
+		case "vcs.time":
+			info += ", " + s.Value
+		case "vcs.modified":
+			if s.Value == "true" {
+				info += " (modified)"
+			}
+		}
+	}
+	return info
+}
+
+func requestDevPassword(cb *tgbotapi.CallbackQuery) {
+	// Without DEV_PASSWORD only owners and developers get in
+	if cfg.DevPassword == "" || isDevLocked(cb.From.ID) {
+		text := "Панель разработчика доступна только по роли"
+		if cfg.DevPassword != "" {
+			text = "Слишком много неверных попыток, попробуйте позже"
+		}
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: text, ShowAlert: true})
+		return
+	}
+	saveUserSession(cb.From.ID, &UserSession{Step: "dev_login"})
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("Отмена", "admin_back")},
+	}
+
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, "🔑 Введите пароль разработчика:")
+	editMsg.ReplyMarkup = markup
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
+
+func checkDevPassword(msg *tgbotapi.Message) {
+	deleteUserSession(msg.From.ID)
+	// Don't leave the password in the chat history
+	bot.Request(tgbotapi.NewDeleteMessage(msg.Chat.ID, msg.MessageID))
+
+	if cfg.DevPassword == "" || isDevLocked(msg.From.ID) {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Вход по паролю недоступен"))
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(msg.Text), []byte(cfg.DevPassword)) != 1 {
+		text := "❌ Неверный пароль"
+		if failDevPassword(msg.From.ID) {
+			slog.Warn("developer password locked out", "user_id", msg.From.ID)
+			text = fmt.Sprintf("❌ Неверный пароль. Вход заблокирован на %d минут", int(devLockout.Minutes()))
+		} else {
+			slog.Warn("wrong developer password", "user_id", msg.From.ID)
+		}
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, text))
+		return
+	}
+	unlockDev(msg.From.ID)
+
+	message := tgbotapi.NewMessage(msg.Chat.ID, developerPanelText())
+	message.ReplyMarkup = developerPanelMarkup()
+	bot.Send(message)
+}
+
+func showDeveloperPanel(cb *tgbotapi.CallbackQuery) {
+	if !can(cb.From.ID, permDeveloper) && !isDevUnlocked(cb.From.ID) {
+		requestDevPassword(cb)
+		return
+	}
+
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, developerPanelText())
+	markup := developerPanelMarkup()
+	editMsg.ReplyMarkup = &markup
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
+
+func developerPanelMarkup() tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("🔄 Обновить", "admin_developer")),
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("← Назад", "admin_back")),
+	)
+}
+
+func developerPanelText() string {
+	var b strings.Builder
+	b.WriteString("👨💻 Панель разработчика\n\n")
+	fmt.Fprintf(&b, "🏷 %s\n", buildInfo())
+	fmt.Fprintf(&b, "⏱ Аптайм: %s\n", time.Since(startedAt).Round(time.Second))
+	fmt.Fprintf(&b, "💬 Активных диалогов: %d\n", sessionCount())
+
+	b.WriteString("\n🔌 Статус:\n")
+	b.WriteString(formatHealthChecks(runHealthChecks()))
+
+	b.WriteString("\n\n📋 Последние записи:\n")
+	writeDevSlots(&b, "booked_at", "")
+	b.WriteString("\n❌ Последние отмены:\n")
+	writeDevSlots(&b, "cancelled_at", "cancelled")
+
+	b.WriteString("\n⚠️ Последние ошибки:\n")
+	errs := lastErrors(devPanelRows)
+	if len(errs) == 0 {
+		b.WriteString("Нет ошибок\n")
+	}
+	for i := len(errs) - 1; i >= 0; i-- {
+		text := errs[i].Message
+		if len([]rune(text)) > 200 {
+			text = string([]rune(text)[:200]) + "…"
+		}
+		fmt.Fprintf(&b, "%s %s\n", errs[i].At.In(tz).Format("02.01 15:04:05"), text)
+	}
+	return b.String()
+}
+
+func writeDevSlots(b *strings.Builder, orderBy, status string) {
+	slots, err := getRecentSlots(orderBy, status, devPanelRows)
+	if err != nil {
+		slog.Error("failed to load recent slots", "order_by", orderBy, "err", err)
+		b.WriteString("Ошибка загрузки\n")
+		return
+	}
+	if len(slots) == 0 {
+		b.WriteString("Нет записей\n")
+	}
+	for _, s := range slots {
+		fmt.Fprintf(b, "#%d %s %s · %s · %s\n", s.ID, s.Date, s.Time, s.MasterName, s.PackageName)
+	}
+}
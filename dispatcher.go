@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// dispatcher runs handleUpdate on a fixed pool of workers. Every chat is
+// pinned to one worker, so updates from the same chat are handled in the
+// order they arrived while different chats proceed in parallel.
+type dispatcher struct {
+	ctx    context.Context
+	queues []chan tgbotapi.Update
+	wg     sync.WaitGroup
+}
+
+// newDispatcher starts the workers. ctx is handed to every handler; it should
+// outlive shutdown's drain phase so queued updates can still be completed.
+func newDispatcher(ctx context.Context, workers int) *dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	d := &dispatcher{ctx: ctx, queues: make([]chan tgbotapi.Update, workers)}
+	for i := range d.queues {
+		d.queues[i] = make(chan tgbotapi.Update, 64)
+		d.wg.Add(1)
+		go d.work(d.queues[i])
+	}
+	return d
+}
+
+func (d *dispatcher) work(queue chan tgbotapi.Update) {
+	defer d.wg.Done()
+	for update := range queue {
+		d.handle(update)
+	}
+}
+
+func (d *dispatcher) handle(update tgbotapi.Update) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("panic while handling update", "update_id", update.UpdateID, "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+	handleUpdate(d.ctx, update)
+}
+
+// dispatch queues update for its chat's worker and reports whether it did.
+// It gives up once ctx ends, so a full queue can't hold up shutdown.
+func (d *dispatcher) dispatch(ctx context.Context, update tgbotapi.Update) bool {
+	key := updateChatID(update)
+	if key < 0 {
+		key = -key
+	}
+	select {
+	case d.queues[key%int64(len(d.queues))] <- update:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// close stops accepting updates and waits for the queued ones to finish
+// or for ctx to expire, whichever comes first.
+func (d *dispatcher) close(ctx context.Context) error {
+	for _, q := range d.queues {
+		close(q)
+	}
+	return waitGroupWithin(ctx, &d.wg)
+}
+
+func updateChatID(update tgbotapi.Update) int64 {
+	if chat := update.FromChat(); chat != nil {
+		return chat.ID
+	}
+	if user := update.SentFrom(); user != nil {
+		return user.ID
+	}
+	return 0
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// TestConcurrentBooking has many clients book the same master and time at
+// once through the worker pool; run it with -race. Exactly one booking may
+// win, everyone else is told the time is taken.
+func TestConcurrentBooking(t *testing.T) {
+	b := newTestBot(t)
+	const clients = 20
+	date := time.Now().In(tz).AddDate(0, 0, 5).Format("2006-01-02")
+
+	scripts := make([][]tgbotapi.Update, clients)
+	for i := range scripts {
+		u := &FakeUser{ID: int64(2000 + i), UserName: fmt.Sprintf("client%d", i)}
+		scripts[i] = []tgbotapi.Update{
+			u.Text("📍 Записаться на Хиджаму"),
+			u.Press(1, "package_complex"),
+			u.Press(1, "gender_male"),
+			u.Press(1, "age_yes"),
+			u.Press(1, "health_no"),
+			u.Text(fmt.Sprintf("Клиент %d", i)),
+			u.Text(fmt.Sprintf("+7999000%04d", i)),
+			u.Press(1, "date_"+date),
+			u.Press(1, "time_"+date+"_10:00"),
+			u.Press(1, "master_Ахмед"),
+			u.Press(1, "confirm_booking"),
+		}
+	}
+
+	d := newDispatcher(context.Background(), cfg.Workers)
+	// Interleave the chats so the confirmations arrive together
+	for step := range scripts[0] {
+		for _, script := range scripts {
+			d.dispatch(context.Background(), script[step])
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := d.close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if booked := b.db.rows("slots", map[string]string{"status": "booked"}); len(booked) != 1 {
+		t.Errorf("booked slots = %d, want 1: %v", len(booked), booked)
+	}
+	answers := make(map[string]int)
+	for _, c := range b.api.Calls("answerCallbackQuery") {
+		answers[c.Params.Get("text")]++
+	}
+	if answers["Запись успешна!"] != 1 || answers["Это время уже занято, выберите другое"] != clients-1 {
+		t.Errorf("answers = %v, want one success and %d taken", answers, clients-1)
+	}
+}
+
+func TestDispatchGivesUpOnFullQueue(t *testing.T) {
+	d := &dispatcher{queues: []chan tgbotapi.Update{make(chan tgbotapi.Update)}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if d.dispatch(ctx, (&FakeUser{ID: 1}).Text("/start")) {
+		t.Error("dispatched into a full queue")
+	}
+}
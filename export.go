@@ -0,0 +1,349 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Column order follows the slots table, then the resolved master and package fields.
+var exportColumns = []string{
+	"id", "date", "time", "gender", "master_id", "master_name", "status",
+	"user_id", "username", "client_name", "client_phone", "package_name",
+	"booked_at", "cancelled_at", "source",
+	"master_contact", "master_gender", "package_key", "package_price",
+	"promo_code", "discount", "visit_discount", "points_spent", "price",
+	"location_id", "starts_at", "payment_status", "payment_amount", "health_flag",
+}
+
+func exportRow(slot Slot) []string {
+	master := resolveMaster(slot)
+	pkgKey, pkg := resolvePackage(slot.PackageName)
+
+	price := ""
+	if pkgKey != "" {
+		price = strconv.Itoa(pkg.Price)
+	}
+
+	return []string{
+		strconv.Itoa(slot.ID), slot.Date, slot.Time, slot.Gender, master.ID, slot.MasterName, slot.Status,
+		slot.UserID, slot.Username, slot.ClientName, slot.ClientPhone, slot.PackageName,
+		formatExportTime(slot.BookedAt), formatExportTime(slot.CancelledAt), slot.Source,
+		master.Contact, master.Gender, pkgKey, price,
+		slot.PromoCode, strconv.Itoa(slot.Discount), strconv.Itoa(slot.VisitDiscount), strconv.Itoa(slot.PointsSpent), strconv.Itoa(slotPrice(slot)),
+		slot.LocationID, formatExportTime(slot.StartsAt), slot.PaymentStatus, strconv.Itoa(slot.PaymentAmount), strconv.FormatBool(slot.HealthFlag),
+	}
+}
+
+// csvCell keeps spreadsheet apps from running client-entered text such as
+// "=HYPERLINK(...)" as a formula.
+func csvCell(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+// Revenue sums what clients paid for completed visits.
+type Revenue struct {
+	Visits    int
+	Revenue   int
+	Discounts int
+}
+
+func revenueOf(slots []Slot) Revenue {
+	var r Revenue
+	for _, slot := range slots {
+		if slot.Status != "completed" {
+			continue
+		}
+		r.Visits++
+		r.Revenue += slotPrice(slot)
+		r.Discounts += slot.Discount + slot.VisitDiscount + slot.PointsSpent
+	}
+	return r
+}
+
+// resolveMaster finds the slot's master by id, else by name, preferring a
+// master who works at the slot's centre since namesakes may work elsewhere.
+func resolveMaster(slot Slot) Master {
+	all := mastersSnapshot()
+	if m, ok := all[slot.MasterID]; ok {
+		return m
+	}
+	found := Master{ID: slot.MasterID}
+	for _, m := range all {
+		if m.Name != slot.MasterName {
+			continue
+		}
+		if slot.LocationID == "" || m.worksAt(slot.LocationID) {
+			return m
+		}
+		found = m
+	}
+	return found
+}
+
+func resolvePackage(name string) (string, Package) {
+	for key, pkg := range packages {
+		if pkg.Name == name {
+			return key, pkg
+		}
+	}
+	return "", Package{}
+}
+
+func formatExportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(tz).Format("2006-01-02 15:04:05")
+}
+
+func buildCSV(slots []Slot) ([]byte, error) {
+	var buf bytes.Buffer
+	// BOM so that Excel opens Cyrillic text correctly
+	buf.WriteString("\ufeff")
+	w := csv.NewWriter(&buf)
+	w.Write(exportColumns)
+	for _, slot := range slots {
+		row := exportRow(slot)
+		for i, v := range row {
+			if !isNumericColumn(exportColumns[i]) {
+				row[i] = csvCell(v)
+			}
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func buildXLSX(slots []Slot) ([]byte, error) {
+	var sheet bytes.Buffer
+	sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`)
+	sheet.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	writeXLSXRow(&sheet, 1, exportColumns)
+	for i, slot := range slots {
+		writeXLSXRow(&sheet, i+2, exportRow(slot))
+	}
+	sheet.WriteString(`</sheetData></worksheet>`)
+
+	files := []struct {
+		name string
+		body string
+	}{
+		{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+			`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+			`</Types>`},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+			`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+			`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets><sheet name="slots" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+			`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+			`</Relationships>`},
+		{"xl/worksheets/sheet1.xml", sheet.String()},
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write([]byte(f.body)); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeXLSXRow(buf *bytes.Buffer, row int, values []string) {
+	fmt.Fprintf(buf, `<row r="%d">`, row)
+	for i, v := range values {
+		ref := xlsxColumn(i) + strconv.Itoa(row)
+		if row > 1 && v != "" && isNumericColumn(exportColumns[i]) {
+			fmt.Fprintf(buf, `<c r="%s"><v>%s</v></c>`, ref, v)
+			continue
+		}
+		fmt.Fprintf(buf, `<c r="%s" t="inlineStr"><is><t>`, ref)
+		xml.EscapeText(buf, []byte(v))
+		buf.WriteString(`</t></is></c>`)
+	}
+	buf.WriteString(`</row>`)
+}
+
+func isNumericColumn(name string) bool {
+	return name == "id" || name == "package_price" || name == "discount" || name == "visit_discount" || name == "points_spent" || name == "price" || name == "payment_amount"
+}
+
+func xlsxColumn(i int) string {
+	name := ""
+	for i >= 0 {
+		name = string(rune('A'+i%26)) + name
+		i = i/26 - 1
+	}
+	return name
+}
+
+// parseExportArgs understands "/export [from] [to] [master=..] [status=..] [package=..]".
+func parseExportArgs(args string) (SlotFilter, error) {
+	today := time.Now().In(tz)
+	filter := SlotFilter{
+		From: today.Format("2006-01-02"),
+		To:   today.AddDate(0, 0, 30).Format("2006-01-02"),
+	}
+
+	var dates []string
+	for _, arg := range strings.Fields(args) {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			if _, err := time.Parse("2006-01-02", arg); err != nil {
+				return filter, fmt.Errorf("неверная дата: %s", arg)
+			}
+			dates = append(dates, arg)
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "master":
+			filter.MasterName = value
+			for id, m := range mastersSnapshot() {
+				if strings.EqualFold(id, value) || strings.EqualFold(m.Name, value) {
+					filter.MasterName = m.Name
+				}
+			}
+		case "status":
+			filter.Status = value
+		case "package":
+			filter.PackageName = value
+			if pkg, ok := packages[value]; ok {
+				filter.PackageName = pkg.Name
+			}
+		default:
+			return filter, fmt.Errorf("неизвестный фильтр: %s", key)
+		}
+	}
+
+	if len(dates) > 0 {
+		filter.From = dates[0]
+		filter.To = dates[0]
+	}
+	if len(dates) > 1 {
+		filter.To = dates[1]
+	}
+	return filter, nil
+}
+
+func exportCommand(msg *tgbotapi.Message) {
+	filter, err := parseExportArgs(msg.CommandArguments())
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ "+err.Error()+"\n\nФормат: /export 2024-05-01 2024-05-31 master=adam status=booked package=complex"))
+		return
+	}
+	sendExport(msg.Chat.ID, filter)
+}
+
+func showExportMenu(cb *tgbotapi.CallbackQuery) {
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("Сегодня", "export_today")},
+		{tgbotapi.NewInlineKeyboardButtonData("Следующие 7 дней", "export_week")},
+		{tgbotapi.NewInlineKeyboardButtonData("Следующие 30 дней", "export_month")},
+		{tgbotapi.NewInlineKeyboardButtonData("Прошлый месяц", "export_lastmonth")},
+		{tgbotapi.NewInlineKeyboardButtonData("← Назад", "admin_back")},
+	}
+
+	text := "📤 Экспорт записей\n\nВыберите период или используйте команду:\n/export 2024-05-01 2024-05-31 master=adam status=booked package=complex"
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, text)
+	editMsg.ReplyMarkup = markup
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
+
+func exportPreset(cb *tgbotapi.CallbackQuery, data string) {
+	today := time.Now().In(tz)
+	var from, to time.Time
+	switch strings.TrimPrefix(data, "export_") {
+	case "today":
+		from, to = today, today
+	case "week":
+		from, to = today, today.AddDate(0, 0, 6)
+	case "month":
+		from, to = today, today.AddDate(0, 0, 29)
+	case "lastmonth":
+		firstOfMonth := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, tz)
+		from, to = firstOfMonth.AddDate(0, -1, 0), firstOfMonth.AddDate(0, 0, -1)
+	default:
+		return
+	}
+
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Готовлю файлы...", ShowAlert: false})
+	sendExport(cb.Message.Chat.ID, SlotFilter{From: from.Format("2006-01-02"), To: to.Format("2006-01-02")})
+}
+
+func sendExport(chatID int64, filter SlotFilter) {
+	slots, err := getSlots(filter)
+	if err != nil {
+		slog.Error("failed to export slots", "err", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "❌ Ошибка при выгрузке записей"))
+		return
+	}
+
+	name := fmt.Sprintf("bookings_%s_%s", filter.From, filter.To)
+	csvData, err := buildCSV(slots)
+	if err != nil {
+		slog.Error("failed to build CSV", "err", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "❌ Ошибка при формировании CSV"))
+		return
+	}
+	xlsxData, err := buildXLSX(slots)
+	if err != nil {
+		slog.Error("failed to build XLSX", "err", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "❌ Ошибка при формировании XLSX"))
+		return
+	}
+
+	caption := fmt.Sprintf("📤 Записи с %s по %s: %d", filter.From, filter.To, len(slots))
+	if filter.MasterName != "" {
+		caption += "\n👨⚕️ " + filter.MasterName
+	}
+	if filter.Status != "" {
+		caption += "\n📌 " + filter.Status
+	}
+	if filter.PackageName != "" {
+		caption += "\n💼 " + filter.PackageName
+	}
+	if r := revenueOf(slots); r.Visits > 0 {
+		caption += fmt.Sprintf("\n💰 Выручка: %d ₽ (%d визитов", r.Revenue, r.Visits)
+		if r.Discounts > 0 {
+			caption += fmt.Sprintf(", скидки и баллы %d ₽", r.Discounts)
+		}
+		caption += ")"
+	}
+
+	csvDoc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{Name: name + ".csv", Bytes: csvData})
+	csvDoc.Caption = caption
+	bot.Send(csvDoc)
+	bot.Send(tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{Name: name + ".xlsx", Bytes: xlsxData}))
+}
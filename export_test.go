@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+)
+
+func TestCSVEscapesFormulas(t *testing.T) {
+	newTestBot(t)
+	slots := []Slot{{
+		ID: 1, Date: "2027-05-01", Time: "10:00", MasterName: "Ахмед", Status: "booked",
+		Username: "@ivan", ClientName: `=HYPERLINK("http://evil","Иван")`, ClientPhone: "+79991234567",
+		PackageName: "Комплекс", Discount: 500, LocationID: "main", PaymentStatus: paymentPaid, PaymentAmount: 1000, HealthFlag: true,
+	}}
+	data, err := buildCSV(slots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\ufeff")))).ReadAll()
+	if err != nil || len(records) != 2 {
+		t.Fatalf("csv = %q, %v", data, err)
+	}
+	got := make(map[string]string)
+	for i, column := range records[0] {
+		got[column] = records[1][i]
+	}
+	want := map[string]string{
+		"client_name":    `'=HYPERLINK("http://evil","Иван")`,
+		"username":       "'@ivan",
+		"client_phone":   "'+79991234567",
+		"master_name":    "Ахмед",
+		"discount":       "500",
+		"location_id":    "main",
+		"payment_status": paymentPaid,
+		"payment_amount": "1000",
+		"health_flag":    "true",
+	}
+	for column, value := range want {
+		if got[column] != value {
+			t.Errorf("%s = %q, want %q", column, got[column], value)
+		}
+	}
+}
+
+func TestGetSlotsPages(t *testing.T) {
+	b := newTestBot(t)
+	const total = slotsPage + slotsPage/2
+	for i := 0; i < total; i++ {
+		b.db.seed("slots", map[string]interface{}{"id": i + 1, "date": "2027-05-01", "time": "10:00", "master_name": "Ахмед", "status": "completed"})
+	}
+	slots, err := getSlots(SlotFilter{From: "2027-05-01", To: "2027-05-01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slots) != total || slots[0].ID != 1 || slots[total-1].ID != total {
+		t.Errorf("got %d slots, want %d in order", len(slots), total)
+	}
+}
+
+func TestResolveMasterNamesakes(t *testing.T) {
+	newTestBot(t)
+	setMasters(map[string]Master{
+		"m1": {ID: "m1", Name: "Ахмед", LocationID: "main", Active: true},
+		"m2": {ID: "m2", Name: "Ахмед", LocationID: "south", Active: true},
+	})
+	for _, loc := range []string{"main", "south"} {
+		want := map[string]string{"main": "m1", "south": "m2"}[loc]
+		for i := 0; i < 10; i++ {
+			if got := resolveMaster(Slot{MasterName: "Ахмед", LocationID: loc}).ID; got != want {
+				t.Fatalf("resolveMaster(Ахмед at %s) = %s, want %s", loc, got, want)
+			}
+		}
+	}
+}
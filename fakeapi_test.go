@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// FakeBotAPI is an in-process stand-in for api.telegram.org. It records every
+// call the bot makes so end-to-end scenarios can assert on exact texts and
+// keyboards. Point a BotAPI at it with NewBotAPIWithAPIEndpoint(token,
+// fake.Endpoint()).
+type FakeBotAPI struct {
+	server   *http.Server
+	listener net.Listener
+
+	mu            sync.Mutex
+	calls         []FakeCall
+	nextMessageID int
+}
+
+// FakeCall is one recorded Bot API request. MessageID is the message the
+// call sent or edited.
+type FakeCall struct {
+	Method    string
+	Params    url.Values
+	Files     []string
+	MessageID int
+}
+
+func (c FakeCall) ChatID() int64 {
+	id, _ := strconv.ParseInt(c.Params.Get("chat_id"), 10, 64)
+	return id
+}
+
+func (c FakeCall) Text() string {
+	if text := c.Params.Get("text"); text != "" {
+		return text
+	}
+	return c.Params.Get("caption")
+}
+
+// InlineKeyboard returns the button rows as "text|callback_data" (or "text|url").
+func (c FakeCall) InlineKeyboard() [][]string {
+	var markup tgbotapi.InlineKeyboardMarkup
+	if err := json.Unmarshal([]byte(c.Params.Get("reply_markup")), &markup); err != nil {
+		return nil
+	}
+	var rows [][]string
+	for _, row := range markup.InlineKeyboard {
+		var buttons []string
+		for _, b := range row {
+			target := ""
+			if b.CallbackData != nil {
+				target = *b.CallbackData
+			} else if b.URL != nil {
+				target = *b.URL
+			}
+			buttons = append(buttons, b.Text+"|"+target)
+		}
+		rows = append(rows, buttons)
+	}
+	return rows
+}
+
+// ReplyKeyboard returns the button texts of a reply keyboard.
+func (c FakeCall) ReplyKeyboard() [][]string {
+	var markup tgbotapi.ReplyKeyboardMarkup
+	if err := json.Unmarshal([]byte(c.Params.Get("reply_markup")), &markup); err != nil {
+		return nil
+	}
+	var rows [][]string
+	for _, row := range markup.Keyboard {
+		var buttons []string
+		for _, b := range row {
+			buttons = append(buttons, b.Text)
+		}
+		rows = append(rows, buttons)
+	}
+	return rows
+}
+
+func NewFakeBotAPI() (*FakeBotAPI, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	f := &FakeBotAPI{listener: l, nextMessageID: 1000}
+	f.server = &http.Server{Handler: http.HandlerFunc(f.serve), ReadHeaderTimeout: 5 * time.Second}
+	go f.server.Serve(l)
+	return f, nil
+}
+
+func (f *FakeBotAPI) Endpoint() string {
+	return "http://" + f.listener.Addr().String() + "/bot%s/%s"
+}
+
+func (f *FakeBotAPI) Close() error {
+	return f.server.Close()
+}
+
+// Calls returns the recorded calls, optionally only those of the given methods.
+func (f *FakeBotAPI) Calls(methods ...string) []FakeCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []FakeCall
+	for _, c := range f.calls {
+		if len(methods) == 0 || containsString(methods, c.Method) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Last returns the most recent call of the given method.
+func (f *FakeBotAPI) Last(method string) (FakeCall, bool) {
+	calls := f.Calls(method)
+	if len(calls) == 0 {
+		return FakeCall{}, false
+	}
+	return calls[len(calls)-1], true
+}
+
+func (f *FakeBotAPI) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = nil
+}
+
+func (f *FakeBotAPI) serve(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "bot") {
+		http.NotFound(w, r)
+		return
+	}
+	method := parts[1]
+
+	call := FakeCall{Method: method}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			fakeReply(w, false, err.Error())
+			return
+		}
+		call.Params = url.Values(r.MultipartForm.Value)
+		for field, headers := range r.MultipartForm.File {
+			for _, h := range headers {
+				call.Files = append(call.Files, field+":"+h.Filename)
+			}
+		}
+	} else {
+		r.ParseForm()
+		call.Params = r.PostForm
+	}
+
+	f.mu.Lock()
+	call.MessageID = f.nextMessageID
+	if id, err := strconv.Atoi(call.Params.Get("message_id")); err == nil {
+		call.MessageID = id
+	} else {
+		f.nextMessageID++
+	}
+	f.calls = append(f.calls, call)
+	f.mu.Unlock()
+
+	switch method {
+	case "getMe":
+		fakeReply(w, true, tgbotapi.User{ID: 1, IsBot: true, FirstName: "HGN", UserName: "hgn_fake_bot"})
+	case "getWebhookInfo":
+		fakeReply(w, true, tgbotapi.WebhookInfo{})
+	case "getUpdates":
+		fakeReply(w, true, []tgbotapi.Update{})
+	case "editMessageText", "editMessageReplyMarkup":
+		fakeReply(w, true, fakeMessage(call, call.MessageID))
+	default:
+		if strings.HasPrefix(method, "send") {
+			fakeReply(w, true, fakeMessage(call, call.MessageID))
+			return
+		}
+		fakeReply(w, true, true)
+	}
+}
+
+func fakeMessage(call FakeCall, messageID int) tgbotapi.Message {
+	return tgbotapi.Message{
+		MessageID: messageID,
+		Date:      int(time.Now().Unix()),
+		Chat:      &tgbotapi.Chat{ID: call.ChatID(), Type: "private"},
+		Text:      call.Params.Get("text"),
+	}
+}
+
+func fakeReply(w http.ResponseWriter, ok bool, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error_code": 400, "description": result})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": result})
+}
+
+// FakeUser builds updates as if a private-chat user sent them, for scripting
+// conversations against handleUpdate.
+type FakeUser struct {
+	ID       int64
+	UserName string
+
+	nextUpdateID int
+}
+
+func (u *FakeUser) user() *tgbotapi.User {
+	return &tgbotapi.User{ID: u.ID, UserName: u.UserName, FirstName: u.UserName}
+}
+
+func (u *FakeUser) chat() *tgbotapi.Chat {
+	return &tgbotapi.Chat{ID: u.ID, Type: "private"}
+}
+
+// Text is a message typed by the user, e.g. "/start" or "📍 Записаться на Хиджаму".
+func (u *FakeUser) Text(text string) tgbotapi.Update {
+	u.nextUpdateID++
+	msg := &tgbotapi.Message{
+		MessageID: u.nextUpdateID,
+		From:      u.user(),
+		Chat:      u.chat(),
+		Date:      int(time.Now().Unix()),
+		Text:      text,
+	}
+	if strings.HasPrefix(text, "/") {
+		command := strings.SplitN(text, " ", 2)[0]
+		msg.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len(command)}}
+	}
+	return tgbotapi.Update{UpdateID: u.nextUpdateID, Message: msg}
+}
+
+// Press is a tap on an inline button with the given callback data attached
+// to the bot message messageID.
+func (u *FakeUser) Press(messageID int, data string) tgbotapi.Update {
+	u.nextUpdateID++
+	return tgbotapi.Update{
+		UpdateID: u.nextUpdateID,
+		CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:      fmt.Sprintf("cb-%d-%d", u.ID, u.nextUpdateID),
+			From:    u.user(),
+			Message: &tgbotapi.Message{MessageID: messageID, Chat: u.chat()},
+			Data:    data,
+		},
+	}
+}
+
+// PreCheckout is Telegram asking to confirm an order the user is about to
+// pay; amount is in rubles.
+func (u *FakeUser) PreCheckout(payload string, amount int) tgbotapi.Update {
+	u.nextUpdateID++
+	return tgbotapi.Update{
+		UpdateID: u.nextUpdateID,
+		PreCheckoutQuery: &tgbotapi.PreCheckoutQuery{
+			ID:             fmt.Sprintf("pcq-%d-%d", u.ID, u.nextUpdateID),
+			From:           u.user(),
+			Currency:       paymentCurrency,
+			TotalAmount:    amount * 100,
+			InvoicePayload: payload,
+		},
+	}
+}
+
+// Pay is the service message Telegram sends after a successful payment.
+func (u *FakeUser) Pay(payload string, amount int) tgbotapi.Update {
+	u.nextUpdateID++
+	return tgbotapi.Update{
+		UpdateID: u.nextUpdateID,
+		Message: &tgbotapi.Message{
+			MessageID: u.nextUpdateID,
+			From:      u.user(),
+			Chat:      u.chat(),
+			Date:      int(time.Now().Unix()),
+			SuccessfulPayment: &tgbotapi.SuccessfulPayment{
+				Currency:                paymentCurrency,
+				TotalAmount:             amount * 100,
+				InvoicePayload:          payload,
+				TelegramPaymentChargeID: fmt.Sprintf("fake-charge-%d", u.nextUpdateID),
+				ProviderPaymentChargeID: fmt.Sprintf("fake-provider-%d", u.nextUpdateID),
+			},
+		},
+	}
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakePostgREST is an in-memory stand-in for Supabase's REST API. It speaks
+// as much PostgREST as the bot uses: column filters, and()/or() groups,
+// order, limit, Single, exact counts, insert and upsert, update and delete.
+// Rows are kept as decoded JSON, so whatever the bot writes it reads back.
+type fakePostgREST struct {
+	server *httptest.Server
+
+	mu     sync.Mutex
+	tables map[string][]map[string]interface{}
+	nextID int
+	fail   map[string]bool
+	before map[string]func()
+}
+
+// fakeMaxRows caps every read like Supabase's default max-rows setting.
+const fakeMaxRows = 1000
+
+// fakeUnique mirrors the unique indexes the bot relies on to settle races.
+var fakeUnique = []struct {
+	name  string
+	table string
+	key   func(row map[string]interface{}) string
+	where func(row map[string]interface{}) bool
+}{
+	{"idx_slots_master_id_booked", "slots", func(row map[string]interface{}) string {
+		// COALESCE(master_id, master_name)
+		master, null := fakeValue(row["master_id"])
+		if null {
+			master, _ = fakeValue(row["master_name"])
+		}
+		date, _ := fakeValue(row["date"])
+		slotTime, _ := fakeValue(row["time"])
+		return master + " " + date + " " + slotTime
+	}, func(row map[string]interface{}) bool {
+		return row["status"] == "booked"
+	}},
+}
+
+// fakeDefaults are the column defaults from schema.sql that the bot reads back.
+var fakeDefaults = map[string]map[string]interface{}{
+	"referrals":        {"status": "pending"},
+	"health_questions": {"active": true, "kind": questionYesNo},
+}
+
+// fakeViews compute the views from schema.sql out of the stored tables.
+var fakeViews = map[string]func(tables map[string][]map[string]interface{}) []map[string]interface{}{
+	"master_ratings": func(tables map[string][]map[string]interface{}) []map[string]interface{} {
+		byMaster := make(map[string]map[string]interface{})
+		var out []map[string]interface{}
+		for _, review := range tables["reviews"] {
+			id, ok := review["master_id"].(string)
+			if !ok {
+				continue
+			}
+			row, seen := byMaster[id]
+			if !seen {
+				row = map[string]interface{}{"master_id": id, "count": int64(0), "sum": int64(0)}
+				byMaster[id] = row
+				out = append(out, row)
+			}
+			rating, _ := review["rating"].(json.Number).Int64()
+			row["count"] = row["count"].(int64) + 1
+			row["sum"] = row["sum"].(int64) + rating
+		}
+		return out
+	},
+}
+
+func newFakePostgREST() *fakePostgREST {
+	db := &fakePostgREST{tables: make(map[string][]map[string]interface{}), nextID: 1, fail: make(map[string]bool), before: make(map[string]func())}
+	db.server = httptest.NewServer(http.HandlerFunc(db.serve))
+	return db
+}
+
+func (db *fakePostgREST) URL() string {
+	return db.server.URL
+}
+
+func (db *fakePostgREST) Close() {
+	db.server.Close()
+}
+
+// seed adds rows to table as if the bot had inserted them.
+func (db *fakePostgREST) seed(table string, rows ...interface{}) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, r := range rows {
+		row := fakeRow(r)
+		db.fillDefaults(table, row)
+		db.tables[table] = append(db.tables[table], row)
+	}
+}
+
+// rows returns a copy of table's rows whose columns equal the given values.
+func (db *fakePostgREST) rows(table string, match map[string]string) []map[string]interface{} {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var out []map[string]interface{}
+	for _, row := range db.tables[table] {
+		ok := true
+		for column, value := range match {
+			if got, _ := fakeValue(row[column]); got != value {
+				ok = false
+			}
+		}
+		if ok {
+			out = append(out, fakeRow(row))
+		}
+	}
+	return out
+}
+
+// set changes columns of the row with the given id behind the bot's back.
+func (db *fakePostgREST) set(table, id string, values map[string]interface{}) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.update(table, map[string][]string{"id": {"eq." + id}}, fakeRow(values))
+}
+
+// failOn makes every request with method to table fail, e.g. ("POST", "loyalty_points").
+func (db *fakePostgREST) failOn(method, table string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.fail[method+" "+table] = true
+}
+
+// beforeNext runs fn once, right before the next request with method to
+// table is served, to interleave another client's requests with the bot's.
+func (db *fakePostgREST) beforeNext(method, table string, fn func()) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.before[method+" "+table] = fn
+}
+
+func (db *fakePostgREST) serve(w http.ResponseWriter, r *http.Request) {
+	table := strings.TrimPrefix(r.URL.Path, "/rest/v1/")
+	params := r.URL.Query()
+
+	db.mu.Lock()
+	hook := db.before[r.Method+" "+table]
+	delete(db.before, r.Method+" "+table)
+	db.mu.Unlock()
+	if hook != nil {
+		hook()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.fail[r.Method+" "+table] {
+		fakeError(w, http.StatusInternalServerError, "XX000", "injected failure")
+		return
+	}
+
+	var body []map[string]interface{}
+	if r.Method == http.MethodPost || r.Method == http.MethodPatch {
+		var err error
+		if body, err = fakeBody(r.Body); err != nil {
+			fakeError(w, http.StatusBadRequest, "PGRST102", err.Error())
+			return
+		}
+	}
+
+	var result []map[string]interface{}
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		matched, err := db.filter(table, params)
+		if err != nil {
+			fakeError(w, http.StatusBadRequest, "PGRST100", err.Error())
+			return
+		}
+		result = matched
+	case http.MethodPost:
+		inserted, code, err := db.insert(table, body, params.Get("on_conflict"), strings.Contains(r.Header.Get("Prefer"), "resolution=merge-duplicates"))
+		if err != nil {
+			fakeError(w, http.StatusConflict, code, err.Error())
+			return
+		}
+		result, status = inserted, http.StatusCreated
+	case http.MethodPatch:
+		updated, code, err := db.update(table, params, body[0])
+		if err != nil {
+			fakeError(w, http.StatusConflict, code, err.Error())
+			return
+		}
+		result = updated
+	case http.MethodDelete:
+		deleted, err := db.delete(table, params)
+		if err != nil {
+			fakeError(w, http.StatusBadRequest, "PGRST100", err.Error())
+			return
+		}
+		result = deleted
+	default:
+		fakeError(w, http.StatusMethodNotAllowed, "PGRST000", "unsupported method "+r.Method)
+		return
+	}
+
+	total := len(result)
+	if order := params.Get("order"); order != "" {
+		fakeSort(result, order)
+	}
+	if offset, err := strconv.Atoi(params.Get("offset")); err == nil && offset < len(result) {
+		result = result[offset:]
+	}
+	if limit, err := strconv.Atoi(params.Get("limit")); err == nil && limit < len(result) {
+		result = result[:limit]
+	}
+	if r.Method == http.MethodGet && len(result) > fakeMaxRows {
+		result = result[:fakeMaxRows]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if strings.Contains(r.Header.Get("Prefer"), "count=exact") {
+		w.Header().Set("Content-Range", fmt.Sprintf("0-%d/%d", len(result)-1, total))
+	}
+	if strings.Contains(r.Header.Get("Accept"), "vnd.pgrst.object") {
+		if len(result) != 1 {
+			fakeError(w, http.StatusNotAcceptable, "PGRST116", "JSON object requested, multiple (or no) rows returned")
+			return
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(result[0])
+		return
+	}
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		if result == nil {
+			result = []map[string]interface{}{}
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+func (db *fakePostgREST) filter(table string, params map[string][]string) ([]map[string]interface{}, error) {
+	rows := db.tables[table]
+	if view, ok := fakeViews[table]; ok {
+		rows = view(db.tables)
+	}
+	var out []map[string]interface{}
+	for _, row := range rows {
+		ok, err := fakeMatchParams(row, params)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out = append(out, fakeRow(row))
+		}
+	}
+	return out, nil
+}
+
+func (db *fakePostgREST) insert(table string, rows []map[string]interface{}, onConflict string, merge bool) ([]map[string]interface{}, string, error) {
+	keys := []string{"id"}
+	if onConflict != "" {
+		keys = strings.Split(onConflict, ",")
+	}
+	var out []map[string]interface{}
+	for _, row := range rows {
+		if merge {
+			if existing := db.find(table, row, keys); existing != nil {
+				for k, v := range row {
+					existing[k] = v
+				}
+				out = append(out, fakeRow(existing))
+				continue
+			}
+		}
+		db.fillDefaults(table, row)
+		if err := db.checkUnique(table, row, -1); err != nil {
+			return nil, "23505", err
+		}
+		db.tables[table] = append(db.tables[table], row)
+		out = append(out, fakeRow(row))
+	}
+	return out, "", nil
+}
+
+func (db *fakePostgREST) update(table string, params map[string][]string, set map[string]interface{}) ([]map[string]interface{}, string, error) {
+	var out []map[string]interface{}
+	for i, row := range db.tables[table] {
+		ok, err := fakeMatchParams(row, params)
+		if err != nil {
+			return nil, "PGRST100", err
+		}
+		if !ok {
+			continue
+		}
+		updated := fakeRow(row)
+		for k, v := range set {
+			updated[k] = v
+		}
+		if err := db.checkUnique(table, updated, i); err != nil {
+			return nil, "23505", err
+		}
+		for k, v := range set {
+			row[k] = v
+		}
+		out = append(out, fakeRow(row))
+	}
+	return out, "", nil
+}
+
+func (db *fakePostgREST) delete(table string, params map[string][]string) ([]map[string]interface{}, error) {
+	var kept, out []map[string]interface{}
+	for _, row := range db.tables[table] {
+		ok, err := fakeMatchParams(row, params)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out = append(out, row)
+		} else {
+			kept = append(kept, row)
+		}
+	}
+	db.tables[table] = kept
+	return out, nil
+}
+
+func (db *fakePostgREST) fillDefaults(table string, row map[string]interface{}) {
+	if _, ok := row["id"]; !ok {
+		row["id"] = json.Number(strconv.Itoa(db.nextID))
+		db.nextID++
+	}
+	if _, ok := row["created_at"]; !ok {
+		row["created_at"] = dbTimestamp(time.Now())
+	}
+	for k, v := range fakeDefaults[table] {
+		if _, ok := row[k]; !ok {
+			row[k] = v
+		}
+	}
+}
+
+// find returns the stored row with the same values in keys as row.
+func (db *fakePostgREST) find(table string, row map[string]interface{}, keys []string) map[string]interface{} {
+	for _, existing := range db.tables[table] {
+		if fakeSame(existing, row, keys) {
+			return existing
+		}
+	}
+	return nil
+}
+
+// checkUnique reports a unique_violation if row clashes with a stored row
+// other than the one at index skip.
+func (db *fakePostgREST) checkUnique(table string, row map[string]interface{}, skip int) error {
+	for _, u := range fakeUnique {
+		if u.table != table || !u.where(row) {
+			continue
+		}
+		for i, existing := range db.tables[table] {
+			if i != skip && u.where(existing) && u.key(existing) == u.key(row) {
+				return fmt.Errorf("duplicate key value violates unique constraint %q", u.name)
+			}
+		}
+	}
+	return nil
+}
+
+func fakeSame(a, b map[string]interface{}, columns []string) bool {
+	for _, c := range columns {
+		x, _ := fakeValue(a[c])
+		y, _ := fakeValue(b[c])
+		if x != y {
+			return false
+		}
+	}
+	return true
+}
+
+// fakeMatchParams applies the query string filters to row; parameters that
+// aren't filters are skipped.
+func fakeMatchParams(row map[string]interface{}, params map[string][]string) (bool, error) {
+	for key, values := range params {
+		switch key {
+		case "select", "order", "limit", "offset", "on_conflict", "columns":
+			continue
+		}
+		for _, value := range values {
+			var ok bool
+			var err error
+			if key == "and" || key == "or" {
+				ok, err = fakeMatchGroup(row, key, strings.TrimSuffix(strings.TrimPrefix(value, "("), ")"))
+			} else {
+				ok, err = fakeMatchColumn(row, key, value)
+			}
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// fakeMatchGroup evaluates the comma-separated conditions of and()/or(),
+// which may nest further groups.
+func fakeMatchGroup(row map[string]interface{}, op, list string) (bool, error) {
+	for _, cond := range fakeSplit(list) {
+		var ok bool
+		var err error
+		switch {
+		case strings.HasPrefix(cond, "and(") || strings.HasPrefix(cond, "or("):
+			inner, rest, _ := strings.Cut(cond, "(")
+			ok, err = fakeMatchGroup(row, inner, strings.TrimSuffix(rest, ")"))
+		default:
+			column, expr, found := strings.Cut(cond, ".")
+			if !found {
+				return false, fmt.Errorf("bad condition %q", cond)
+			}
+			ok, err = fakeMatchColumn(row, column, expr)
+		}
+		if err != nil {
+			return false, err
+		}
+		if op == "or" && ok {
+			return true, nil
+		}
+		if op == "and" && !ok {
+			return false, nil
+		}
+	}
+	return op == "and", nil
+}
+
+// fakeMatchColumn evaluates one "op.value" filter, with SQL's rule that a
+// comparison with NULL is never true.
+func fakeMatchColumn(row map[string]interface{}, column, expr string) (bool, error) {
+	negate := strings.HasPrefix(expr, "not.")
+	expr = strings.TrimPrefix(expr, "not.")
+	op, want, _ := strings.Cut(expr, ".")
+	got, isNull := fakeValue(row[column])
+
+	var ok bool
+	switch op {
+	case "is":
+		switch want {
+		case "null":
+			ok = isNull
+		default:
+			ok = !isNull && got == want
+		}
+		if negate {
+			ok = !ok
+		}
+		return ok, nil
+	case "eq":
+		ok = got == want
+	case "neq":
+		ok = got != want
+	case "gt":
+		ok = fakeCompare(got, want) > 0
+	case "gte":
+		ok = fakeCompare(got, want) >= 0
+	case "lt":
+		ok = fakeCompare(got, want) < 0
+	case "lte":
+		ok = fakeCompare(got, want) <= 0
+	case "in":
+		ok = containsString(fakeSplit(strings.TrimSuffix(strings.TrimPrefix(want, "("), ")")), got)
+	default:
+		return false, fmt.Errorf("unsupported operator %q", op)
+	}
+	if isNull {
+		return false, nil
+	}
+	return ok != negate, nil
+}
+
+// fakeSplit splits on top-level commas, keeping parenthesised groups whole
+// and unquoting "values".
+func fakeSplit(list string) []string {
+	var parts []string
+	var cur strings.Builder
+	depth, quoted := 0, false
+	for _, r := range list {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			continue
+		case quoted:
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == ',' && depth == 0:
+			parts = append(parts, cur.String())
+			cur.Reset()
+			continue
+		}
+		cur.WriteRune(r)
+	}
+	if cur.Len() > 0 {
+		parts = append(parts, cur.String())
+	}
+	return parts
+}
+
+// fakeValue renders a stored value the way it appears in a filter.
+func fakeValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", true
+	case string:
+		return v, false
+	case json.Number:
+		return v.String(), false
+	case bool:
+		return strconv.FormatBool(v), false
+	default:
+		b, _ := json.Marshal(v)
+		return string(b), false
+	}
+}
+
+// fakeCompare orders numbers numerically, timestamps by instant and
+// everything else (dates, clock times) as text.
+func fakeCompare(a, b string) int {
+	if x, err := strconv.ParseFloat(a, 64); err == nil {
+		if y, err := strconv.ParseFloat(b, 64); err == nil {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	if x, err := time.Parse(time.RFC3339, a); err == nil {
+		if y, err := time.Parse(time.RFC3339, b); err == nil {
+			return x.Compare(y)
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// fakeSort applies order=col.asc.nullslast,... with NULLs last.
+func fakeSort(rows []map[string]interface{}, order string) {
+	terms := strings.Split(order, ",")
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, term := range terms {
+			parts := strings.Split(term, ".")
+			a, aNull := fakeValue(rows[i][parts[0]])
+			b, bNull := fakeValue(rows[j][parts[0]])
+			if aNull != bNull {
+				return bNull
+			}
+			c := fakeCompare(a, b)
+			if len(parts) > 1 && parts[1] == "desc" {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+// fakeBody decodes a JSON object or array of objects, keeping numbers as
+// written.
+func fakeBody(r io.Reader) ([]map[string]interface{}, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var rows []map[string]interface{}
+		err := dec.Decode(&rows)
+		return rows, err
+	}
+	var row map[string]interface{}
+	if err := dec.Decode(&row); err != nil {
+		return nil, err
+	}
+	return []map[string]interface{}{row}, nil
+}
+
+// fakeRow copies v into a row through JSON.
+func fakeRow(v interface{}) map[string]interface{} {
+	data, _ := json.Marshal(v)
+	rows, _ := fakeBody(bytes.NewReader(data))
+	return rows[0]
+}
+
+func fakeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"code": code, "message": message})
+}
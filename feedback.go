@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Some hours after a completed visit the feedback job asks the client for a
+// 1–5 rating, then for an optional comment. Ratings at or below
+// lowRating are sent to everyone with permReviews.
+
+const (
+	lowRating = 3
+	// Visits that ended earlier than this are not asked about any more.
+	feedbackWindow = 7 * 24 * time.Hour
+
+	stepFeedbackComment = "feedback_comment"
+)
+
+type Review struct {
+	ID         int       `json:"id"`
+	SlotID     int       `json:"slot_id"`
+	MasterID   string    `json:"master_id"`
+	MasterName string    `json:"master_name"`
+	UserID     int64     `json:"user_id"`
+	Rating     int       `json:"rating"`
+	Comment    string    `json:"comment"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type Rating struct {
+	Count int
+	Sum   int
+}
+
+func (r Rating) Average() float64 {
+	if r.Count == 0 {
+		return 0
+	}
+	return float64(r.Sum) / float64(r.Count)
+}
+
+func (r Rating) String() string {
+	return fmt.Sprintf("⭐%.1f (%d)", r.Average(), r.Count)
+}
+
+func stars(rating int) string {
+	return strings.Repeat("★", rating) + strings.Repeat("☆", 5-rating)
+}
+
+// feedbackDue returns completed visits that ended at least FeedbackDelay ago
+// and were not asked about yet.
+func feedbackDue(now time.Time) ([]Slot, error) {
+	data, _, err := supabaseClient.From("slots").
+		Select("*", "", false).
+		Eq("status", "completed").
+		Is("feedback_requested_at", "null").
+		Not("user_id", "is", "null").
+		// postgrest-go keeps one filter per column, so both ends_at bounds go into a single and=()
+		And(fmt.Sprintf("ends_at.lt.%s,ends_at.gt.%s", dbTimestamp(now.Add(-cfg.FeedbackDelay)), dbTimestamp(now.Add(-feedbackWindow))), "").
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+	var slots []Slot
+	err = json.Unmarshal(data, &slots)
+	return slots, err
+}
+
+// markFeedbackRequested claims the slot so the request is sent only once.
+func markFeedbackRequested(slotID int) (bool, error) {
+	data, _, err := supabaseClient.From("slots").
+		Update(map[string]interface{}{"feedback_requested_at": dbTimestamp(time.Now())}, "", "").
+		Eq("id", strconv.Itoa(slotID)).
+		Is("feedback_requested_at", "null").
+		Execute()
+	if err != nil {
+		return false, err
+	}
+	var rows []Slot
+	json.Unmarshal(data, &rows)
+	return len(rows) > 0, nil
+}
+
+// requestFeedback is the feedback job.
+func requestFeedback(ctx context.Context) {
+	slots, err := feedbackDue(time.Now())
+	if err != nil {
+		slog.Error("failed to load visits for feedback", "err", err)
+		return
+	}
+	for _, slot := range slots {
+		if ctx.Err() != nil {
+			return
+		}
+		userID, _ := strconv.ParseInt(slot.UserID, 10, 64)
+		if userID == 0 {
+			continue
+		}
+		claimed, err := markFeedbackRequested(slot.ID)
+		if err != nil {
+			slog.Error("failed to mark feedback requested", "slot_id", slot.ID, "err", err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		var row []tgbotapi.InlineKeyboardButton
+		for i := 1; i <= 5; i++ {
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData(strconv.Itoa(i)+"⭐", fmt.Sprintf("rate_%d_%d", slot.ID, i)))
+		}
+		message := tgbotapi.NewMessage(userID, fmt.Sprintf("🙏 Как прошёл визит %s к мастеру %s?\n\nОцените, пожалуйста, от 1 до 5:", slot.Date, slot.MasterName))
+		message.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(row)
+		bot.Send(message)
+		slog.Info("feedback requested", "slot_id", slot.ID)
+	}
+}
+
+func loadReview(slotID int) (Review, bool, error) {
+	data, _, err := supabaseClient.From("reviews").Select("*", "", false).
+		Eq("slot_id", strconv.Itoa(slotID)).
+		Execute()
+	if err != nil {
+		return Review{}, false, err
+	}
+	var rows []Review
+	if err := json.Unmarshal(data, &rows); err != nil || len(rows) == 0 {
+		return Review{}, false, err
+	}
+	return rows[0], true, nil
+}
+
+func saveReview(r Review) error {
+	row := map[string]interface{}{
+		"slot_id":     r.SlotID,
+		"master_name": r.MasterName,
+		"user_id":     r.UserID,
+		"rating":      r.Rating,
+	}
+	if r.MasterID != "" {
+		row["master_id"] = r.MasterID
+	}
+	_, _, err := supabaseClient.From("reviews").Insert(row, false, "", "", "").Execute()
+	return err
+}
+
+func setReviewComment(slotID int, comment string) error {
+	_, _, err := supabaseClient.From("reviews").
+		Update(map[string]interface{}{"comment": comment}, "", "").
+		Eq("slot_id", strconv.Itoa(slotID)).
+		Execute()
+	return err
+}
+
+// handleRating handles rate_<slot>_<rating>.
+func handleRating(cb *tgbotapi.CallbackQuery, data string) {
+	parts := strings.Split(strings.TrimPrefix(data, "rate_"), "_")
+	if len(parts) != 2 {
+		return
+	}
+	slotID, _ := strconv.Atoi(parts[0])
+	rating, _ := strconv.Atoi(parts[1])
+	slot, err := getBookingByID(slotID)
+	if err != nil || rating < 1 || rating > 5 || slot.UserID != strconv.FormatInt(cb.From.ID, 10) {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Запись не найдена", ShowAlert: true})
+		return
+	}
+	if slot.Status != "completed" {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Оценить можно только состоявшийся визит", ShowAlert: true})
+		return
+	}
+	if _, exists, err := loadReview(slotID); err != nil || exists {
+		text := "Вы уже оценили этот визит"
+		if err != nil {
+			slog.Error("failed to load review", "slot_id", slotID, "err", err)
+			text = "Ошибка при сохранении"
+		}
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: text, ShowAlert: true})
+		return
+	}
+
+	review := Review{SlotID: slotID, MasterID: resolveMaster(*slot).ID, MasterName: slot.MasterName, UserID: cb.From.ID, Rating: rating}
+	if err := saveReview(review); err != nil {
+		slog.Error("failed to save review", "slot_id", slotID, "err", err)
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Ошибка при сохранении", ShowAlert: true})
+		return
+	}
+	slog.Info("review saved", "slot_id", slotID, "rating", rating)
+	if rating <= lowRating {
+		notifyReviewers(fmt.Sprintf("⚠️ Низкая оценка %s\n\n👨⚕️ %s\n📅 %s %s\n👤 %s %s", stars(rating), slot.MasterName, slot.Date, slot.Time, slot.ClientName, slot.ClientPhone))
+	}
+
+	session := getSession(cb.From.ID)
+	session.Step = stepFeedbackComment
+	session.Data["feedback_slot"] = strconv.Itoa(slotID)
+	setSession(cb.From.ID, session)
+
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("Пропустить", "feedback_skip")},
+	}
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, fmt.Sprintf("Спасибо за оценку %s!\n\nЕсли хотите, напишите пару слов о визите:", stars(rating)))
+	editMsg.ReplyMarkup = markup
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
+
+// finishFeedback leaves the comment step and keeps the rest of the session.
+func finishFeedback(userID int64, session *UserSession) {
+	delete(session.Data, "feedback_slot")
+	session.Step = ""
+	if len(session.Data) == 0 {
+		deleteUserSession(userID)
+		return
+	}
+	saveUserSession(userID, session)
+}
+
+func skipFeedbackComment(cb *tgbotapi.CallbackQuery) {
+	session := getSession(cb.From.ID)
+	if session.Step == stepFeedbackComment {
+		finishFeedback(cb.From.ID, &session)
+	}
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, "Спасибо за оценку!")
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
+
+// interruptsFeedback reports whether the message is a command or a menu
+// button rather than a comment; the comment step is then dropped so the
+// message is handled as usual.
+func interruptsFeedback(msg *tgbotapi.Message) bool {
+	session, err := loadUserSession(msg.From.ID)
+	if err != nil || session.Step != stepFeedbackComment {
+		return false
+	}
+	interrupt := strings.HasPrefix(msg.Text, "/")
+	for _, row := range mainMenuMarkup(msg.From.ID).Keyboard {
+		for _, button := range row {
+			if msg.Text == button.Text {
+				interrupt = true
+			}
+		}
+	}
+	if interrupt {
+		finishFeedback(msg.From.ID, session)
+	}
+	return interrupt
+}
+
+// saveFeedbackComment handles the text sent after a rating.
+func saveFeedbackComment(msg *tgbotapi.Message, session *UserSession) {
+	slotID, _ := strconv.Atoi(sessionString(*session, "feedback_slot"))
+	comment := strings.TrimSpace(msg.Text)
+	if comment == "" {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "Напишите комментарий текстом или нажмите «Пропустить»."))
+		return
+	}
+	finishFeedback(msg.From.ID, session)
+
+	if err := setReviewComment(slotID, comment); err != nil {
+		slog.Error("failed to save review comment", "slot_id", slotID, "err", err)
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Не удалось сохранить комментарий"))
+		return
+	}
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "Спасибо за отзыв! 🤍"))
+
+	if review, ok, _ := loadReview(slotID); ok && review.Rating <= lowRating {
+		notifyReviewers(fmt.Sprintf("💬 Комментарий к оценке %s\n\n👨⚕️ %s\n%s", stars(review.Rating), review.MasterName, comment))
+	}
+}
+
+func notifyReviewers(text string) {
+	for _, id := range usersWith(permReviews) {
+		bot.Send(tgbotapi.NewMessage(id, text))
+	}
+}
+
+// masterRatings returns average ratings keyed by master id. The
+// master_ratings view sums the reviews in the database, so the picker reads
+// one row per master rather than every review.
+func masterRatings() map[string]Rating {
+	ratings := make(map[string]Rating)
+	data, _, err := supabaseClient.From("master_ratings").Select("master_id,count,sum", "", false).Execute()
+	if err != nil {
+		slog.Error("failed to load ratings", "err", err)
+		return ratings
+	}
+	var rows []struct {
+		MasterID string `json:"master_id"`
+		Count    int    `json:"count"`
+		Sum      int    `json:"sum"`
+	}
+	json.Unmarshal(data, &rows)
+	for _, r := range rows {
+		ratings[r.MasterID] = Rating{Count: r.Count, Sum: r.Sum}
+	}
+	return ratings
+}
+
+// masterLabels maps master names to "Name ⭐4.8 (12)" for those with reviews.
+func masterLabels() map[string]string {
+	ratings := masterRatings()
+	labels := make(map[string]string)
+	for id, master := range mastersSnapshot() {
+		if r, ok := ratings[id]; ok {
+			labels[master.Name] = master.Name + " " + r.String()
+		}
+	}
+	return labels
+}
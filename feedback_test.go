@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFeedbackAfterDelay(t *testing.T) {
+	b := newTestBot(t)
+	client := &FakeUser{ID: 4001, UserName: "ivan"}
+	date, slotTime, messageID := b.bookUntilConfirmation(client)
+	b.handle(client.Press(messageID, "confirm_booking"))
+
+	booked := b.db.rows("slots", map[string]string{"status": "booked"})
+	if len(booked) != 1 || booked[0]["master_id"] != "m1" {
+		t.Fatalf("booked slots = %v, want one with master_id m1", booked)
+	}
+	slotID, _ := fakeValue(booked[0]["id"])
+	rate := fmt.Sprintf("rate_%s_5", slotID)
+
+	b.handle(client.Press(messageID, rate))
+	b.expectAnswer("Оценить можно только состоявшийся визит")
+
+	now := time.Now()
+	b.db.set("slots", slotID, map[string]interface{}{"status": "completed", "ends_at": dbTimestamp(now.Add(-time.Hour))})
+	b.handled = len(b.api.Calls())
+	requestFeedback(context.Background())
+	if got := b.messagesTo(client.ID); len(got) != 0 {
+		t.Errorf("asked for a rating an hour after the visit: %q", got)
+	}
+
+	b.db.set("slots", slotID, map[string]interface{}{"ends_at": dbTimestamp(now.Add(-cfg.FeedbackDelay - time.Minute))})
+	requestFeedback(context.Background())
+	ask := b.last("sendMessage")
+	b.expectText(ask, fmt.Sprintf("🙏 Как прошёл визит %s к мастеру Ахмед?\n\nОцените, пожалуйста, от 1 до 5:", date))
+	b.expectKeyboard(ask, [][]string{{"1⭐|rate_" + slotID + "_1", "2⭐|rate_" + slotID + "_2", "3⭐|rate_" + slotID + "_3", "4⭐|rate_" + slotID + "_4", "5⭐|rate_" + slotID + "_5"}})
+
+	b.db.set("slots", slotID, map[string]interface{}{"feedback_requested_at": nil, "ends_at": dbTimestamp(now.Add(-feedbackWindow - time.Minute))})
+	b.handled = len(b.api.Calls())
+	requestFeedback(context.Background())
+	if got := b.messagesTo(client.ID); len(got) != 0 {
+		t.Errorf("asked about a visit older than the window: %q", got)
+	}
+
+	b.handle(client.Press(ask.MessageID, rate))
+	reviews := b.db.rows("reviews", nil)
+	if len(reviews) != 1 || reviews[0]["master_id"] != "m1" {
+		t.Fatalf("reviews = %v, want one for m1", reviews)
+	}
+	if got := masterLabels()["Ахмед"]; got != "Ахмед ⭐5.0 (1)" {
+		t.Errorf("master label = %q (booked %s %s)", got, date, slotTime)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const healthTimeout = 5 * time.Second
+
+// shuttingDown makes /readyz fail as soon as shutdown starts so the load
+// balancer stops routing webhooks to this replica.
+var shuttingDown atomic.Bool
+
+type healthCheck struct {
+	Name    string
+	Err     error
+	Latency time.Duration
+}
+
+func runHealthChecks() []healthCheck {
+	checks := []struct {
+		name string
+		fn   func() error
+	}{
+		{"database", pingDB},
+		{"telegram", pingTelegram},
+	}
+
+	results := make([]healthCheck, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, name string, fn func() error) {
+			defer wg.Done()
+			start := time.Now()
+			err := withTimeout(healthTimeout, fn)
+			results[i] = healthCheck{Name: name, Err: err, Latency: time.Since(start)}
+		}(i, c.name, c.fn)
+	}
+	wg.Wait()
+	return results
+}
+
+func pingDB() error {
+	_, _, err := supabaseClient.From("masters").Select("id", "", false).Limit(1, "").Execute()
+	return err
+}
+
+func pingTelegram() error {
+	_, err := api.GetMe()
+	return err
+}
+
+func withTimeout(d time.Duration, fn func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(d):
+		return errors.New("timeout")
+	}
+}
+
+func formatHealthChecks(checks []healthCheck) string {
+	names := map[string]string{"database": "База данных", "telegram": "Telegram API"}
+	var lines []string
+	for _, c := range checks {
+		if c.Err != nil {
+			lines = append(lines, fmt.Sprintf("❌ %s: %v", names[c.Name], c.Err))
+		} else {
+			lines = append(lines, fmt.Sprintf("✅ %s (%d мс)", names[c.Name], c.Latency.Milliseconds()))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// serveHealthz is the liveness probe and only shows the process answers;
+// restarting the bot does not fix Supabase or Telegram being down.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	body := map[string]string{}
+	if shuttingDown.Load() {
+		status = http.StatusServiceUnavailable
+		body["shutdown"] = "in progress"
+	}
+	for _, c := range runHealthChecks() {
+		if c.Err != nil {
+			status = http.StatusServiceUnavailable
+			body[c.Name] = c.Err.Error()
+		} else {
+			body[c.Name] = "ok"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Hijri dates use the tabular (arithmetic) Islamic calendar, which needs no
+// network or moon-sighting data. It can differ from the announced month start
+// by a day, so staff can shift it with hijriAdjustment.
+
+const hijriAdjustmentKey = "hijri_adjustment"
+
+// sunnahDays are the days of the lunar month recommended for hijama.
+var sunnahDays = map[int]bool{17: true, 19: true, 21: true}
+
+var hijriMonths = []string{
+	"мухаррам", "сафар", "раби аль-авваль", "раби ас-сани", "джумада аль-уля", "джумада ас-сани",
+	"раджаб", "шаабан", "рамадан", "шавваль", "зуль-када", "зуль-хиджа",
+}
+
+var hijriAdjustment atomic.Int32
+
+type HijriDate struct {
+	Year, Month, Day int
+}
+
+func (h HijriDate) String() string {
+	return fmt.Sprintf("%d %s %d", h.Day, hijriMonths[h.Month-1], h.Year)
+}
+
+func (h HijriDate) sunnah() bool {
+	return sunnahDays[h.Day]
+}
+
+// toHijri converts the calendar day of t, shifted by the configured
+// adjustment.
+func toHijri(t time.Time) HijriDate {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	jd := int(day.Unix()/86400) + 2440588 + int(hijriAdjustment.Load())
+
+	l := jd - 1948440 + 10632
+	n := (l - 1) / 10631
+	l = l - 10631*n + 354
+	j := ((10985-l)/5316)*((50*l)/17719) + (l/5670)*((43*l)/15238)
+	l = l - ((30-j)/15)*((17719*j)/50) - (j/16)*((15238*j)/43) + 29
+	m := (24 * l) / 709
+	return HijriDate{Year: 30*n + j - 30, Month: m, Day: l - (709*m)/24}
+}
+
+func loadHijriAdjustment() {
+	data, _, err := supabaseClient.From("settings").Select("value", "", false).
+		Eq("key", hijriAdjustmentKey).
+		Execute()
+	if err != nil {
+		slog.Error("failed to load hijri adjustment", "err", err)
+		return
+	}
+	var rows []struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(data, &rows); err != nil || len(rows) == 0 {
+		return
+	}
+	if n, err := strconv.Atoi(rows[0].Value); err == nil {
+		hijriAdjustment.Store(int32(n))
+	}
+}
+
+func saveHijriAdjustment(actorID int64, n int) error {
+	row := map[string]interface{}{
+		"key":        hijriAdjustmentKey,
+		"value":      strconv.Itoa(n),
+		"updated_by": actorID,
+		"updated_at": time.Now().UTC(),
+	}
+	_, _, err := supabaseClient.From("settings").Upsert(row, "key", "", "").Execute()
+	if err != nil {
+		return err
+	}
+	before := hijriAdjustment.Swap(int32(n))
+	writeAudit(actorID, auditSettingUpdate, "setting", hijriAdjustmentKey, 0, before, n)
+	return nil
+}
+
+// hijriCommand handles "/hijri [-1|0|+1]".
+func hijriCommand(msg *tgbotapi.Message) {
+	arg := strings.TrimSpace(msg.CommandArguments())
+	if arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < -1 || n > 1 {
+			bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "Использование: /hijri -1, /hijri 0 или /hijri +1"))
+			return
+		}
+		if err := saveHijriAdjustment(msg.From.ID, n); err != nil {
+			slog.Error("failed to save hijri adjustment", "err", err)
+			bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Ошибка при сохранении"))
+			return
+		}
+	}
+
+	today := time.Now().In(tz)
+	text := fmt.Sprintf("🌙 Сегодня %s (%s)\nПоправка: %+d дн.\n\nБлижайшие дни сунны:",
+		toHijri(today), today.Format("02.01.2006"), hijriAdjustment.Load())
+	for i := 0; i < bookingWindowDays; i++ {
+		date := today.AddDate(0, 0, i)
+		if h := toHijri(date); h.sunnah() {
+			text += fmt.Sprintf("\n⭐ %s — %s", date.Format("02.01.2006"), h)
+		}
+	}
+	text += "\n\nЕсли начало месяца объявили на день раньше или позже расчёта, задайте поправку: /hijri -1, /hijri 0 или /hijri +1"
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, text))
+}
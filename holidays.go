@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/supabase-community/postgrest-go"
+)
+
+// ClosedDay is a non-working day of one centre, or of every centre when
+// LocationID is empty; a shortened one when Opens and Closes are set.
+type ClosedDay struct {
+	Date       string `json:"date"`
+	LocationID string `json:"location_id"`
+	Opens      string `json:"opens,omitempty"`
+	Closes     string `json:"closes,omitempty"`
+	Note       string `json:"note,omitempty"`
+}
+
+func (d ClosedDay) String() string {
+	text := d.Date
+	if d.LocationID != "" {
+		text += " " + locationByID(d.LocationID).Name
+	}
+	if d.Opens == "" {
+		text += " — выходной"
+	} else {
+		text += fmt.Sprintf(" — сокращённый %s–%s", d.Opens, d.Closes)
+	}
+	if d.Note != "" {
+		text += " (" + d.Note + ")"
+	}
+	return text
+}
+
+// loadClosedDays returns the closed days of the location in [from, to] by
+// date; a day set for the location overrides one set for every centre. Errors
+// are logged and treated as "open", like loadBlocks.
+func loadClosedDays(from, to, locationID string) map[string]ClosedDay {
+	days, err := getClosedDays(from, to)
+	if err != nil {
+		slog.Error("failed to load closed days", "from", from, "to", to, "err", err)
+	}
+	byDate := make(map[string]ClosedDay, len(days))
+	for _, d := range days {
+		if d.LocationID == "" {
+			if _, ok := byDate[d.Date]; !ok {
+				byDate[d.Date] = d
+			}
+		} else if d.LocationID == locationID {
+			byDate[d.Date] = d
+		}
+	}
+	return byDate
+}
+
+func getClosedDays(from, to string) ([]ClosedDay, error) {
+	data, _, err := supabaseClient.From("closed_days").Select("*", "exact", false).
+		And("date.gte."+from+",date.lte."+to, "").
+		Order("date", &postgrest.OrderOpts{Ascending: true}).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []ClosedDay
+	err = json.Unmarshal(data, &results)
+	return results, err
+}
+
+// replaceClosedDays makes days the whole calendar of the location ("" for
+// every centre) for every year they cover. The new days are upserted before
+// stale ones are deleted, so a failure halfway never leaves the centre with an
+// empty calendar.
+func replaceClosedDays(days []ClosedDay, locationID string) error {
+	rows := make([]map[string]interface{}, 0, len(days))
+	for _, d := range days {
+		row := map[string]interface{}{"date": d.Date, "location_id": nil, "opens": nil, "closes": nil, "note": d.Note}
+		if locationID != "" {
+			row["location_id"] = locationID
+		}
+		if d.Opens != "" {
+			row["opens"], row["closes"] = d.Opens, d.Closes
+		}
+		rows = append(rows, row)
+	}
+	if _, _, err := supabaseClient.From("closed_days").Insert(rows, true, "date,location_id", "", "").Execute(); err != nil {
+		return err
+	}
+	years := make(map[string][]string)
+	for _, d := range days {
+		years[d.Date[:4]] = append(years[d.Date[:4]], d.Date)
+	}
+	for year, dates := range years {
+		_, _, err := supabaseClient.From("closed_days").
+			Delete("", "").
+			And("date.gte."+year+"-01-01,date.lte."+year+"-12-31,date.not.in.("+strings.Join(dates, ",")+"),"+locationFilter(locationID), "").
+			Execute()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteClosedDay(date, locationID string) error {
+	_, _, err := supabaseClient.From("closed_days").
+		Delete("", "").
+		And("date.eq."+date+","+locationFilter(locationID), "").
+		Execute()
+	return err
+}
+
+// locationFilter matches rows of the location, or those for every centre
+// when locationID is empty.
+func locationFilter(locationID string) string {
+	if locationID == "" {
+		return "location_id.is.null"
+	}
+	return "location_id.eq." + locationID
+}
+
+// parseHolidays reads the import format, one entry per line:
+//
+//	# comment
+//	2027-01-01 Новый год
+//	02.01.2027..08.01.2027 Новогодние каникулы
+//	2027-02-22 10:00-17:00 Предпраздничный день
+//
+// A time range marks a shortened day with those opening hours; without one
+// the centre is closed. Errors name the offending line.
+func parseHolidays(r io.Reader) ([]ClosedDay, error) {
+	byDate := make(map[string]ClosedDay)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\uFEFF"))
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = strings.TrimSpace(text[:i])
+		}
+		if text == "" {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		from, to, isRange := strings.Cut(fields[0], "..")
+		start, err := parseBlockDate(from)
+		if err != nil {
+			return nil, fmt.Errorf("строка %d: неверная дата %q", line, from)
+		}
+		end := start
+		if isRange {
+			if end, err = parseBlockDate(to); err != nil || end < start {
+				return nil, fmt.Errorf("строка %d: неверный диапазон %q", line, fields[0])
+			}
+		}
+
+		day := ClosedDay{}
+		rest := fields[1:]
+		if len(rest) > 0 && strings.Contains(rest[0], ":") {
+			if !strings.Contains(rest[0], "-") {
+				return nil, fmt.Errorf("строка %d: для сокращённого дня нужен интервал ЧЧ:ММ-ЧЧ:ММ", line)
+			}
+			if day.Opens, day.Closes, err = parseBlockTimes(rest[0]); err != nil {
+				return nil, fmt.Errorf("строка %d: неверное время %q", line, rest[0])
+			}
+			rest = rest[1:]
+		}
+		day.Note = strings.Join(rest, " ")
+
+		for d, _ := time.Parse("2006-01-02", start); d.Format("2006-01-02") <= end; d = d.AddDate(0, 0, 1) {
+			day.Date = d.Format("2006-01-02")
+			byDate[day.Date] = day
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	days := make([]ClosedDay, 0, len(byDate))
+	for _, d := range byDate {
+		days = append(days, d)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Date < days[j].Date })
+	return days, nil
+}
+
+const holidaysUsage = `Праздники и выходные центра:
+/holidays — ближайшие дни
+/holidays import [центр] — загрузить файл (или прислать текст) на год
+/holidays del <дата> [центр] — открыть день
+
+Формат файла, одна строка — одна запись:
+# Праздники 2027
+01.01.2027..08.01.2027 Новогодние каникулы
+22.02.2027 10:00-17:00 Предпраздничный день
+23.02.2027 День защитника Отечества
+
+С интервалом времени день сокращённый, без него центр закрыт. Импорт заменяет все дни тех лет, что есть в файле. Без центра (id из таблицы locations) дни действуют во всех центрах, с центром — только в нём и важнее общих.`
+
+// holidaysCommand handles "/holidays [import | del <date>]".
+func holidaysCommand(msg *tgbotapi.Message) {
+	args := strings.Fields(msg.CommandArguments())
+	locationID := ""
+	if n := len(args); n > 0 && (args[0] == "import" && n == 2 || args[0] == "del" && n == 3) {
+		locationID = args[n-1]
+		if _, ok := getLocation(locationID); !ok {
+			bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Нет центра "+locationID+"\n\n"+holidaysUsage))
+			return
+		}
+		args = args[:n-1]
+	}
+	switch {
+	case len(args) == 0:
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, closedDaysText()+"\n\n"+holidaysUsage))
+	case args[0] == "import":
+		saveUserSession(msg.From.ID, &UserSession{Step: "holidays_import", Data: map[string]interface{}{"location": locationID}})
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "Пришлите файл .txt со списком дней или вставьте его текстом. /cancel — отмена."))
+	case args[0] == "del" && len(args) == 2:
+		date, err := parseBlockDate(args[1])
+		if err != nil {
+			bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Неверная дата\n\n"+holidaysUsage))
+			return
+		}
+		var before ClosedDay
+		if days, err := getClosedDays(date, date); err == nil {
+			for _, d := range days {
+				if d.LocationID == locationID {
+					before = d
+				}
+			}
+		}
+		if err := deleteClosedDay(date, locationID); err != nil {
+			slog.Error("failed to delete closed day", "date", date, "err", err)
+			bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Ошибка при удалении"))
+			return
+		}
+		if before.Date != "" {
+			writeAudit(msg.From.ID, auditClosedDayDelete, "closed_day", date, 0, before, nil)
+		}
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "✅ "+date+" — рабочий день"))
+	default:
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, holidaysUsage))
+	}
+}
+
+// importHolidays handles the message sent after "/holidays import".
+func importHolidays(msg *tgbotapi.Message) {
+	if msg.Text == "/cancel" {
+		deleteUserSession(msg.From.ID)
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "Импорт отменён"))
+		return
+	}
+
+	var r io.Reader = strings.NewReader(msg.Text)
+	if msg.Document != nil {
+		body, err := downloadDocument(msg.Document.FileID)
+		if err != nil {
+			slog.Error("failed to download holidays file", "err", err)
+			bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Не удалось скачать файл, попробуйте ещё раз"))
+			return
+		}
+		defer body.Close()
+		r = io.LimitReader(body, 1<<20)
+	}
+
+	days, err := parseHolidays(r)
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ "+err.Error()+"\n\nИсправьте и пришлите ещё раз или /cancel."))
+		return
+	}
+	if len(days) == 0 {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ В файле нет ни одной даты. Пришлите ещё раз или /cancel."))
+		return
+	}
+	locationID := sessionString(getSession(msg.From.ID), "location")
+	deleteUserSession(msg.From.ID)
+
+	if err := replaceClosedDays(days, locationID); err != nil {
+		slog.Error("failed to import closed days", "err", err)
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Ошибка при сохранении"))
+		return
+	}
+	writeAudit(msg.From.ID, auditClosedDaysImport, "closed_day", days[0].Date[:4], 0, nil, days)
+
+	text := fmt.Sprintf("✅ Загружено дней: %d", len(days))
+	if booked := bookingsOnClosedDays(days, locationID); len(booked) > 0 {
+		text += "\n\n⚠️ На эти дни уже есть записи вне рабочего времени — перенесите или отмените их в расписании:"
+		for _, slot := range booked {
+			text += fmt.Sprintf("\n#%d %s %s %s — %s", slot.ID, slot.Date, slot.Time, slot.MasterName, slot.ClientName)
+		}
+	}
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, text))
+}
+
+func downloadDocument(fileID string) (io.ReadCloser, error) {
+	url, err := api.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("download failed: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func bookingsOnClosedDays(days []ClosedDay, locationID string) []Slot {
+	slots, err := getSlots(SlotFilter{From: days[0].Date, To: days[len(days)-1].Date, Status: "booked"})
+	if err != nil {
+		slog.Error("failed to check bookings on closed days", "err", err)
+		return nil
+	}
+	cal := calendar{closed: make(map[string]ClosedDay)}
+	for _, d := range days {
+		cal.closed[d.Date] = d
+	}
+	var booked []Slot
+	for _, slot := range slots {
+		if locationID != "" && slotLocation(slot).ID != locationID {
+			continue
+		}
+		if !cal.centreOpen(slot.Date, slot.Time) {
+			booked = append(booked, slot)
+		}
+	}
+	return booked
+}
+
+func closedDaysText() string {
+	from := time.Now().In(tz).Format("2006-01-02")
+	to := time.Now().In(tz).AddDate(1, 0, 0).Format("2006-01-02")
+	days, err := getClosedDays(from, to)
+	if err != nil {
+		slog.Error("failed to load closed days", "err", err)
+		return "❌ Не удалось загрузить календарь"
+	}
+	if len(days) == 0 {
+		return "📆 Праздников и выходных не задано"
+	}
+	text := "📆 Праздники и выходные\n"
+	for _, d := range days {
+		text += "\n" + d.String()
+	}
+	return text
+}
+
+func showAdminHolidays(cb *tgbotapi.CallbackQuery) {
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("← Назад", "admin_back")},
+	}
+	text := closedDaysText() + "\n\n" + holidaysUsage
+	if len(text) > 4000 {
+		text = text[:strings.LastIndex(text[:4000], "\n")]
+	}
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, text)
+	editMsg.ReplyMarkup = markup
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	defaultDurationMinutes = 60
+	reminderBefore         = 2 * time.Hour
+)
+
+func packageDuration(pkg Package) time.Duration {
+	if pkg.Duration <= 0 {
+		return defaultDurationMinutes * time.Minute
+	}
+	return time.Duration(pkg.Duration) * time.Minute
+}
+
+func buildBookingICS(slot Slot, pkg Package) ([]byte, error) {
+	var buf bytes.Buffer
+	writeICSHeader(&buf, "HGN")
+	summary := "Хиджама"
+	if pkg.Name != "" {
+		summary += ": " + pkg.Name
+	}
+	if err := writeICSEvent(&buf, slot, summary, "Мастер: "+slot.MasterName, packageDuration(pkg)); err != nil {
+		return nil, err
+	}
+	writeICSLine(&buf, "END:VCALENDAR")
+	return buf.Bytes(), nil
+}
+
+func buildMasterFeed(master Master, slots []Slot) []byte {
+	var buf bytes.Buffer
+	writeICSHeader(&buf, "HGN · "+master.Name)
+	for _, slot := range slots {
+		_, pkg := resolvePackage(slot.PackageName)
+		summary := slot.ClientName
+		if summary == "" {
+			summary = "Запись"
+		}
+		desc := fmt.Sprintf("Процедура: %s\nТелефон: %s", slot.PackageName, slot.ClientPhone)
+		if err := writeICSEvent(&buf, slot, summary, desc, packageDuration(pkg)); err != nil {
+			slog.Warn("skipping slot in ICS feed", "slot_id", slot.ID, "err", err)
+		}
+	}
+	writeICSLine(&buf, "END:VCALENDAR")
+	return buf.Bytes()
+}
+
+func writeICSHeader(buf *bytes.Buffer, name string) {
+	writeICSLine(buf, "BEGIN:VCALENDAR")
+	writeICSLine(buf, "VERSION:2.0")
+	writeICSLine(buf, "PRODID:-//HGN//Hidjama Bot//RU")
+	writeICSLine(buf, "CALSCALE:GREGORIAN")
+	writeICSLine(buf, "METHOD:PUBLISH")
+	writeICSLine(buf, "X-WR-CALNAME:"+icsEscape(name))
+}
+
+func writeICSEvent(buf *bytes.Buffer, slot Slot, summary, description string, duration time.Duration) error {
+	start, err := slotStartTime(slot)
+	if err != nil {
+		return err
+	}
+	const stamp = "20060102T150405Z"
+
+	writeICSLine(buf, "BEGIN:VEVENT")
+	writeICSLine(buf, fmt.Sprintf("UID:slot-%d-%s@hgn-bot", slot.ID, start.UTC().Format(stamp)))
+	writeICSLine(buf, "DTSTAMP:"+time.Now().UTC().Format(stamp))
+	writeICSLine(buf, "DTSTART:"+start.UTC().Format(stamp))
+	writeICSLine(buf, "DTEND:"+start.Add(duration).UTC().Format(stamp))
+	writeICSLine(buf, "SUMMARY:"+icsEscape(summary))
+	writeICSLine(buf, "DESCRIPTION:"+icsEscape(description))
+	loc := slotLocation(slot)
+	writeICSLine(buf, "LOCATION:"+icsEscape(loc.Name+", "+loc.Address))
+	if loc.hasCoordinates() {
+		writeICSLine(buf, fmt.Sprintf("GEO:%f;%f", loc.Latitude, loc.Longitude))
+	}
+	writeICSLine(buf, "BEGIN:VALARM")
+	writeICSLine(buf, "ACTION:DISPLAY")
+	writeICSLine(buf, "DESCRIPTION:"+icsEscape(summary))
+	writeICSLine(buf, fmt.Sprintf("TRIGGER:-PT%dM", int(reminderBefore.Minutes())))
+	writeICSLine(buf, "END:VALARM")
+	writeICSLine(buf, "END:VEVENT")
+	return nil
+}
+
+func icsEscape(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+	return r.Replace(s)
+}
+
+// writeICSLine folds content lines at 75 octets without splitting UTF-8 sequences (RFC 5545, 3.1).
+func writeICSLine(buf *bytes.Buffer, line string) {
+	width := 0
+	for _, r := range line {
+		size := len(string(r))
+		if width+size > 75 {
+			buf.WriteString("\r\n ")
+			width = 1
+		}
+		buf.WriteRune(r)
+		width += size
+	}
+	buf.WriteString("\r\n")
+}
+
+func masterFeedToken(masterID string) string {
+	mac := hmac.New(sha256.New, []byte(cfg.ICSSecret))
+	mac.Write([]byte(masterID))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+func masterFeedURL(masterID string) string {
+	if cfg.ICSSecret == "" || cfg.PublicURL == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/ics/%s.ics?token=%s", cfg.PublicURL, masterID, masterFeedToken(masterID))
+}
+
+// serveMasterFeed serves GET /ics/<master_id>.ics?token=<token>.
+func serveMasterFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	masterID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/ics/"), ".ics")
+	token := r.URL.Query().Get("token")
+	if !hmac.Equal([]byte(token), []byte(masterFeedToken(masterID))) {
+		http.NotFound(w, r)
+		return
+	}
+	master, ok := getMaster(masterID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	from := time.Now().In(tz).AddDate(0, 0, -30).Format("2006-01-02")
+	slots, err := getSlots(SlotFilter{From: from, MasterName: master.Name, Status: "booked"})
+	if err != nil {
+		slog.Error("failed to load ICS feed", "master_id", masterID, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(buildMasterFeed(master, slots))
+}
+
+func showMasterCalendar(cb *tgbotapi.CallbackQuery, data string) {
+	masterID := strings.TrimPrefix(data, "master_calendar_")
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("← Назад", "master_back_"+masterID)},
+	}
+
+	text := "📅 Календарь недоступен: не настроены PUBLIC_URL и ICS_SECRET"
+	if url := masterFeedURL(masterID); url != "" {
+		text = "📅 Подпишитесь на календарь в телефоне по ссылке (только для вас, не передавайте её):\n\n" + url
+	}
+
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, text)
+	editMsg.ReplyMarkup = markup
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var jobsWG sync.WaitGroup
+
+// startJob runs fn every interval until ctx is cancelled. A run that is in
+// progress when ctx is cancelled is allowed to finish.
+func startJob(ctx context.Context, name string, interval time.Duration, fn func(ctx context.Context)) {
+	jobsWG.Add(1)
+	go func() {
+		defer jobsWG.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		slog.Info("background job started", "job", name)
+		for {
+			select {
+			case <-ctx.Done():
+				slog.Info("background job stopped", "job", name)
+				return
+			case <-ticker.C:
+				fn(ctx)
+			}
+		}
+	}()
+}
+
+func waitJobs(ctx context.Context) error {
+	return waitGroupWithin(ctx, &jobsWG)
+}
+
+func waitGroupWithin(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ctxTransport aborts outgoing HTTP requests once ctx is cancelled.
+// supabase-go and telegram-bot-api do not accept a context per call, but both
+// end up on http.DefaultTransport, so binding it here gives every DB and
+// Telegram request the bot's lifetime.
+type ctxTransport struct {
+	base http.RoundTripper
+	ctx  context.Context
+}
+
+func (t *ctxTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	stop := context.AfterFunc(t.ctx, cancel)
+	release := func() {
+		stop()
+		cancel()
+	}
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+func bindHTTPToContext(ctx context.Context) {
+	http.DefaultTransport = &ctxTransport{base: http.DefaultTransport, ctx: ctx}
+}
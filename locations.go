@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Location is one HGN centre. Opens and Closes bound the bookable hours;
+// masters without a location_id work at every centre.
+type Location struct {
+	ID        string  `json:"id"`
+	Name      string  `json:"name"`
+	Address   string  `json:"address"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Timezone  string  `json:"timezone"`
+	Opens     string  `json:"opens"`
+	Closes    string  `json:"closes"`
+	Active    bool    `json:"active"`
+
+	zone *time.Location
+}
+
+// defaultLocation is used until the locations table is filled.
+var defaultLocation = Location{
+	ID:      "main",
+	Name:    "HGN Москва",
+	Address: "Мичуринский проспект, 19к1",
+	Opens:   "09:00",
+	Closes:  "21:00",
+	Active:  true,
+}
+
+func loadLocationsFromDB() map[string]Location {
+	locations := make(map[string]Location)
+
+	data, _, err := supabaseClient.From("locations").Select("*", "exact", false).Execute()
+	if err != nil {
+		slog.Error("failed to load locations", "err", err)
+		return locations
+	}
+
+	var results []Location
+	if err := json.Unmarshal(data, &results); err != nil {
+		slog.Error("failed to decode locations", "err", err)
+		return locations
+	}
+
+	for _, l := range results {
+		if !l.Active {
+			continue
+		}
+		if l.Timezone != "" {
+			if l.zone, err = time.LoadLocation(l.Timezone); err != nil {
+				slog.Warn("unknown location timezone, using the default", "location", l.ID, "timezone", l.Timezone)
+			}
+		}
+		locations[l.ID] = l
+	}
+	slog.Info("locations loaded", "total", len(results), "active", len(locations))
+	return locations
+}
+
+// sortedLocations returns the active locations by name, or the default one
+// if none are configured.
+func sortedLocations() []Location {
+	all := locationsSnapshot()
+	if len(all) == 0 {
+		return []Location{defaultLocation}
+	}
+	sorted := make([]Location, 0, len(all))
+	for _, l := range all {
+		sorted = append(sorted, l)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	return sorted
+}
+
+func multipleLocations() bool {
+	return len(locationsSnapshot()) > 1
+}
+
+// locationByID falls back to the first location for unknown ids and for
+// bookings made before locations existed.
+func locationByID(id string) Location {
+	if l, ok := getLocation(id); ok {
+		return l
+	}
+	return sortedLocations()[0]
+}
+
+func slotLocation(slot Slot) Location {
+	return locationByID(slot.LocationID)
+}
+
+func (l Location) timezone() *time.Location {
+	if l.zone != nil {
+		return l.zone
+	}
+	return tz
+}
+
+func (l Location) today() time.Time {
+	return time.Now().In(l.timezone())
+}
+
+func (l Location) hasCoordinates() bool {
+	return l.Latitude != 0 || l.Longitude != 0
+}
+
+func (l Location) String() string {
+	return fmt.Sprintf("Центр: %s\nАдрес: %s", l.Name, l.Address)
+}
+
+func (m Master) worksAt(locationID string) bool {
+	return m.LocationID == "" || m.LocationID == locationID
+}
+
+// mastersAt returns the masters working at the location who perform the
+// package (any package if pkgKey is empty).
+func mastersAt(locationID, pkgKey string) map[string]Master {
+	all := mastersSnapshot()
+	for id, m := range all {
+		if !m.worksAt(locationID) || !m.performs(pkgKey) {
+			delete(all, id)
+		}
+	}
+	return all
+}
+
+// locationMarkup lists the locations as buttons whose data is prefix+id.
+func locationMarkup(prefix string) *tgbotapi.InlineKeyboardMarkup {
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	for _, l := range sortedLocations() {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(l.Name+" · "+l.Address, prefix+l.ID),
+		})
+	}
+	return markup
+}
+
+// sendVenue sends the centre as a map pin when its coordinates are known.
+func sendVenue(chatID int64, l Location) {
+	if !l.hasCoordinates() {
+		return
+	}
+	bot.Send(tgbotapi.NewVenue(chatID, l.Name, l.Address, l.Latitude, l.Longitude))
+}
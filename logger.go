@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Clients share health data with the bot, so names and phone numbers never
+// reach the logs in clear text: attributes with these keys are masked, and
+// anything that looks like a phone number is masked in every string value.
+var (
+	phoneKeys = map[string]bool{"phone": true, "client_phone": true, "contact": true}
+	nameKeys  = map[string]bool{"name": true, "client_name": true, "username": true}
+	phoneRe   = regexp.MustCompile(`\+?\d[\d\-\s()]{8,}\d`)
+)
+
+func initLogger() {
+	level := slog.LevelInfo
+	if cfg.Debug {
+		level = slog.LevelDebug
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if cfg.LogFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(&errorCapture{Handler: handler}))
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() != slog.KindString {
+		return a
+	}
+	s := a.Value.String()
+	switch {
+	case phoneKeys[a.Key]:
+		a.Value = slog.StringValue(maskPhone(s))
+	case nameKeys[a.Key]:
+		a.Value = slog.StringValue(maskName(s))
+	default:
+		a.Value = slog.StringValue(phoneRe.ReplaceAllStringFunc(s, maskPhoneLike))
+	}
+	return a
+}
+
+// maskPhone keeps only the last two digits: "+79267640131" -> "+*********31".
+func maskPhone(s string) string {
+	digits := 0
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	var b strings.Builder
+	seen := 0
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			seen++
+			if seen <= digits-2 {
+				r = '*'
+			}
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// maskPhoneLike masks a phoneRe match only when it has enough digits to be a
+// phone number, so dates like 2024-05-01 stay readable.
+func maskPhoneLike(s string) string {
+	digits := 0
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	if digits < 10 {
+		return s
+	}
+	return maskPhone(s)
+}
+
+// maskName keeps the first letter: "Мухаммад" -> "М***".
+func maskName(s string) string {
+	if s == "" {
+		return ""
+	}
+	r, _ := utf8.DecodeRuneInString(s)
+	return string(r) + "***"
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type loggerKey struct{}
+
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// logFrom returns the request-scoped logger (update_id, user_id, handler) or the default one.
+func logFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// LogValue lets slot values be logged directly without leaking client data.
+func (s Slot) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("id", s.ID),
+		slog.String("date", s.Date),
+		slog.String("time", s.Time),
+		slog.String("master", s.MasterName),
+		slog.String("status", s.Status),
+		slog.String("package", s.PackageName),
+		slog.String("client_name", maskName(s.ClientName)),
+		slog.String("client_phone", maskPhone(s.ClientPhone)),
+	)
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/supabase-community/postgrest-go"
+)
+
+// Loyalty works on Telegram clients: visits are their completed slots, and
+// points live in the loyalty_points ledger (1 point = 1 ₽). Points are earned
+// when staff mark a visit as completed, spent when a booking is confirmed and
+// returned if that booking is cancelled. Bookings made by staff count once
+// they are linked to the client's Telegram account.
+
+const loyaltyRulesKey = "loyalty_rules"
+
+// LoyaltyRules is stored as JSON in settings; zero values switch a part off.
+type LoyaltyRules struct {
+	// PointsPercent of the price paid is credited for a completed visit.
+	PointsPercent int `json:"points_percent"`
+	// Every EveryNth visit gets NthDiscount percent off.
+	EveryNth    int `json:"every_nth"`
+	NthDiscount int `json:"nth_discount"`
+	// MaxRedeemPercent caps the share of a price payable with points.
+	MaxRedeemPercent int `json:"max_redeem_percent"`
+	// ReferralPoints go to both clients on the invited client's first visit.
+	ReferralPoints int `json:"referral_points"`
+}
+
+func (r LoyaltyRules) enabled() bool {
+	return r.PointsPercent > 0 || r.nthEnabled() || r.ReferralPoints > 0
+}
+
+func (r LoyaltyRules) nthEnabled() bool {
+	return r.EveryNth > 1 && r.NthDiscount > 0
+}
+
+// nthVisit reports whether visit number n gets the every-Nth discount.
+func (r LoyaltyRules) nthVisit(n int) bool {
+	return r.nthEnabled() && n%r.EveryNth == 0
+}
+
+func (r LoyaltyRules) String() string {
+	if !r.enabled() {
+		return "Программа лояльности выключена"
+	}
+	var parts []string
+	if r.PointsPercent > 0 {
+		parts = append(parts, fmt.Sprintf("• %d%% от оплаченной суммы возвращается баллами (1 балл = 1 ₽)", r.PointsPercent))
+	}
+	if r.ReferralPoints > 0 {
+		parts = append(parts, fmt.Sprintf("• %d баллов вам и другу за его первый визит по вашей ссылке", r.ReferralPoints))
+	}
+	if r.PointsPercent > 0 || r.ReferralPoints > 0 {
+		parts = append(parts, fmt.Sprintf("• баллами можно оплатить до %d%% стоимости", r.redeemPercent()))
+	}
+	if r.nthEnabled() {
+		parts = append(parts, fmt.Sprintf("• каждый %d-й визит — скидка %d%%", r.EveryNth, r.NthDiscount))
+	}
+	return strings.Join(parts, "\n")
+}
+
+func (r LoyaltyRules) redeemPercent() int {
+	if r.MaxRedeemPercent <= 0 || r.MaxRedeemPercent > 100 {
+		return 100
+	}
+	return r.MaxRedeemPercent
+}
+
+var (
+	loyaltyMu    sync.RWMutex
+	loyaltyRules LoyaltyRules
+)
+
+func getLoyaltyRules() LoyaltyRules {
+	loyaltyMu.RLock()
+	defer loyaltyMu.RUnlock()
+	return loyaltyRules
+}
+
+func loadLoyaltyRules() {
+	data, _, err := supabaseClient.From("settings").Select("value", "", false).
+		Eq("key", loyaltyRulesKey).
+		Execute()
+	if err != nil {
+		slog.Error("failed to load loyalty rules", "err", err)
+		return
+	}
+	var rows []struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(data, &rows); err != nil || len(rows) == 0 {
+		return
+	}
+	var rules LoyaltyRules
+	if err := json.Unmarshal([]byte(rows[0].Value), &rules); err != nil {
+		slog.Error("failed to decode loyalty rules", "err", err)
+		return
+	}
+	loyaltyMu.Lock()
+	loyaltyRules = rules
+	loyaltyMu.Unlock()
+}
+
+func saveLoyaltyRules(actorID int64, rules LoyaltyRules) error {
+	value, _ := json.Marshal(rules)
+	row := map[string]interface{}{
+		"key":        loyaltyRulesKey,
+		"value":      string(value),
+		"updated_by": actorID,
+		"updated_at": dbTimestamp(time.Now()),
+	}
+	_, _, err := supabaseClient.From("settings").Upsert(row, "key", "", "").Execute()
+	if err != nil {
+		return err
+	}
+	loyaltyMu.Lock()
+	before := loyaltyRules
+	loyaltyRules = rules
+	loyaltyMu.Unlock()
+	writeAudit(actorID, auditSettingUpdate, "setting", loyaltyRulesKey, 0, before, rules)
+	return nil
+}
+
+// PointsEntry is one row of the loyalty_points ledger.
+type PointsEntry struct {
+	UserID    int64     `json:"user_id"`
+	SlotID    int       `json:"slot_id"`
+	Points    int       `json:"points"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const (
+	pointsEarned   = "visit"
+	pointsReversed = "visit_undone"
+	pointsSpent    = "booking"
+	pointsReturned = "booking_cancelled"
+	pointsReferral = "referral"
+	// pointsReferralReversed takes back a referral reward whose visit was undone
+	pointsReferralReversed = "referral_undone"
+)
+
+var pointsReasons = map[string]string{
+	pointsEarned:           "визит",
+	pointsReversed:         "визит отменён",
+	pointsSpent:            "оплата записи",
+	pointsReturned:         "запись отменена",
+	pointsReferral:         "приглашение друга",
+	pointsReferralReversed: "визит друга отменён",
+}
+
+func addPoints(userID int64, slotID, points int, reason string) error {
+	row := map[string]interface{}{
+		"user_id": userID,
+		"slot_id": slotID,
+		"points":  points,
+		"reason":  reason,
+	}
+	_, _, err := supabaseClient.From("loyalty_points").Insert(row, false, "", "", "").Execute()
+	if err != nil {
+		slog.Error("failed to save loyalty points", "user_id", userID, "slot_id", slotID, "points", points, "err", err)
+	}
+	return err
+}
+
+func pointsHistory(userID int64) ([]PointsEntry, error) {
+	data, _, err := supabaseClient.From("loyalty_points").Select("*", "", false).
+		Eq("user_id", strconv.FormatInt(userID, 10)).
+		Order("created_at", &postgrest.OrderOpts{Ascending: false}).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+	var entries []PointsEntry
+	err = json.Unmarshal(data, &entries)
+	return entries, err
+}
+
+func pointsBalance(userID int64) int {
+	entries, err := pointsHistory(userID)
+	if err != nil {
+		slog.Error("failed to load loyalty points", "user_id", userID, "err", err)
+		return 0
+	}
+	balance := 0
+	for _, e := range entries {
+		balance += e.Points
+	}
+	return balance
+}
+
+// slotPoints is the balance of the user's points with the reasons for the
+// visit in slotID.
+func slotPoints(userID int64, slotID int, reasons ...string) int {
+	entries, err := pointsHistory(userID)
+	if err != nil {
+		slog.Error("failed to load loyalty points", "user_id", userID, "err", err)
+		return 0
+	}
+	sum := 0
+	for _, e := range entries {
+		if e.SlotID == slotID && containsString(reasons, e.Reason) {
+			sum += e.Points
+		}
+	}
+	return sum
+}
+
+// visitCount returns the client's completed visits and the number the next
+// booking will have, counting bookings that are still upcoming. The
+// every-Nth discount is thus settled when booking, not when the visit is
+// completed; counting upcoming bookings keeps two of them from both getting it.
+func visitCount(userID int64) (completed, next int) {
+	data, _, err := supabaseClient.From("slots").Select("status", "", false).
+		Eq("user_id", strconv.FormatInt(userID, 10)).
+		In("status", []string{"booked", "completed"}).
+		Execute()
+	if err != nil {
+		slog.Error("failed to count visits", "user_id", userID, "err", err)
+		return 0, 1
+	}
+	var rows []struct {
+		Status string `json:"status"`
+	}
+	json.Unmarshal(data, &rows)
+	for _, r := range rows {
+		if r.Status == "completed" {
+			completed++
+		}
+	}
+	return completed, len(rows) + 1
+}
+
+// applyLoyalty takes the every-Nth discount off the quote and, if the client
+// chose to, pays part of the rest with points.
+func (q *Quote) applyLoyalty(userID int64, usePoints bool) {
+	rules := getLoyaltyRules()
+	if !rules.enabled() || userID == 0 {
+		return
+	}
+	if _, next := visitCount(userID); rules.nthVisit(next) {
+		q.VisitNumber = next
+		q.VisitDiscount = q.Price * rules.NthDiscount / 100
+		q.Price -= q.VisitDiscount
+	}
+	q.PointsBalance = pointsBalance(userID)
+	if usePoints && q.PointsBalance > 0 {
+		q.Points = min(q.PointsBalance, q.Price*rules.redeemPercent()/100)
+		q.Price -= q.Points
+	}
+}
+
+// returnPoints gives back the points of a cancelled booking.
+func returnPoints(slot Slot) {
+	userID, _ := strconv.ParseInt(slot.UserID, 10, 64)
+	if slot.PointsSpent > 0 && userID != 0 {
+		addPoints(userID, slot.ID, slot.PointsSpent, pointsReturned)
+	}
+}
+
+// visitStatusChanged credits points when a visit is marked completed and
+// takes them back if the mark is undone.
+func visitStatusChanged(slot Slot, status string) {
+	switch {
+	case status == "completed" && slot.Status != status:
+		rewardReferral(slot)
+	case slot.Status == "completed" && status != slot.Status:
+		revokeReferral(slot)
+	}
+	userID, _ := strconv.ParseInt(slot.UserID, 10, 64)
+	rules := getLoyaltyRules()
+	if userID == 0 || rules.PointsPercent <= 0 || slot.Status == status {
+		return
+	}
+	points := slotPrice(slot) * rules.PointsPercent / 100
+	if points <= 0 && status == "completed" {
+		return
+	}
+	switch {
+	case status == "completed":
+		if addPoints(userID, slot.ID, points, pointsEarned) == nil {
+			notifyClient(slot, fmt.Sprintf("🎁 Спасибо за визит! Начислено %d баллов, на счёте %d.", points, pointsBalance(userID)))
+		}
+	case slot.Status == "completed":
+		// Take back what was credited, even if the rules changed since
+		if earned := slotPoints(userID, slot.ID, pointsEarned, pointsReversed); earned > 0 {
+			addPoints(userID, slot.ID, -earned, pointsReversed)
+		}
+	}
+}
+
+func showClientProfile(msg *tgbotapi.Message) {
+	userID := msg.From.ID
+	rules := getLoyaltyRules()
+	completed, next := visitCount(userID)
+	balance := pointsBalance(userID)
+
+	text := fmt.Sprintf("👤 Профиль\n\n✅ Визитов: %d\n🎁 Баллов: %d", completed, balance)
+	if rules.nthEnabled() {
+		left := rules.EveryNth - (next-1)%rules.EveryNth
+		if left == 1 {
+			text += fmt.Sprintf("\n\n⭐ Следующая запись — со скидкой %d%%", rules.NthDiscount)
+		} else {
+			text += fmt.Sprintf("\n\n⭐ До скидки %d%% осталось записей: %d", rules.NthDiscount, left)
+		}
+	}
+	text += "\n\n" + rules.String()
+	text += referralProfileText(userID)
+
+	if entries, err := pointsHistory(userID); err == nil && len(entries) > 0 {
+		text += "\n\nПоследние операции:"
+		for i, e := range entries {
+			if i == 5 {
+				break
+			}
+			text += fmt.Sprintf("\n%s  %+d — %s", e.CreatedAt.In(tz).Format("02.01.2006"), e.Points, pointsReasons[e.Reason])
+		}
+	}
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, text))
+}
+
+const loyaltyUsage = "/loyalty — текущие правила\n" +
+	"/loyalty points 5 [max=50] — 5% от оплаты баллами, оплачивать баллами до 50% цены\n" +
+	"/loyalty every 5 50 — каждый 5-й визит со скидкой 50%\n" +
+	"/loyalty referral 300 — 300 баллов клиенту и приглашённому другу за первый визит друга\n" +
+	"/loyalty points 0, /loyalty every 0, /loyalty referral 0 — выключить часть\n" +
+	"/loyalty off — выключить всё"
+
+// loyaltyCommand handles "/loyalty" and its subcommands.
+func loyaltyCommand(msg *tgbotapi.Message) {
+	args := strings.Fields(msg.CommandArguments())
+	rules := getLoyaltyRules()
+	bad := func() {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Не понял правило\n\n"+loyaltyUsage))
+	}
+
+	switch {
+	case len(args) == 0:
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "🎁 "+rules.String()+"\n\n"+loyaltyUsage))
+		return
+	case args[0] == "off" && len(args) == 1:
+		rules = LoyaltyRules{}
+	case args[0] == "points" && (len(args) == 2 || len(args) == 3):
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 || n > 100 {
+			bad()
+			return
+		}
+		rules.PointsPercent = n
+		if len(args) == 3 {
+			limit, err := strconv.Atoi(strings.TrimPrefix(args[2], "max="))
+			if err != nil || limit < 1 || limit > 100 {
+				bad()
+				return
+			}
+			rules.MaxRedeemPercent = limit
+		}
+	case args[0] == "referral" && len(args) == 2:
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			bad()
+			return
+		}
+		rules.ReferralPoints = n
+	case args[0] == "every" && len(args) == 2 && args[1] == "0":
+		rules.EveryNth, rules.NthDiscount = 0, 0
+	case args[0] == "every" && len(args) == 3:
+		nth, err1 := strconv.Atoi(args[1])
+		discount, err2 := strconv.Atoi(strings.TrimSuffix(args[2], "%"))
+		if err1 != nil || err2 != nil || nth < 2 || discount < 1 || discount > 100 {
+			bad()
+			return
+		}
+		rules.EveryNth, rules.NthDiscount = nth, discount
+	default:
+		bad()
+		return
+	}
+
+	if err := saveLoyaltyRules(msg.From.ID, rules); err != nil {
+		slog.Error("failed to save loyalty rules", "err", err)
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Ошибка при сохранении"))
+		return
+	}
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "✅ "+rules.String()))
+}
@@ -1,140 +1,317 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
 type Package struct {
-	Key   string
-	Name  string
-	Price int
-	Desc  string
-}
-
-type Booking struct {
-	User   string
-	Master string
-	Date   string
-	Time   string
+	Key      string
+	Name     string
+	Price    int
+	Desc     string
+	Duration int `json:"duration_minutes"`
+	// Prepayment in rubles asked when booking in the bot; 0 means none, the
+	// full price means full prepayment.
+	Prepayment int `json:"prepayment"`
 }
 
 var cfg *Config
 var masters map[string]Master
+var locations map[string]Location
 var packages map[string]Package
 var contactMap map[string]string
 var masterNotifications = make(map[string]bool)
-var bookingsLog []Booking
-var bot *tgbotapi.BotAPI
 var tz *time.Location
+var allowedUpdates = []string{"message", "callback_query", "pre_checkout_query"}
 
 func main() {
-	log.Println("Starting bot...")
+	slog.Info("starting bot")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// workCtx outlives ctx by the drain deadline so in-flight updates can finish
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+	bindHTTPToContext(workCtx)
 
 	var err error
 	cfg, err = loadConfig()
 	if err != nil {
-		log.Fatal("Failed to load config:", err)
+		fatal("failed to load config", "err", err)
 	}
 
-	log.Println("Config loaded")
+	initLogger()
+	slog.Info("config loaded", "debug", cfg.Debug)
 
 	tz, err = time.LoadLocation(cfg.Timezone)
 	if err != nil {
+		slog.Warn("unknown TIMEZONE, using UTC", "timezone", cfg.Timezone, "err", err)
 		tz = time.UTC
 	}
 
 	token := cfg.Token
 	if token == "" {
-		log.Fatal("BOT_TOKEN not set")
+		fatal("BOT_TOKEN not set")
 	}
 
-	bot, err = tgbotapi.NewBotAPI(token)
+	api, err = tgbotapi.NewBotAPIWithAPIEndpoint(token, cfg.APIEndpoint)
 	if err != nil {
-		log.Fatal(err)
+		fatal("failed to connect to Telegram", "err", err)
 	}
+	bot = instrumentedMessenger{next: api}
 
-	// Delete webhook to ensure polling works
-	_, err = bot.Request(tgbotapi.DeleteWebhookConfig{})
-	if err != nil {
-		log.Printf("Delete webhook error: %v", err)
-	}
-
-	// Check webhook status
-	webhookInfo, err := bot.GetWebhookInfo()
-	if err == nil && webhookInfo.URL != "" {
-		log.Printf("Webhook still active: %s", webhookInfo.URL)
-	} else if err != nil {
-		log.Printf("Webhook info error: %v", err)
-	} else {
-		log.Println("No active webhook")
-	}
-
-	log.Printf("Authorized on account %s", bot.Self.UserName)
+	slog.Info("authorized", "account", api.Self.UserName)
 
 	initDB()
-	masters = loadMastersFromDB()
+	instrumentDBTransport(cfg.SupabaseURL)
+	setMasters(loadMastersFromDB())
+	setLocations(loadLocationsFromDB())
+	loadRolesFromDB()
+	loadHijriAdjustment()
+	loadLoyaltyRules()
+	if len(usersWith(permManageRoles)) == 0 {
+		slog.Warn("no owners configured; set ADMINS or grant the owner role in user_roles")
+	}
 	packages = loadPackagesFromDB()
 	loadAllSessions()
+	initPayments()
 
-	log.Printf("Loaded %d masters, %d packages", len(masters), len(packages))
+	slog.Info("catalog loaded", "masters", len(masters), "packages", len(packages), "locations", len(locations))
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 10
-	u.AllowedUpdates = []string{"message", "callback_query"}
+	httpMux.HandleFunc("/metrics", serveMetrics)
+	httpMux.HandleFunc("/healthz", serveHealthz)
+	httpMux.HandleFunc("/readyz", serveReadyz)
+	if cfg.ICSSecret != "" {
+		httpMux.HandleFunc("/ics/", serveMasterFeed)
+	}
+
+	var updates tgbotapi.UpdatesChannel
+	if cfg.WebhookURL != "" {
+		updates, err = webhookUpdates(ctx)
+		if err != nil {
+			fatal("failed to set webhook", "err", err)
+		}
+		slog.Info("bot started, receiving updates via webhook", "url", cfg.WebhookURL)
+	} else {
+		updates = pollingUpdates()
+		slog.Info("bot started, polling for updates")
+	}
+	srv := startHTTPServer()
+	if payments != nil {
+		startJob(ctx, "payment_holds", time.Minute, releaseExpiredHolds)
+	}
+	startJob(ctx, "feedback", 10*time.Minute, requestFeedback)
+	// Grants made through another instance reach this one within a minute
+	startJob(ctx, "roles", time.Minute, func(context.Context) { loadRolesFromDB() })
+
+	d := newDispatcher(workCtx, cfg.Workers)
+	held := receiveUpdates(ctx, updates, d)
+	shuttingDown.Store(true)
 
-	updates := bot.GetUpdatesChan(u)
+	slog.Info("shutting down, draining in-flight updates", "timeout", cfg.StopTimeout)
+	if cfg.WebhookURL == "" {
+		api.StopReceivingUpdates()
+	}
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), cfg.StopTimeout)
+	defer cancelDrain()
 
-	log.Println("Bot started, polling for updates")
+	if srv != nil {
+		if err := srv.Shutdown(drainCtx); err != nil {
+			slog.Error("HTTP server shutdown failed", "err", err)
+		}
+	}
+	// Updates already accepted from Telegram must not be lost, unless the
+	// queues stay full past the deadline
+	drain := func(update tgbotapi.Update) bool {
+		if d.dispatch(drainCtx, update) {
+			return true
+		}
+		slog.Warn("drain deadline exceeded, dropping update", "update_id", update.UpdateID)
+		return false
+	}
+	for pending := held == nil || drain(*held); pending; {
+		select {
+		case update, ok := <-updates:
+			pending = ok && drain(update)
+		default:
+			pending = false
+		}
+	}
+	if err := d.close(drainCtx); err != nil {
+		slog.Warn("drain deadline exceeded, aborting in-flight updates", "err", err)
+		cancelWork()
+	}
+	if err := waitJobs(drainCtx); err != nil {
+		slog.Warn("background jobs did not stop in time", "err", err)
+	}
+	slog.Info("bot stopped")
+}
 
-	for update := range updates {
-		log.Printf("Received update ID %d", update.UpdateID)
-		handleUpdate(update)
+// receiveUpdates hands updates to d until ctx ends. An update it could not
+// queue by then is returned so the drain can still handle it.
+func receiveUpdates(ctx context.Context, updates tgbotapi.UpdatesChannel, d *dispatcher) *tgbotapi.Update {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case update, ok := <-updates:
+			if !ok {
+				return nil
+			}
+			slog.Debug("received update", "update_id", update.UpdateID)
+			if !d.dispatch(ctx, update) {
+				return &update
+			}
+		}
 	}
 }
 
-func handleUpdate(update tgbotapi.Update) {
+func handleUpdate(ctx context.Context, update tgbotapi.Update) {
+	kind := updateType(update)
+	logger := slog.Default().With("update_id", update.UpdateID, "handler", kind)
+	if user := update.SentFrom(); user != nil {
+		logger = logger.With("user_id", user.ID)
+	}
+	ctx = withLogger(ctx, logger)
+
+	if ctx.Err() != nil {
+		logger.Warn("dropping update: shutting down")
+		return
+	}
+	start := time.Now()
+	defer func() {
+		metricUpdates.inc(kind)
+		metricHandlerDuration.observe(kind, time.Since(start))
+	}()
+
 	if update.Message != nil {
-		log.Printf("Handling message: %s from %s", update.Message.Text, update.Message.From.UserName)
-		handleMessage(update.Message)
+		logger.Debug("handling message", "text_len", len(update.Message.Text))
+		handleMessage(ctx, update.Message)
 	} else if update.CallbackQuery != nil {
-		log.Printf("Handling callback: %s", update.CallbackQuery.Data)
-		handleCallback(update.CallbackQuery)
+		logger.Debug("handling callback", "data", update.CallbackQuery.Data)
+		handleCallback(ctx, update.CallbackQuery)
+	} else if update.PreCheckoutQuery != nil {
+		logger.Debug("handling pre-checkout", "payload", update.PreCheckoutQuery.InvoicePayload)
+		handlePreCheckout(ctx, update.PreCheckoutQuery)
 	} else {
-		log.Printf("Unknown update type: %+v", update)
+		logger.Warn("unknown update type")
 	}
+	logger.Debug("update handled", "duration", time.Since(start))
 }
 
-func handleMessage(msg *tgbotapi.Message) {
+func handleMessage(ctx context.Context, msg *tgbotapi.Message) {
 	userID := msg.From.ID
-	session := userSessions[userID]
-	if session != nil {
+	if msg.SuccessfulPayment != nil {
+		handleSuccessfulPayment(ctx, msg)
+		return
+	}
+	if msg.Contact != nil {
+		handleContact(msg)
+		return
+	}
+	if len(msg.Photo) > 0 && strings.HasPrefix(msg.Caption, "/master") {
+		if can(userID, permManageMasters) {
+			masterCommand(msg)
+		}
+		return
+	}
+	if hasUserSession(userID) && !interruptsFeedback(msg) {
+		session, _ := loadUserSession(userID)
 		handleSessionMessage(msg, session)
 		return
 	}
 
 	text := strings.ToLower(msg.Text)
-	log.Printf("Message text (lowercase): '%s'", text)
 
 	switch {
-	case text == "/start":
-		log.Printf("Processing /start for user %d in chat %d", userID, msg.Chat.ID)
+	case text == "/start" || strings.HasPrefix(text, "/start "):
+		logFrom(ctx).Info("start command", "chat_id", msg.Chat.ID, "payload", msg.CommandArguments())
 		start(msg)
+	case strings.HasPrefix(text, "/export"):
+		if can(userID, permExport) {
+			exportCommand(msg)
+		}
+	case strings.HasPrefix(text, "/grant"):
+		if can(userID, permManageRoles) {
+			grantCommand(msg)
+		}
+	case strings.HasPrefix(text, "/revoke"):
+		if can(userID, permManageRoles) {
+			revokeCommand(msg)
+		}
+	case strings.HasPrefix(text, "/audit"):
+		if can(userID, permAudit) {
+			auditCommand(msg)
+		}
+	case strings.HasPrefix(text, "/hijri"):
+		if can(userID, permManageBlocks) {
+			hijriCommand(msg)
+		}
+	case strings.HasPrefix(text, "/holidays"):
+		if can(userID, permManageBlocks) {
+			holidaysCommand(msg)
+		}
+	case strings.HasPrefix(text, "/promo"):
+		if can(userID, permManagePromos) {
+			promoCommand(msg)
+		}
+	case strings.HasPrefix(text, "/master"):
+		if can(userID, permManageMasters) {
+			masterCommand(msg)
+		}
+	case strings.HasPrefix(text, "/referrals"):
+		if can(userID, permManagePromos) {
+			referralsCommand(msg)
+		}
+	case strings.HasPrefix(text, "/loyalty"):
+		if can(userID, permManagePromos) {
+			loyaltyCommand(msg)
+		}
+	case strings.HasPrefix(text, "/blocks"):
+		if can(userID, permManageBlocks) || masterIDOf(userID) != "" {
+			blocksCommand(msg)
+		}
+	case strings.HasPrefix(text, "/block"):
+		if can(userID, permManageBlocks) || masterIDOf(userID) != "" {
+			blockCommand(msg)
+		}
+	case strings.HasPrefix(text, "/unblock"):
+		if can(userID, permManageBlocks) || masterIDOf(userID) != "" {
+			unblockCommand(msg)
+		}
+	case text == "/roles":
+		if can(userID, permManageRoles) {
+			rolesCommand(msg)
+		}
 	case strings.Contains(text, "записаться"):
-		log.Println("Booking start triggered")
+		logFrom(ctx).Info("booking started")
 		bookStart(msg)
 	case strings.Contains(text, "админ панель"):
 		if isAdmin(userID) {
-			adminPanel(msg.Chat.ID)
+			adminPanel(msg.Chat.ID, userID)
+		}
+	case strings.Contains(text, "кабинет мастера"):
+		if masterID := masterIDOf(userID); masterID != "" {
+			showMasterProfile(msg.Chat.ID, masterID)
 		}
 	case strings.Contains(text, "другие возможности"):
 		otherOptions(msg)
 	case strings.Contains(text, "мои записи"):
 		showMyBookings(msg)
+	case strings.Contains(text, "профиль"):
+		showClientProfile(msg)
 	}
 }
 
@@ -143,15 +320,27 @@ func handleSessionMessage(msg *tgbotapi.Message, session *UserSession) {
 	text := msg.Text
 
 	switch session.Step {
+	case "dev_login":
+		checkDevPassword(msg)
+	case "manual_name", "manual_phone":
+		handleManualBookingMessage(msg, session)
+	case "holidays_import":
+		importHolidays(msg)
+	case "waiting_promo":
+		enterPromo(msg, session)
+	case stepFeedbackComment:
+		saveFeedbackComment(msg, session)
+	case stepHealthText:
+		enterHealthAnswer(msg)
 	case "master_login":
-		masterID := session.Data["master_id"].(string)
-		master := masters[masterID]
-		if text == master.Code {
+		masterID, _ := session.Data["master_id"].(string)
+		master, ok := getMaster(masterID)
+		if ok && text == master.Code {
 			showMasterProfile(msg.Chat.ID, masterID)
 		} else {
 			bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Неверный код"))
 		}
-		delete(userSessions, userID)
+		deleteUserSession(userID)
 	case "add_master_name":
 		session.Data["name"] = text
 		session.Step = "add_master_code"
@@ -162,6 +351,7 @@ func handleSessionMessage(msg *tgbotapi.Message, session *UserSession) {
 		msg := tgbotapi.NewMessage(msg.Chat.ID, "Введите код доступа:")
 		msg.ReplyMarkup = markup
 		bot.Send(msg)
+		saveUserSession(userID, session)
 	case "add_master_code":
 		session.Data["code"] = text
 		session.Step = "add_master_contact"
@@ -172,6 +362,7 @@ func handleSessionMessage(msg *tgbotapi.Message, session *UserSession) {
 		msg := tgbotapi.NewMessage(msg.Chat.ID, "Введите контакт (или пусто):")
 		msg.ReplyMarkup = markup
 		bot.Send(msg)
+		saveUserSession(userID, session)
 	case "add_master_contact":
 		session.Data["contact"] = text
 		session.Step = "add_master_gender"
@@ -184,6 +375,7 @@ func handleSessionMessage(msg *tgbotapi.Message, session *UserSession) {
 		msg := tgbotapi.NewMessage(msg.Chat.ID, "Выберите пол:")
 		msg.ReplyMarkup = markup
 		bot.Send(msg)
+		saveUserSession(userID, session)
 	case "waiting_name":
 		session.Data["client_name"] = text
 		session.Step = "waiting_phone"
@@ -198,38 +390,57 @@ func handleSessionMessage(msg *tgbotapi.Message, session *UserSession) {
 	case "waiting_phone":
 		session.Data["client_phone"] = text
 		session.Step = ""
+		if !multipleLocations() {
+			session.Data["location"] = sortedLocations()[0].ID
+			saveUserSession(userID, session)
+			showDatePageMessage(msg, 0)
+			return
+		}
 		saveUserSession(userID, session)
-		showDatePageMessage(msg, 0)
+		message := tgbotapi.NewMessage(msg.Chat.ID, "Выберите центр:")
+		message.ReplyMarkup = locationMarkup("location_")
+		bot.Send(message)
 	}
 }
 
 func start(msg *tgbotapi.Message) {
+	message := tgbotapi.NewMessage(msg.Chat.ID, "HGN · Доступ активирован\nРегистрация не требуется")
+	message.ReplyMarkup = mainMenuMarkup(msg.From.ID)
+	_, err := bot.Send(message)
+	if err != nil {
+		slog.Error("failed to send start message", "chat_id", msg.Chat.ID, "err", err)
+	}
+
+	// Deep links: t.me/<bot>?start=<payload>
+	if payload := msg.CommandArguments(); strings.HasPrefix(payload, referralPrefix) {
+		startReferral(msg, strings.TrimPrefix(payload, referralPrefix))
+	}
+}
+
+func mainMenuMarkup(userID int64) tgbotapi.ReplyKeyboardMarkup {
 	markup := tgbotapi.NewReplyKeyboard(
 		tgbotapi.NewKeyboardButtonRow(
 			tgbotapi.NewKeyboardButton("📍 Записаться на Хиджаму"),
 		),
 		tgbotapi.NewKeyboardButtonRow(
 			tgbotapi.NewKeyboardButton("📋 Мои записи"),
+			tgbotapi.NewKeyboardButton("👤 Профиль"),
 		),
 		tgbotapi.NewKeyboardButtonRow(
 			tgbotapi.NewKeyboardButton("Другие возможности"),
 		),
 	)
-	if isAdmin(msg.From.ID) {
+	if masterIDOf(userID) != "" {
 		markup.Keyboard = append(markup.Keyboard, tgbotapi.NewKeyboardButtonRow(
-			tgbotapi.NewKeyboardButton("🔐 Админ панель"),
+			tgbotapi.NewKeyboardButton("🩺 Кабинет мастера"),
 		))
 	}
-
-	message := tgbotapi.NewMessage(msg.Chat.ID, "HGN · Доступ активирован\nРегистрация не требуется")
-	message.ReplyMarkup = markup
-	log.Printf("Sending start message to chat %d", msg.Chat.ID)
-	_, err := bot.Send(message)
-	if err != nil {
-		log.Printf("Send error in start: %v", err)
-	} else {
-		log.Println("Start reply sent")
+	if isAdmin(userID) {
+		markup.Keyboard = append(markup.Keyboard, tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton("🔐 Админ панель"),
+		))
 	}
+	return markup
 }
 
 func bookStart(msg *tgbotapi.Message) {
@@ -240,10 +451,11 @@ func bookStart(msg *tgbotapi.Message) {
 	bot.Send(message)
 }
 
+var packageOrder = []string{"complex", "upper", "lower", "individual", "cosmetology"}
+
 func createServiceKeyboard() tgbotapi.InlineKeyboardMarkup {
 	var keyboard [][]tgbotapi.InlineKeyboardButton
-	order := []string{"complex", "upper", "lower", "individual", "cosmetology"}
-	for _, key := range order {
+	for _, key := range packageOrder {
 		if pkg, ok := packages[key]; ok {
 			keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
 				tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%s — %d ₽", pkg.Name, pkg.Price), "package_"+key),
@@ -253,10 +465,16 @@ func createServiceKeyboard() tgbotapi.InlineKeyboardMarkup {
 	return tgbotapi.NewInlineKeyboardMarkup(keyboard...)
 }
 
-func handleCallback(cb *tgbotapi.CallbackQuery) {
+func handleCallback(ctx context.Context, cb *tgbotapi.CallbackQuery) {
 	data := cb.Data
 	userID := cb.From.ID
 
+	if !authorizeCallback(userID, data) {
+		logFrom(ctx).Warn("callback denied", "data", data)
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Недостаточно прав", ShowAlert: true})
+		return
+	}
+
 	if strings.HasPrefix(data, "package_") {
 		key := strings.TrimPrefix(data, "package_")
 		if pkg, ok := packages[key]; ok {
@@ -319,17 +537,30 @@ func handleCallback(cb *tgbotapi.CallbackQuery) {
 		bot.Send(editMsg)
 		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
 	} else if data == "age_yes" {
-		markup := &tgbotapi.InlineKeyboardMarkup{}
-		markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
-			{tgbotapi.NewInlineKeyboardButtonData("← Назад", "back_to_gender")},
+		startQuestionnaire(cb)
+	} else if strings.HasPrefix(data, "health_") {
+		handleHealthCallback(cb, data)
+	} else if strings.HasPrefix(data, "location_") {
+		if _, ok := getLocation(strings.TrimPrefix(data, "location_")); !ok {
+			return
 		}
-		editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, "Прежде чем начать запись, укажите свое имя:")
-		editMsg.ReplyMarkup = markup
-		bot.Send(editMsg)
 		session := getSession(userID)
-		session.Step = "waiting_name"
+		session.Data["location"] = strings.TrimPrefix(data, "location_")
 		setSession(userID, session)
+		showDatePage(cb, 0)
+	} else if data == "back_to_location" {
+		editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, "Выберите центр:")
+		editMsg.ReplyMarkup = locationMarkup("location_")
+		bot.Send(editMsg)
 		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+	} else if data == "sunnah_only_on" || data == "sunnah_only_off" {
+		session := getSession(userID)
+		session.Data["sunnah_only"] = ""
+		if data == "sunnah_only_on" {
+			session.Data["sunnah_only"] = "1"
+		}
+		setSession(userID, session)
+		showDatePage(cb, 0)
 	} else if strings.HasPrefix(data, "date_page_") {
 		pageStr := strings.TrimPrefix(data, "date_page_")
 		page := 0
@@ -383,13 +614,6 @@ func handleCallback(cb *tgbotapi.CallbackQuery) {
 	} else if data == "back_to_date" {
 		// Back to date selection
 		showDatePage(cb, 0)
-	} else if strings.HasPrefix(data, "master_") {
-		master := strings.TrimPrefix(data, "master_")
-		session := getSession(userID)
-		session.Data["master"] = master
-		setSession(userID, session)
-		// Show confirmation
-		showBookingConfirmation(cb)
 	} else if data == "back_to_time" {
 		session := getSession(userID)
 		date, ok := session.Data["date"].(string)
@@ -403,10 +627,50 @@ func handleCallback(cb *tgbotapi.CallbackQuery) {
 		finalizeBooking(cb)
 	} else if data == "back_to_master" {
 		showMasterSelection(cb)
+	} else if data == "promo_enter" {
+		startPromoEntry(cb)
+	} else if data == "points_on" || data == "points_off" {
+		session := getSession(userID)
+		session.Data["use_points"] = ""
+		if data == "points_on" {
+			session.Data["use_points"] = "1"
+		}
+		setSession(userID, session)
+		showBookingConfirmation(cb)
+	} else if data == "promo_back" || data == "promo_clear" {
+		session := getSession(userID)
+		session.Step = ""
+		if data == "promo_clear" {
+			delete(session.Data, "promo")
+		}
+		setSession(userID, session)
+		showBookingConfirmation(cb)
 	} else if data == "admin_masters_btn" {
 		showAdminMasters(cb)
+	} else if data == "admin_export" {
+		showExportMenu(cb)
+	} else if strings.HasPrefix(data, "export_") {
+		exportPreset(cb, data)
 	} else if data == "admin_developer" {
 		showDeveloperPanel(cb)
+	} else if data == "admin_roles" {
+		showRoles(cb)
+	} else if data == "admin_audit" {
+		showAuditLog(cb)
+	} else if data == "admin_blocks" {
+		showAdminBlocks(cb)
+	} else if data == "admin_holidays" {
+		showAdminHolidays(cb)
+	} else if data == "admin_promos" {
+		showAdminPromos(cb)
+	} else if data == "admin_referrals" {
+		showAdminReferrals(cb)
+	} else if strings.HasPrefix(data, "admin_block_del_") {
+		adminDeleteBlock(cb, data)
+	} else if strings.HasPrefix(data, "admin_book_") {
+		handleManualBookingCallback(cb, data)
+	} else if strings.HasPrefix(data, "admin_day_") || strings.HasPrefix(data, "admin_slot_") || strings.HasPrefix(data, "admin_move_") {
+		handleScheduleCallback(cb, data)
 	} else if data == "admin_back" {
 		showAdminMain(cb)
 	} else if strings.HasPrefix(data, "master_profile_") {
@@ -422,25 +686,92 @@ func handleCallback(cb *tgbotapi.CallbackQuery) {
 		showMasterProfit(cb, data)
 	} else if strings.HasPrefix(data, "master_notify_") {
 		toggleMasterNotify(cb, data)
+	} else if strings.HasPrefix(data, "master_calendar_") {
+		showMasterCalendar(cb, data)
+	} else if strings.HasPrefix(data, "master_blocks_") {
+		showMasterBlocks(cb, data)
 	} else if strings.HasPrefix(data, "master_back_") {
 		backToMasterProfile(cb, data)
 	} else if strings.HasPrefix(data, "cancel_booking_") {
 		cancelUserBooking(cb, data)
+	} else if strings.HasPrefix(data, "pay_") {
+		resendInvoice(cb, strings.TrimPrefix(data, "pay_"))
+	} else if strings.HasPrefix(data, "master_info_") {
+		showMasterInfo(cb, data)
+	} else if strings.HasPrefix(data, "rate_") {
+		handleRating(cb, data)
+	} else if data == "feedback_skip" {
+		skipFeedbackComment(cb)
+	} else if strings.HasPrefix(data, "master_") {
+		// Must stay last: master_profile_, master_bookings_ etc. share the prefix
+		master := strings.TrimPrefix(data, "master_")
+		session := getSession(userID)
+		session.Data["master"] = master
+		setSession(userID, session)
+		// Show confirmation
+		showBookingConfirmation(cb)
 	}
 }
 
-func adminPanel(chatID int64) {
-	markup := &tgbotapi.InlineKeyboardMarkup{}
-	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
-		{tgbotapi.NewInlineKeyboardButtonData("👨⚕️ Мастера", "admin_masters_btn")},
-		{tgbotapi.NewInlineKeyboardButtonData("👨💻 Разработчик", "admin_developer")},
-	}
-
+func adminPanel(chatID, userID int64) {
 	message := tgbotapi.NewMessage(chatID, "Привет мастер!\nЭто админ панель")
-	message.ReplyMarkup = markup
+	message.ReplyMarkup = adminMenuMarkup(userID)
 	bot.Send(message)
 }
 
+// adminMenuMarkup shows only the sections the user's roles allow.
+func adminMenuMarkup(userID int64) *tgbotapi.InlineKeyboardMarkup {
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	if can(userID, permManageBooking) {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("🗓 Расписание", "admin_day_"+time.Now().In(tz).Format("2006-01-02")),
+		})
+	}
+	if can(userID, permBookClients) {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("➕ Записать клиента", "admin_book_start"),
+		})
+	}
+	if can(userID, permManageMasters) {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("👨⚕️ Мастера", "admin_masters_btn"),
+		})
+	}
+	if can(userID, permManageBlocks) {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("⛔ Блокировки", "admin_blocks"),
+		}, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("📆 Праздники", "admin_holidays"),
+		})
+	}
+	if can(userID, permManagePromos) {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("🎟 Промокоды", "admin_promos"),
+		}, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("🤝 Рефералы", "admin_referrals"),
+		})
+	}
+	if can(userID, permExport) {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("📤 Экспорт записей", "admin_export"),
+		})
+	}
+	if can(userID, permAudit) {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("📜 Журнал", "admin_audit"),
+		})
+	}
+	if can(userID, permManageRoles) {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("👥 Роли", "admin_roles"),
+		})
+	}
+	markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("👨💻 Разработчик", "admin_developer"),
+	})
+	return markup
+}
+
 func otherOptions(msg *tgbotapi.Message) {
 	markup := &tgbotapi.InlineKeyboardMarkup{}
 	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
@@ -454,15 +785,6 @@ func otherOptions(msg *tgbotapi.Message) {
 	bot.Send(message)
 }
 
-func isAdmin(userID int64) bool {
-	for _, admin := range cfg.Admins {
-		if admin == userID {
-			return true
-		}
-	}
-	return false
-}
-
 func getSession(userID int64) UserSession {
 	session, err := loadUserSession(userID)
 	if err != nil {
@@ -484,7 +806,7 @@ func clearSession(userID int64) {
 
 func showAdminMasters(cb *tgbotapi.CallbackQuery) {
 	markup := &tgbotapi.InlineKeyboardMarkup{}
-	for masterID, master := range masters {
+	for masterID, master := range mastersSnapshot() {
 		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
 			tgbotapi.NewInlineKeyboardButtonData(master.Name, "master_profile_"+masterID),
 		})
@@ -500,38 +822,15 @@ func showAdminMasters(cb *tgbotapi.CallbackQuery) {
 	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
 }
 
-func showDeveloperPanel(cb *tgbotapi.CallbackQuery) {
-	// Show booking logs and status
-	logs := "📋 Последние записи:\n"
-	// Simplified, assume bookingsLog has entries
-	for _, b := range bookingsLog {
-		logs += fmt.Sprintf("👤 %s\n👨⚕️ %s\n📅 %s %s\n", b.User, b.Master, b.Date, b.Time)
-	}
-	if len(bookingsLog) == 0 {
-		logs += "Нет записей"
-	}
-	status := "\n🔌 Статус: ✅ База данных, ✅ Telegram API"
-
-	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, logs+status)
-	bot.Send(editMsg)
-	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
-}
-
 func showAdminMain(cb *tgbotapi.CallbackQuery) {
-	markup := &tgbotapi.InlineKeyboardMarkup{}
-	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
-		{tgbotapi.NewInlineKeyboardButtonData("👨⚕️ Мастера", "admin_masters_btn")},
-		{tgbotapi.NewInlineKeyboardButtonData("👨💻 Разработчик", "admin_developer")},
-	}
-
 	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, "Привет мастер!\nЭто админ панель")
-	editMsg.ReplyMarkup = markup
+	editMsg.ReplyMarkup = adminMenuMarkup(cb.From.ID)
 	bot.Send(editMsg)
 	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
 }
 
 func showMasterProfileLogin(cb *tgbotapi.CallbackQuery, masterID string) {
-	userSessions[cb.From.ID] = &UserSession{Step: "master_login", Data: map[string]interface{}{"master_id": masterID}}
+	saveUserSession(cb.From.ID, &UserSession{Step: "master_login", Data: map[string]interface{}{"master_id": masterID}})
 	markup := &tgbotapi.InlineKeyboardMarkup{}
 	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
 		{tgbotapi.NewInlineKeyboardButtonData("Отмена", "admin_masters_btn")},
@@ -544,7 +843,7 @@ func showMasterProfileLogin(cb *tgbotapi.CallbackQuery, masterID string) {
 }
 
 func startAddMaster(cb *tgbotapi.CallbackQuery) {
-	userSessions[cb.From.ID] = &UserSession{Step: "add_master_name"}
+	saveUserSession(cb.From.ID, &UserSession{Step: "add_master_name"})
 	markup := &tgbotapi.InlineKeyboardMarkup{}
 	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
 		{tgbotapi.NewInlineKeyboardButtonData("Отмена", "admin_masters_btn")},
@@ -558,8 +857,8 @@ func startAddMaster(cb *tgbotapi.CallbackQuery) {
 
 func processMasterGender(cb *tgbotapi.CallbackQuery, data string) {
 	gender := strings.TrimPrefix(data, "gender_master_")
-	session := userSessions[cb.From.ID]
-	if session == nil || session.Step != "add_master_gender" {
+	session, _ := loadUserSession(cb.From.ID)
+	if session.Step != "add_master_gender" {
 		return
 	}
 	session.Data["gender"] = gender
@@ -568,47 +867,60 @@ func processMasterGender(cb *tgbotapi.CallbackQuery, data string) {
 	code := session.Data["code"].(string)
 	contact := session.Data["contact"].(string)
 	masterID := strings.ToLower(strings.ReplaceAll(name, " ", "_"))
-	masters[masterID] = Master{ID: masterID, Name: name, Code: code, Contact: contact, Gender: gender}
+	master := Master{ID: masterID, Name: name, Code: code, Contact: contact, Gender: gender}
+	setMaster(master)
+	// The access code stays out of the log
+	master.Code = ""
+	writeAudit(cb.From.ID, auditMasterCreate, "master", masterID, 0, nil, master)
 	// Save to DB (simplified, need implement saveMasters)
 
 	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, fmt.Sprintf("Мастер '%s' добавлен!", name))
 	bot.Send(editMsg)
-	delete(userSessions, cb.From.ID)
+	deleteUserSession(cb.From.ID)
 	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
 }
 
-func showMasterBookings(cb *tgbotapi.CallbackQuery, data string) {
-	masterID := strings.TrimPrefix(data, "master_bookings_")
+func showMasterProfit(cb *tgbotapi.CallbackQuery, data string) {
+	masterID := strings.TrimPrefix(data, "master_profit_")
 	markup := &tgbotapi.InlineKeyboardMarkup{}
 	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
 		{tgbotapi.NewInlineKeyboardButtonData("← Назад", "master_back_"+masterID)},
 	}
 
-	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, "📋 Записи: (пока пусто)")
+	now := time.Now().In(tz)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, tz).Format("2006-01-02")
+	month := masterRevenue(masterID, monthStart)
+	total := masterRevenue(masterID, "")
+	text := fmt.Sprintf("💰 Прибыль\n\nЗа этот месяц: %d ₽ (%d визитов)\nВсего: %d ₽ (%d визитов)", month.Revenue, month.Visits, total.Revenue, total.Visits)
+	if total.Discounts > 0 {
+		text += fmt.Sprintf("\n\nСкидки и баллы: %d ₽", total.Discounts)
+	}
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, text)
 	editMsg.ReplyMarkup = markup
 	bot.Send(editMsg)
 	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
 }
 
-func showMasterProfit(cb *tgbotapi.CallbackQuery, data string) {
-	masterID := strings.TrimPrefix(data, "master_profit_")
-	markup := &tgbotapi.InlineKeyboardMarkup{}
-	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
-		{tgbotapi.NewInlineKeyboardButtonData("← Назад", "master_back_"+masterID)},
+// masterRevenue sums the master's completed visits since from (all time if
+// empty) at the prices clients actually paid.
+func masterRevenue(masterID, from string) Revenue {
+	master, _ := getMaster(masterID)
+	if master.Name == "" {
+		return Revenue{}
 	}
-
-	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, "💰 Прибыль: 0 ₽")
-	editMsg.ReplyMarkup = markup
-	bot.Send(editMsg)
-	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+	slots, err := getSlots(SlotFilter{From: from, MasterName: master.Name, Status: "completed"})
+	if err != nil {
+		slog.Error("failed to load master revenue", "master", masterID, "err", err)
+	}
+	return revenueOf(slots)
 }
 
 func toggleMasterNotify(cb *tgbotapi.CallbackQuery, data string) {
 	masterID := strings.TrimPrefix(data, "master_notify_")
-	current := masterNotifications[masterID]
-	masterNotifications[masterID] = !current
+	enabled := toggleNotifications(masterID)
+	writeAudit(cb.From.ID, auditMasterNotifications, "master", masterID, 0, map[string]bool{"notifications": !enabled}, map[string]bool{"notifications": enabled})
 	status := "❌ Отключены"
-	if !current {
+	if enabled {
 		status = "✅ Включены"
 	}
 	markup := &tgbotapi.InlineKeyboardMarkup{}
@@ -623,16 +935,23 @@ func toggleMasterNotify(cb *tgbotapi.CallbackQuery, data string) {
 }
 
 func showMasterProfile(chatID int64, masterID string) {
-	master := masters[masterID]
+	master, _ := getMaster(masterID)
 	markup := &tgbotapi.InlineKeyboardMarkup{}
 	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
 		{tgbotapi.NewInlineKeyboardButtonData("📋 Мои записи", "master_bookings_"+masterID)},
 		{tgbotapi.NewInlineKeyboardButtonData("💰 Прибыль", "master_profit_"+masterID)},
 		{tgbotapi.NewInlineKeyboardButtonData("🔔 Уведомления", "master_notify_"+masterID)},
-		{tgbotapi.NewInlineKeyboardButtonData("← Назад", "admin_back")},
+		{tgbotapi.NewInlineKeyboardButtonData("📅 Календарь", "master_calendar_"+masterID)},
+		{tgbotapi.NewInlineKeyboardButtonData("⛔ Блокировки", "master_blocks_"+masterID)},
+	}
+	if isAdmin(chatID) {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("← Назад", "admin_back"),
+		})
 	}
 
-	text := fmt.Sprintf("👨⚕️ %s\n📞 %s\n\nВыполненно: 0\nПрибыль: 0 ₽", master.Name, master.Contact)
+	r := masterRevenue(masterID, "")
+	text := fmt.Sprintf("👨⚕️ %s\n📞 %s\n\nВыполненно: %d\nПрибыль: %d ₽", master.Name, master.Contact, r.Visits, r.Revenue)
 	msg := tgbotapi.NewMessage(chatID, text)
 	msg.ReplyMarkup = markup
 	bot.Send(msg)
@@ -645,60 +964,64 @@ func backToMasterProfile(cb *tgbotapi.CallbackQuery, data string) {
 }
 
 func showDatePage(cb *tgbotapi.CallbackQuery, page int) {
-	today := time.Now().In(tz)
-	var dates []time.Time
-	for i := 0; i < 30; i++ {
-		dates = append(dates, today.AddDate(0, 0, i))
-	}
-
-	datesPerPage := 5
-	start := page * datesPerPage
-	end := start + datesPerPage
-	if end > len(dates) {
-		end = len(dates)
-	}
-	pageDates := dates[start:end]
-
-	markup := &tgbotapi.InlineKeyboardMarkup{}
-	for _, date := range pageDates {
-		dateStr := date.Format("2006-01-02")
-		weekday := []string{"Вс", "Пн", "Вт", "Ср", "Чт", "Пт", "Сб"}[int(date.Weekday())]
-		label := fmt.Sprintf("%s (%s)", date.Format("02.01"), weekday)
-		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
-			tgbotapi.NewInlineKeyboardButtonData(label, "date_"+dateStr),
-		})
+	text, markup := clientDatePage(cb.From.ID, page)
+	back := "back_to_gender"
+	if multipleLocations() {
+		back = "back_to_location"
 	}
-
-	var navButtons []tgbotapi.InlineKeyboardButton
-	if page > 0 {
-		navButtons = append(navButtons, tgbotapi.NewInlineKeyboardButtonData("← Назад", fmt.Sprintf("date_page_%d", page-1)))
-	}
-	if end < len(dates) {
-		navButtons = append(navButtons, tgbotapi.NewInlineKeyboardButtonData("Далее →", fmt.Sprintf("date_page_%d", page+1)))
-	}
-	if len(navButtons) > 0 {
-		markup.InlineKeyboard = append(markup.InlineKeyboard, navButtons)
-	}
-
 	markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
-		tgbotapi.NewInlineKeyboardButtonData("← Назад", "back_to_gender"),
+		tgbotapi.NewInlineKeyboardButtonData("← Назад", back),
 	})
 
-	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, "Выберите дату:")
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, text)
 	editMsg.ReplyMarkup = markup
 	bot.Send(editMsg)
 	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
 }
 
 func showDatePageMessage(msg *tgbotapi.Message, page int) {
-	today := time.Now().In(tz)
+	text, markup := clientDatePage(msg.From.ID, page)
+	message := tgbotapi.NewMessage(msg.Chat.ID, text)
+	message.ReplyMarkup = markup
+	bot.Send(message)
+}
+
+// clientDatePage is the client's date picker with the toggle between all days and the Sunnah days.
+func clientDatePage(userID int64, page int) (string, *tgbotapi.InlineKeyboardMarkup) {
+	session := getSession(userID)
+	sunnahOnly := sessionString(session, "sunnah_only") == "1"
+	markup := datePageMarkup(locationByID(sessionString(session, "location")), sessionString(session, "package"), page, "date_", "date_page_", sunnahOnly)
+
+	text := "Выберите дату:\n⭐ — 17, 19 и 21 число по хиджре, рекомендованные дни для хиджамы"
+	toggle := tgbotapi.NewInlineKeyboardButtonData("⭐ Только дни сунны", "sunnah_only_on")
+	if sunnahOnly {
+		if len(markup.InlineKeyboard) == 0 {
+			text = "В ближайшие 30 дней нет свободных дней сунны (17, 19 и 21 число по хиджре)"
+		} else {
+			text = "Выберите дату — 17, 19 или 21 число по хиджре:"
+		}
+		toggle = tgbotapi.NewInlineKeyboardButtonData("📅 Все дни", "sunnah_only_off")
+	}
+	markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{toggle})
+	return text, markup
+}
+
+// datePageMarkup lists the open days of the booking window at loc, five per page, labelled with
+// the Hijri date. dateData and pageData prefix the callback data so the client and admin flows can
+// share it; sunnahOnly keeps only the recommended days.
+func datePageMarkup(loc Location, pkgKey string, page int, dateData, pageData string, sunnahOnly bool) *tgbotapi.InlineKeyboardMarkup {
 	var dates []time.Time
-	for i := 0; i < 30; i++ {
-		dates = append(dates, today.AddDate(0, 0, i))
+	for _, date := range bookingDates(loc, pkgKey) {
+		if !sunnahOnly || toHijri(date).sunnah() {
+			dates = append(dates, date)
+		}
 	}
 
 	datesPerPage := 5
 	start := page * datesPerPage
+	if start < 0 || start >= len(dates) {
+		start = 0
+	}
 	end := start + datesPerPage
 	if end > len(dates) {
 		end = len(dates)
@@ -709,26 +1032,27 @@ func showDatePageMessage(msg *tgbotapi.Message, page int) {
 	for _, date := range pageDates {
 		dateStr := date.Format("2006-01-02")
 		weekday := []string{"Вс", "Пн", "Вт", "Ср", "Чт", "Пт", "Сб"}[int(date.Weekday())]
-		label := fmt.Sprintf("%s (%s)", date.Format("02.01"), weekday)
+		hijri := toHijri(date)
+		label := fmt.Sprintf("%s (%s) · %d %s", date.Format("02.01"), weekday, hijri.Day, hijriMonths[hijri.Month-1])
+		if hijri.sunnah() {
+			label = "⭐ " + label
+		}
 		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
-			tgbotapi.NewInlineKeyboardButtonData(label, "date_"+dateStr),
+			tgbotapi.NewInlineKeyboardButtonData(label, dateData+dateStr),
 		})
 	}
 
 	var navButtons []tgbotapi.InlineKeyboardButton
 	if page > 0 {
-		navButtons = append(navButtons, tgbotapi.NewInlineKeyboardButtonData("← Назад", fmt.Sprintf("date_page_%d", page-1)))
+		navButtons = append(navButtons, tgbotapi.NewInlineKeyboardButtonData("← Назад", fmt.Sprintf("%s%d", pageData, page-1)))
 	}
 	if end < len(dates) {
-		navButtons = append(navButtons, tgbotapi.NewInlineKeyboardButtonData("Далее →", fmt.Sprintf("date_page_%d", page+1)))
+		navButtons = append(navButtons, tgbotapi.NewInlineKeyboardButtonData("Далее →", fmt.Sprintf("%s%d", pageData, page+1)))
 	}
 	if len(navButtons) > 0 {
 		markup.InlineKeyboard = append(markup.InlineKeyboard, navButtons)
 	}
-
-	message := tgbotapi.NewMessage(msg.Chat.ID, "Выберите дату:")
-	message.ReplyMarkup = markup
-	bot.Send(message)
+	return markup
 }
 
 func showMasterSelection(cb *tgbotapi.CallbackQuery) {
@@ -747,25 +1071,24 @@ func showMasterSelection(cb *tgbotapi.CallbackQuery) {
 		return
 	}
 
-	log.Printf("Total masters: %d", len(masters))
-	bookedMasters := getBookedMasters(date, time)
-	log.Printf("Booked masters: %v", bookedMasters)
-
-	var availableMasters []string
-	for _, master := range masters {
-		log.Printf("Checking master: %s, booked: %v", master.Name, bookedMasters[master.Name])
-		if !bookedMasters[master.Name] {
-			availableMasters = append(availableMasters, master.Name)
-		}
-	}
-
-	log.Printf("Available masters: %d", len(availableMasters))
-
 	markup := &tgbotapi.InlineKeyboardMarkup{}
-	for _, master := range availableMasters {
-		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
-			tgbotapi.NewInlineKeyboardButtonData(master, "master_"+master),
-		})
+	labels := masterLabels()
+	profiles := make(map[string]Master)
+	for _, m := range mastersSnapshot() {
+		profiles[m.Name] = m
+	}
+	for _, master := range availableMasters(locationByID(sessionString(session, "location")), sessionString(session, "package"), date, time) {
+		label := master
+		if l, ok := labels[master]; ok {
+			label = l
+		}
+		row := []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(label, "master_"+master),
+		}
+		if m := profiles[master]; m.hasProfile() {
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData("ℹ️", "master_info_"+m.ID))
+		}
+		markup.InlineKeyboard = append(markup.InlineKeyboard, row)
 	}
 	markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
 		tgbotapi.NewInlineKeyboardButtonData("← Назад", "back_to_time"),
@@ -778,34 +1101,61 @@ func showMasterSelection(cb *tgbotapi.CallbackQuery) {
 }
 
 func showBookingConfirmation(cb *tgbotapi.CallbackQuery) {
-	userID := cb.From.ID
-	session := getSession(userID)
-	date, _ := session.Data["date"].(string)
-	time, _ := session.Data["time"].(string)
-	master, _ := session.Data["master"].(string)
-	pkgKey, ok := session.Data["package"].(string)
-	if !ok || pkgKey == "" {
+	if pkgKey := sessionString(getSession(cb.From.ID), "package"); pkgKey == "" {
 		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Ошибка: процедура не выбрана", ShowAlert: true})
 		return
 	}
+	text, markup := bookingConfirmation(cb.From.ID)
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, text)
+	editMsg.ReplyMarkup = markup
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
+
+// bookingConfirmation builds the confirmation screen for the booking in the
+// client's session, priced with their promo code.
+func bookingConfirmation(userID int64) (string, *tgbotapi.InlineKeyboardMarkup) {
+	session := getSession(userID)
+	date := sessionString(session, "date")
+	time := sessionString(session, "time")
+	master := sessionString(session, "master")
+	pkgKey := sessionString(session, "package")
 	pkg := packages[pkgKey]
+	loc := locationByID(sessionString(session, "location"))
+	quote, reason := bookingQuote(userID, session, pkgKey, loc)
 
-	text := fmt.Sprintf("Подтвердите запись:\n\n📅 %s\n🕐 %s\n👨⚕️ %s\n💼 %s\n💰 %d ₽\n\nЦентр: HGN Москва\nАдрес: Мичуринский проспект, 19к1", date, time, master, pkg.Name, pkg.Price)
+	text := fmt.Sprintf("Подтвердите запись:\n\n📅 %s\n🕐 %s\n👨⚕️ %s\n💼 %s\n%s\n\n%s", date, time, master, pkg.Name, quote, loc)
+	if amount := prepaymentFor(pkg, quote.Price); amount > 0 {
+		text += fmt.Sprintf("\n\n💳 Предоплата %d ₽ онлайн, время держится %d мин.", amount, int(cfg.PaymentHold.Minutes()))
+	}
+	if reason != "" {
+		text += "\n\n❌ Промокод снят: " + reason
+	}
 
+	promoButton := tgbotapi.NewInlineKeyboardButtonData("🎟 Ввести промокод", "promo_enter")
+	if quote.PromoCode != "" {
+		promoButton = tgbotapi.NewInlineKeyboardButtonData("✖️ Убрать промокод", "promo_clear")
+	}
 	markup := &tgbotapi.InlineKeyboardMarkup{}
 	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
 		{
 			tgbotapi.NewInlineKeyboardButtonData("✅ Подтвердить", "confirm_booking"),
 		},
-		{
-			tgbotapi.NewInlineKeyboardButtonData("← Назад", "back_to_master"),
-		},
+		{promoButton},
 	}
-
-	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, text)
-	editMsg.ReplyMarkup = markup
-	bot.Send(editMsg)
-	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+	if quote.Points > 0 {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("✖️ Не списывать баллы", "points_off"),
+		})
+	} else if quote.PointsBalance > 0 {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("🎁 Списать баллы (%d)", quote.PointsBalance), "points_on"),
+		})
+	}
+	markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("← Назад", "back_to_master"),
+	})
+	return text, markup
 }
 
 func finalizeBooking(cb *tgbotapi.CallbackQuery) {
@@ -819,33 +1169,133 @@ func finalizeBooking(cb *tgbotapi.CallbackQuery) {
 	clientPhone, _ := session.Data["client_phone"].(string)
 	pkgKey := session.Data["package"].(string)
 	pkg := packages[pkgKey]
+	loc := locationByID(sessionString(session, "location"))
 
-	err := bookSlotWithPackage(date, time, gender, master, userID, cb.From.UserName, clientName, clientPhone, pkg.Name)
+	if slotStarted(Slot{Date: date, Time: time, LocationID: loc.ID}) {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Это время уже прошло, выберите другое", ShowAlert: true})
+		return
+	}
+	if ok, err := questionnaireComplete(session); err != nil || !ok {
+		text := "Сначала заполните анкету о здоровье — начните запись заново"
+		if err != nil {
+			slog.Error("failed to check health questionnaire", "user_id", userID, "err", err)
+			text = "Не удалось проверить анкету о здоровье, попробуйте позже"
+		}
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: text, ShowAlert: true})
+		return
+	}
+	if !masterAvailable(loc, pkgKey, date, time, master) {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Это время уже занято, выберите другое", ShowAlert: true})
+		showMasterSelection(cb)
+		return
+	}
+	quote, reason := bookingQuote(userID, session, pkgKey, loc)
+	if reason != "" {
+		// The code ran out since it was entered; show the new price first
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Промокод больше не действует: " + reason, ShowAlert: true})
+		showBookingConfirmation(cb)
+		return
+	}
+
+	slot, err := bookSlotWithPackage(date, time, gender, master, userID, cb.From.UserName, clientName, clientPhone, pkg.Name, loc.ID, quote)
+	if errors.Is(err, errSlotTaken) {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Это время уже занято, выберите другое", ShowAlert: true})
+		showMasterSelection(cb)
+		return
+	}
 	if err != nil {
 		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Ошибка при бронировании", ShowAlert: true})
 		return
 	}
+	if reason := promoOverLimit(quote.PromoCode, slot.ID, userID, clientPhone); reason != "" {
+		if err := cancelBooking(slot.ID); err != nil {
+			slog.Error("failed to roll back booking", "slot_id", slot.ID, "err", err)
+		}
+		delete(session.Data, "promo")
+		setSession(userID, session)
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Промокод больше не действует: " + reason, ShowAlert: true})
+		showBookingConfirmation(cb)
+		return
+	}
+	if quote.Points > 0 {
+		// The price already counts the points; without them the booking can't stand
+		if err := addPoints(userID, slot.ID, -quote.Points, pointsSpent); err != nil {
+			if err := cancelBooking(slot.ID); err != nil {
+				slog.Error("failed to roll back booking", "slot_id", slot.ID, "err", err)
+			}
+			bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Не удалось списать баллы, попробуйте ещё раз", ShowAlert: true})
+			return
+		}
+	}
+	metricBookingsCreated.inc("")
+	auditSlot(userID, auditBookingCreate, nil, &slot)
+	saveHealthAnswers(&slot, session)
+
+	if amount := prepaymentFor(pkg, quote.Price); amount > 0 {
+		holdForPayment(cb, slot, amount)
+		return
+	}
 
 	// Send confirmation
-	text := fmt.Sprintf("✅ Запись подтверждена!\n\n📅 %s\n🕐 %s\n👨⚕️ %s\n\nЦентр: HGN Москва\nАдрес: Мичуринский проспект, 19к1", date, time, master)
+	text := fmt.Sprintf("✅ Запись подтверждена!\n\n📅 %s\n🕐 %s\n👨⚕️ %s\n\n%s", date, time, master, loc)
 	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, text)
 	bot.Send(editMsg)
+	sendVenue(cb.Message.Chat.ID, loc)
 
-	for _, admin := range cfg.Admins {
-		msg := tgbotapi.NewMessage(admin, fmt.Sprintf("🔔 Новая запись!\n\n👨⚕️ %s\n📅 %s\n🕐 %s\n💼 %s\n💰 %d ₽\n👤 %s\n📞 %s\n💬 @%s", master, date, time, pkg.Name, pkg.Price, clientName, clientPhone, cb.From.UserName))
-		bot.Send(msg)
+	if ics, err := buildBookingICS(slot, pkg); err != nil {
+		slog.Error("failed to build ICS", "slot_id", slot.ID, "err", err)
+	} else {
+		doc := tgbotapi.NewDocument(cb.Message.Chat.ID, tgbotapi.FileBytes{Name: fmt.Sprintf("hijama_%s.ics", date), Bytes: ics})
+		doc.Caption = "📅 Добавьте запись в календарь"
+		bot.Send(doc)
 	}
 
+	notify := fmt.Sprintf("🔔 Новая запись!\n\n📍 %s\n👨⚕️ %s\n📅 %s\n🕐 %s\n💼 %s\n%s\n👤 %s\n📞 %s\n💬 @%s", loc.Name, master, date, time, pkg.Name, quote, clientName, clientPhone, cb.From.UserName)
+	if slot.HealthFlag {
+		notify += "\n\n" + healthText(slot)
+	}
+	notifyStaff(userID, notify)
+
 	clearSession(userID)
 	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Запись успешна!", ShowAlert: false})
 }
 
-func showTimeSelection(cb *tgbotapi.CallbackQuery, dateStr string) {
-	// Fixed times
-	times := []string{"09:00", "10:00", "11:00", "12:00", "13:00", "14:00", "15:00", "16:00", "17:00", "18:00", "19:00", "20:00"}
+// holdForPayment keeps a just booked slot until the client pays the
+// prepayment; confirmation and staff notification follow the payment.
+func holdForPayment(cb *tgbotapi.CallbackQuery, slot Slot, amount int) {
+	userID := cb.From.ID
+	err := holdSlotForPayment(&slot, amount)
+	if err == nil {
+		err = payments.SendInvoice(cb.Message.Chat.ID, slot, amount)
+	}
+	if err != nil {
+		slog.Error("failed to start payment", "slot_id", slot.ID, "err", err)
+		if err := cancelBooking(slot.ID); err != nil {
+			slog.Error("failed to cancel unpaid booking", "slot_id", slot.ID, "err", err)
+		} else {
+			returnPoints(slot)
+		}
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Не удалось выставить счёт, попробуйте позже", ShowAlert: true})
+		return
+	}
+
+	expires := slot.HoldExpiresAt.In(slotLocation(slot).timezone()).Format("15:04")
+	text := fmt.Sprintf("⏳ Время забронировано\n\n📅 %s\n🕐 %s\n👨⚕️ %s\n\n%s\n\nЧтобы подтвердить запись, оплатите %d ₽ по счёту ниже до %s. Без оплаты бронь снимется.",
+		slot.Date, slot.Time, slot.MasterName, slotLocation(slot), amount, expires)
+	bot.Send(tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, text))
 
+	clearSession(userID)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
+
+// bookingTimes are the fixed start times offered every day.
+var bookingTimes = []string{"09:00", "10:00", "11:00", "12:00", "13:00", "14:00", "15:00", "16:00", "17:00", "18:00", "19:00", "20:00"}
+
+func showTimeSelection(cb *tgbotapi.CallbackQuery, dateStr string) {
+	session := getSession(cb.From.ID)
+	loc := locationByID(sessionString(session, "location"))
 	markup := &tgbotapi.InlineKeyboardMarkup{}
-	for _, t := range times {
+	for _, t := range availableTimes(loc, sessionString(session, "package"), dateStr) {
 		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
 			tgbotapi.NewInlineKeyboardButtonData(t, "time_"+dateStr+"_"+t),
 		})
@@ -864,20 +1314,32 @@ func showMyBookings(msg *tgbotapi.Message) {
 	bookings, err := getUserBookings(msg.From.ID)
 	if err != nil || len(bookings) == 0 {
 		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "У вас нет активных записей"))
+		if err == nil {
+			requestContact(msg.Chat.ID)
+		}
 		return
 	}
 
 	for _, booking := range bookings {
 		canCancel := canCancelBooking(booking)
-		text := fmt.Sprintf("📋 Ваша запись:\n\n📅 %s\n🕐 %s\n👨‍⚕️ %s\n\nЦентр: HGN Москва\nАдрес: Мичуринский проспект, 19г1",
-			booking.Date, booking.Time, booking.MasterName)
+		text := fmt.Sprintf("📋 Ваша запись:\n\n📅 %s\n🕐 %s\n👨‍⚕️ %s\n\n%s",
+			booking.Date, booking.Time, booking.MasterName, slotLocation(booking))
+
+		if line := paymentLine(booking); line != "" {
+			text += "\n\n" + line
+		}
 
 		markup := &tgbotapi.InlineKeyboardMarkup{}
+		if booking.PaymentStatus == paymentPending {
+			markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+				tgbotapi.NewInlineKeyboardButtonData("💳 Оплатить", fmt.Sprintf("pay_%d", booking.ID)),
+			})
+		}
 		if canCancel {
 			text += "\n\n⚠️ Отмена возможна за 2 часа до процедуры"
-			markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
-				{tgbotapi.NewInlineKeyboardButtonData("❌ Отменить запись", fmt.Sprintf("cancel_booking_%d", booking.ID))},
-			}
+			markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+				tgbotapi.NewInlineKeyboardButtonData("❌ Отменить запись", fmt.Sprintf("cancel_booking_%d", booking.ID)),
+			})
 		} else {
 			text += "\n\n⚠️ Отмена невозможна (менее 2 часов до процедуры)"
 		}
@@ -896,24 +1358,35 @@ func cancelUserBooking(cb *tgbotapi.CallbackQuery, data string) {
 	fmt.Sscanf(data, "cancel_booking_%d", &bookingID)
 
 	booking, err := getBookingByID(bookingID)
-	if err != nil {
+	if err != nil || booking.UserID != strconv.FormatInt(cb.From.ID, 10) || booking.Status != "booked" {
 		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Ошибка при отмене", ShowAlert: true})
 		return
 	}
+	if !canCancelBooking(*booking) {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Отмена возможна не позднее чем за 2 часа до процедуры", ShowAlert: true})
+		return
+	}
 
 	err = cancelBooking(bookingID)
 	if err != nil {
 		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Ошибка при отмене", ShowAlert: true})
 		return
 	}
-
-	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, "✅ Запись отменена")
+	metricBookingsCanceled.inc("")
+	cancelled := *booking
+	cancelled.Status = "cancelled"
+	cancelled.CancelledAt = time.Now().In(tz)
+	auditSlot(cb.From.ID, auditBookingCancel, booking, &cancelled)
+	returnPoints(*booking)
+
+	text := "✅ Запись отменена"
+	if refund := refundPayment(cb.From.ID, *booking); refund != "" {
+		text += "\n\n" + refund
+	}
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, text)
 	bot.Send(editMsg)
 
-	for _, admin := range cfg.Admins {
-		msg := tgbotapi.NewMessage(admin, fmt.Sprintf("❌ Отмена записи\n\n👨⚕️ %s\n📅 %s\n🕐 %s\n💬 @%s", booking.MasterName, booking.Date, booking.Time, cb.From.UserName))
-		bot.Send(msg)
-	}
+	notifyStaff(cb.From.ID, fmt.Sprintf("❌ Отмена записи\n\n👨⚕️ %s\n📅 %s\n🕐 %s\n💬 @%s", booking.MasterName, booking.Date, booking.Time, cb.From.UserName))
 
 	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Запись отменена", ShowAlert: false})
 }
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Staff book clients who call or walk in under the admin_book_ callbacks. The
+// steps mirror the client flow (package, location, date, time, master) and
+// keep their state in the staff member's own session.
+
+var bookingSources = map[string]string{
+	"phone":   "📞 По телефону",
+	"walk_in": "🚶 В центре",
+}
+
+func handleManualBookingCallback(cb *tgbotapi.CallbackQuery, data string) {
+	userID := cb.From.ID
+	session := getSession(userID)
+
+	switch {
+	case data == "admin_book_start":
+		saveUserSession(userID, &UserSession{Step: "manual_package", Data: map[string]interface{}{}})
+		showManualPackages(cb)
+	case data == "admin_book_cancel":
+		deleteUserSession(userID)
+		showAdminMain(cb)
+	case strings.HasPrefix(data, "admin_book_pkg_"):
+		key := strings.TrimPrefix(data, "admin_book_pkg_")
+		if _, ok := packages[key]; !ok {
+			return
+		}
+		session.Data["package"] = key
+		if multipleLocations() {
+			setSession(userID, session)
+			markup := locationMarkup("admin_book_loc_")
+			markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+				tgbotapi.NewInlineKeyboardButtonData("Отмена", "admin_book_cancel"),
+			})
+			editManual(cb, "➕ Запись клиента\n\nВыберите центр:", markup)
+			return
+		}
+		session.Data["location"] = sortedLocations()[0].ID
+		setSession(userID, session)
+		showManualDates(cb, 0)
+	case strings.HasPrefix(data, "admin_book_loc_"):
+		id := strings.TrimPrefix(data, "admin_book_loc_")
+		if _, ok := getLocation(id); !ok {
+			return
+		}
+		session.Data["location"] = id
+		setSession(userID, session)
+		showManualDates(cb, 0)
+	case strings.HasPrefix(data, "admin_book_page_"):
+		page, _ := strconv.Atoi(strings.TrimPrefix(data, "admin_book_page_"))
+		showManualDates(cb, page)
+	case strings.HasPrefix(data, "admin_book_date_"):
+		date := strings.TrimPrefix(data, "admin_book_date_")
+		session.Data["date"] = date
+		setSession(userID, session)
+		showManualTimes(cb, date)
+	case strings.HasPrefix(data, "admin_book_time_"):
+		session.Data["time"] = strings.TrimPrefix(data, "admin_book_time_")
+		setSession(userID, session)
+		showManualMasters(cb, session)
+	case strings.HasPrefix(data, "admin_book_master_"):
+		session.Data["master"] = strings.TrimPrefix(data, "admin_book_master_")
+		session.Step = "manual_name"
+		setSession(userID, session)
+		editManual(cb, "Введите имя клиента:", manualCancelMarkup())
+	case strings.HasPrefix(data, "admin_book_source_"):
+		source := strings.TrimPrefix(data, "admin_book_source_")
+		if _, ok := bookingSources[source]; !ok {
+			return
+		}
+		session.Data["source"] = source
+		setSession(userID, session)
+		showManualConfirmation(cb, session)
+	case data == "admin_book_confirm":
+		finalizeManualBooking(cb, session)
+	}
+}
+
+func handleManualBookingMessage(msg *tgbotapi.Message, session *UserSession) {
+	switch session.Step {
+	case "manual_name":
+		session.Data["client_name"] = strings.TrimSpace(msg.Text)
+		session.Step = "manual_phone"
+		saveUserSession(msg.From.ID, session)
+		message := tgbotapi.NewMessage(msg.Chat.ID, "Введите телефон клиента:")
+		message.ReplyMarkup = manualCancelMarkup()
+		bot.Send(message)
+	case "manual_phone":
+		phone := normalizePhone(msg.Text)
+		if phone == "" {
+			message := tgbotapi.NewMessage(msg.Chat.ID, "❌ Не похоже на номер телефона, введите ещё раз:")
+			message.ReplyMarkup = manualCancelMarkup()
+			bot.Send(message)
+			return
+		}
+		session.Data["client_phone"] = phone
+		session.Step = "manual_source"
+		saveUserSession(msg.From.ID, session)
+
+		markup := &tgbotapi.InlineKeyboardMarkup{}
+		markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+			{
+				tgbotapi.NewInlineKeyboardButtonData(bookingSources["phone"], "admin_book_source_phone"),
+				tgbotapi.NewInlineKeyboardButtonData(bookingSources["walk_in"], "admin_book_source_walk_in"),
+			},
+			{tgbotapi.NewInlineKeyboardButtonData("Отмена", "admin_book_cancel")},
+		}
+		message := tgbotapi.NewMessage(msg.Chat.ID, "Как клиент записался?")
+		message.ReplyMarkup = markup
+		bot.Send(message)
+	}
+}
+
+func manualCancelMarkup() *tgbotapi.InlineKeyboardMarkup {
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("Отмена", "admin_book_cancel")},
+	}
+	return markup
+}
+
+func editManual(cb *tgbotapi.CallbackQuery, text string, markup *tgbotapi.InlineKeyboardMarkup) {
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, text)
+	editMsg.ReplyMarkup = markup
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
+
+func showManualPackages(cb *tgbotapi.CallbackQuery) {
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	for _, key := range packageOrder {
+		pkg, ok := packages[key]
+		if !ok {
+			continue
+		}
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%s — %d ₽", pkg.Name, pkg.Price), "admin_book_pkg_"+key),
+		})
+	}
+	markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("Отмена", "admin_book_cancel"),
+	})
+	editManual(cb, "➕ Запись клиента\n\nВыберите услугу:", markup)
+}
+
+func manualLocation(session UserSession) Location {
+	return locationByID(sessionString(session, "location"))
+}
+
+func showManualDates(cb *tgbotapi.CallbackQuery, page int) {
+	session := getSession(cb.From.ID)
+	markup := datePageMarkup(manualLocation(session), sessionString(session, "package"), page, "admin_book_date_", "admin_book_page_", false)
+	markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("Отмена", "admin_book_cancel"),
+	})
+	editManual(cb, "➕ Запись клиента\n\nВыберите дату:", markup)
+}
+
+func showManualTimes(cb *tgbotapi.CallbackQuery, date string) {
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	session := getSession(cb.From.ID)
+	for _, t := range availableTimes(manualLocation(session), sessionString(session, "package"), date) {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(t, "admin_book_time_"+t),
+		})
+	}
+	markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("← Назад", "admin_book_page_0"),
+		tgbotapi.NewInlineKeyboardButtonData("Отмена", "admin_book_cancel"),
+	})
+	editManual(cb, fmt.Sprintf("➕ Запись клиента\n\nВремя на %s:", date), markup)
+}
+
+func showManualMasters(cb *tgbotapi.CallbackQuery, session UserSession) {
+	date, _ := session.Data["date"].(string)
+	slotTime, _ := session.Data["time"].(string)
+
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	for _, master := range availableMasters(manualLocation(session), sessionString(session, "package"), date, slotTime) {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(master, "admin_book_master_"+master),
+		})
+	}
+	markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("← Назад", "admin_book_date_"+date),
+		tgbotapi.NewInlineKeyboardButtonData("Отмена", "admin_book_cancel"),
+	})
+
+	text := fmt.Sprintf("➕ Запись клиента\n\nСвободные мастера на %s %s:", date, slotTime)
+	if len(markup.InlineKeyboard) == 1 {
+		text = fmt.Sprintf("➕ Запись клиента\n\nНа %s %s все мастера заняты", date, slotTime)
+	}
+	editManual(cb, text, markup)
+}
+
+func showManualConfirmation(cb *tgbotapi.CallbackQuery, session UserSession) {
+	pkg := packages[sessionString(session, "package")]
+	text := fmt.Sprintf("Подтвердите запись:\n\n📍 %s\n📅 %s\n🕐 %s\n👨⚕️ %s\n💼 %s\n💰 %d ₽\n👤 %s\n📞 %s\n%s",
+		manualLocation(session).Name, sessionString(session, "date"), sessionString(session, "time"), sessionString(session, "master"),
+		pkg.Name, pkg.Price, sessionString(session, "client_name"), sessionString(session, "client_phone"),
+		bookingSources[sessionString(session, "source")])
+
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("✅ Записать", "admin_book_confirm")},
+		{tgbotapi.NewInlineKeyboardButtonData("Отмена", "admin_book_cancel")},
+	}
+	editManual(cb, text, markup)
+}
+
+func finalizeManualBooking(cb *tgbotapi.CallbackQuery, session UserSession) {
+	userID := cb.From.ID
+	date := sessionString(session, "date")
+	slotTime := sessionString(session, "time")
+	master := sessionString(session, "master")
+	clientName := sessionString(session, "client_name")
+	clientPhone := sessionString(session, "client_phone")
+	source := sessionString(session, "source")
+	pkg := packages[sessionString(session, "package")]
+	loc := manualLocation(session)
+	if date == "" || slotTime == "" || master == "" || source == "" {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Запись устарела, начните заново", ShowAlert: true})
+		return
+	}
+
+	if slotStarted(Slot{Date: date, Time: slotTime, LocationID: loc.ID}) {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Это время уже прошло", ShowAlert: true})
+		showManualDates(cb, 0)
+		return
+	}
+	if !masterAvailable(loc, sessionString(session, "package"), date, slotTime, master) {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Мастер уже занят на это время", ShowAlert: true})
+		showManualMasters(cb, session)
+		return
+	}
+
+	slot, err := bookSlotForClient(date, slotTime, master, clientName, clientPhone, pkg.Name, source, loc.ID, pkg.Price)
+	if errors.Is(err, errSlotTaken) {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Мастер уже занят на это время", ShowAlert: true})
+		showManualMasters(cb, session)
+		return
+	}
+	if err != nil {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Ошибка при бронировании", ShowAlert: true})
+		return
+	}
+	metricBookingsCreated.inc("")
+	auditSlot(userID, auditBookingCreate, nil, &slot)
+	deleteUserSession(userID)
+
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("➕ Записать ещё", "admin_book_start")},
+		{tgbotapi.NewInlineKeyboardButtonData("← В админ панель", "admin_back")},
+	}
+	text := fmt.Sprintf("✅ Клиент записан\n\n📅 %s\n🕐 %s\n👨⚕️ %s\n👤 %s\n📞 %s\n\nКогда клиент поделится этим номером в боте, он получит подтверждение.", date, slotTime, master, clientName, clientPhone)
+	editManual(cb, text, markup)
+
+	notifyStaff(userID, fmt.Sprintf("🔔 Новая запись (%s)\n\n📍 %s\n👨⚕️ %s\n📅 %s\n🕐 %s\n💼 %s\n💰 %d ₽\n👤 %s\n📞 %s", bookingSources[source], loc.Name, master, date, slotTime, pkg.Name, pkg.Price, clientName, clientPhone))
+}
+
+func sessionString(session UserSession, key string) string {
+	s, _ := session.Data[key].(string)
+	return s
+}
+
+// normalizePhone reduces a Russian number to +7XXXXXXXXXX so phone bookings
+// can be matched with a shared Telegram contact. Other numbers keep their
+// digits with a leading "+". Returns "" if the input isn't a phone number.
+func normalizePhone(s string) string {
+	var digits []byte
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			digits = append(digits, byte(r))
+		}
+	}
+	switch {
+	case len(digits) == 10:
+		digits = append([]byte("7"), digits...)
+	case len(digits) == 11 && digits[0] == '8':
+		digits[0] = '7'
+	}
+	if len(digits) < 10 || len(digits) > 15 {
+		return ""
+	}
+	return "+" + string(digits)
+}
+
+// requestContact asks the client to share their phone so bookings made by
+// staff on that number show up in the bot.
+func requestContact(chatID int64) {
+	button := tgbotapi.NewKeyboardButtonContact("📱 Поделиться номером")
+	markup := tgbotapi.NewOneTimeReplyKeyboard(tgbotapi.NewKeyboardButtonRow(button))
+	message := tgbotapi.NewMessage(chatID, "Если вы записывались по телефону или в центре, поделитесь номером — мы найдём вашу запись.")
+	message.ReplyMarkup = markup
+	bot.Send(message)
+}
+
+// handleContact links staff-made bookings to the Telegram account. Only the
+// user's own contact counts: Telegram guarantees its number belongs to them,
+// unlike a typed one.
+func handleContact(msg *tgbotapi.Message) {
+	contact := msg.Contact
+	if contact.UserID != msg.From.ID {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "Отправьте, пожалуйста, свой номер кнопкой «📱 Поделиться номером»"))
+		return
+	}
+
+	linked := linkPhoneBookings(msg.From.ID, msg.From.UserName, contact.PhoneNumber)
+	text := "Записей на этот номер не найдено"
+	if linked > 0 {
+		text = fmt.Sprintf("✅ Найдено записей: %d. Они появятся в «📋 Мои записи».", linked)
+	}
+	message := tgbotapi.NewMessage(msg.Chat.ID, text)
+	message.ReplyMarkup = mainMenuMarkup(msg.From.ID)
+	bot.Send(message)
+}
+
+func linkPhoneBookings(userID int64, username, phone string) int {
+	phone = normalizePhone(phone)
+	if phone == "" {
+		return 0
+	}
+	slots, err := getUnlinkedBookings()
+	if err != nil {
+		slog.Error("failed to load unlinked bookings", "user_id", userID, "err", err)
+		return 0
+	}
+
+	linked := 0
+	for _, slot := range slots {
+		if normalizePhone(slot.ClientPhone) != phone {
+			continue
+		}
+		if err := linkBooking(slot.ID, userID, username); err != nil {
+			slog.Error("failed to link booking", "slot_id", slot.ID, "user_id", userID, "err", err)
+			continue
+		}
+		before := slot
+		slot.UserID = strconv.FormatInt(userID, 10)
+		slot.Username = username
+		auditSlot(userID, auditBookingLink, &before, &slot)
+		sendBookingConfirmation(userID, slot)
+		linked++
+	}
+	return linked
+}
+
+func sendBookingConfirmation(chatID int64, slot Slot) {
+	loc := slotLocation(slot)
+	text := fmt.Sprintf("✅ Вы записаны!\n\n📅 %s\n🕐 %s\n👨⚕️ %s\n💼 %s\n\n%s", slot.Date, slot.Time, slot.MasterName, slot.PackageName, loc)
+	bot.Send(tgbotapi.NewMessage(chatID, text))
+	sendVenue(chatID, loc)
+	sendBookingICS(chatID, slot)
+}
+
+func sendBookingICS(chatID int64, slot Slot) {
+	_, pkg := resolvePackage(slot.PackageName)
+	if ics, err := buildBookingICS(slot, pkg); err != nil {
+		slog.Error("failed to build ICS", "slot_id", slot.ID, "err", err)
+	} else {
+		doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{Name: fmt.Sprintf("hijama_%s.ics", slot.Date), Bytes: ics})
+		doc.Caption = "📅 Добавьте запись в календарь"
+		bot.Send(doc)
+	}
+}
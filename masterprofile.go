@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Master profiles: photo, bio, experience and the packages the master
+// performs. Profiles are edited with /master and shown to clients from the
+// master selection; availability only offers masters for their packages.
+
+const masterBioMaxLen = 500
+
+// performs reports whether the master does the package. Masters without a
+// package list do all of them.
+func (m Master) performs(pkgKey string) bool {
+	return pkgKey == "" || len(m.Packages) == 0 || containsString(m.Packages, pkgKey)
+}
+
+func (m Master) hasProfile() bool {
+	return m.PhotoFileID != "" || m.Bio != "" || m.Experience > 0
+}
+
+func yearsWord(n int) string {
+	switch {
+	case n%10 == 1 && n%100 != 11:
+		return "год"
+	case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+		return "года"
+	}
+	return "лет"
+}
+
+func (m Master) packageNames() string {
+	if len(m.Packages) == 0 {
+		return "все процедуры"
+	}
+	var names []string
+	for _, key := range m.Packages {
+		if pkg, ok := packages[key]; ok {
+			names = append(names, pkg.Name)
+		} else {
+			names = append(names, key)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// card is the profile shown to clients.
+func (m Master) card(rating Rating) string {
+	text := "👨⚕️ " + m.Name
+	if rating.Count > 0 {
+		text += " " + rating.String()
+	}
+	if m.Experience > 0 {
+		text += fmt.Sprintf("\nСтаж: %d %s", m.Experience, yearsWord(m.Experience))
+	}
+	text += "\nПроцедуры: " + m.packageNames()
+	if m.Bio != "" {
+		text += "\n\n" + m.Bio
+	}
+	return text
+}
+
+func sendMasterCard(chatID int64, m Master) {
+	text := m.card(masterRatings()[m.ID])
+	if m.PhotoFileID == "" {
+		bot.Send(tgbotapi.NewMessage(chatID, text))
+		return
+	}
+	photo := tgbotapi.NewPhoto(chatID, tgbotapi.FileID(m.PhotoFileID))
+	photo.Caption = text
+	if _, err := bot.Send(photo); err != nil {
+		slog.Error("failed to send master photo", "master", m.ID, "err", err)
+		bot.Send(tgbotapi.NewMessage(chatID, text))
+	}
+}
+
+// showMasterInfo handles master_info_<id> from the master selection. The card
+// is sent as a new message so the selection stays usable.
+func showMasterInfo(cb *tgbotapi.CallbackQuery, data string) {
+	m, ok := getMaster(strings.TrimPrefix(data, "master_info_"))
+	if !ok {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Мастер не найден", ShowAlert: true})
+		return
+	}
+	sendMasterCard(cb.Message.Chat.ID, m)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
+
+// updateMasterProfile stores one profile field and refreshes the cache.
+func updateMasterProfile(actorID int64, m Master, field string, value interface{}) error {
+	_, _, err := supabaseClient.From("masters").
+		Update(map[string]interface{}{field: value}, "", "").
+		Eq("id", m.ID).
+		Execute()
+	if err != nil {
+		return err
+	}
+	before, _ := getMaster(m.ID)
+	setMaster(m)
+	writeAudit(actorID, auditMasterUpdate, "master", m.ID, 0, map[string]interface{}{field: profileField(before, field)}, map[string]interface{}{field: value})
+	return nil
+}
+
+func profileField(m Master, field string) interface{} {
+	switch field {
+	case "photo_file_id":
+		return m.PhotoFileID
+	case "bio":
+		return m.Bio
+	case "experience_years":
+		return m.Experience
+	case "packages":
+		return m.Packages
+	}
+	return nil
+}
+
+const masterUsage = "/master — профили мастеров\n" +
+	"/master ID — карточка мастера\n" +
+	"/master ID bio Текст — описание (до 500 символов), /master ID bio - — убрать\n" +
+	"/master ID exp 7 — стаж в годах\n" +
+	"/master ID packages complex,upper — процедуры мастера, /master ID packages all — все\n" +
+	"/master ID photo — подписью к фото или ответом на фото, /master ID photo off — убрать"
+
+func masterProfilesText() string {
+	all := mastersSnapshot()
+	ids := make([]string, 0, len(all))
+	for id := range all {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	text := "👨⚕️ Профили мастеров\n"
+	for _, id := range ids {
+		m := all[id]
+		photo, bio := "—", "—"
+		if m.PhotoFileID != "" {
+			photo = "✅"
+		}
+		if m.Bio != "" {
+			bio = "✅"
+		}
+		text += fmt.Sprintf("\n%s — %s: стаж %d, фото %s, описание %s\n   %s", id, m.Name, m.Experience, photo, bio, m.packageNames())
+	}
+	return text + "\n\n" + masterUsage
+}
+
+// masterCommand handles /master; it also arrives as a photo caption.
+func masterCommand(msg *tgbotapi.Message) {
+	text := msg.Text
+	if text == "" {
+		text = msg.Caption
+	}
+	args := strings.Fields(text)[1:]
+	reply := func(text string) {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, text))
+	}
+	if len(args) == 0 {
+		reply(masterProfilesText())
+		return
+	}
+	m, ok := getMaster(strings.ToLower(args[0]))
+	if !ok {
+		reply("❌ Мастер " + args[0] + " не найден\n\n" + masterUsage)
+		return
+	}
+	if len(args) == 1 {
+		sendMasterCard(msg.Chat.ID, m)
+		return
+	}
+
+	var field string
+	var value interface{}
+	switch args[1] {
+	case "bio":
+		// The bio keeps its own spacing and line breaks
+		bio := text
+		for i := 0; i < 3; i++ {
+			bio = strings.TrimSpace(bio)
+			if j := strings.IndexAny(bio, " \t\n"); j >= 0 {
+				bio = bio[j:]
+			} else {
+				bio = ""
+			}
+		}
+		bio = strings.TrimSpace(bio)
+		if bio == "-" {
+			bio = ""
+		}
+		if len([]rune(bio)) > masterBioMaxLen {
+			reply(fmt.Sprintf("❌ Описание длиннее %d символов", masterBioMaxLen))
+			return
+		}
+		m.Bio, field, value = bio, "bio", bio
+	case "exp":
+		if len(args) != 3 {
+			reply(masterUsage)
+			return
+		}
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 0 || n > 80 {
+			reply("❌ Укажите стаж числом лет\n\n" + masterUsage)
+			return
+		}
+		m.Experience, field, value = n, "experience_years", n
+	case "packages":
+		if len(args) != 3 {
+			reply(masterUsage)
+			return
+		}
+		keys := []string{}
+		if args[2] != "all" {
+			for _, key := range strings.Split(args[2], ",") {
+				if _, ok := packages[key]; !ok {
+					reply("❌ Нет процедуры " + key + ", есть: " + strings.Join(packageOrder, ", "))
+					return
+				}
+				keys = append(keys, key)
+			}
+		}
+		m.Packages, field, value = keys, "packages", keys
+	case "photo":
+		// The largest size comes last
+		var fileID string
+		switch {
+		case len(args) == 3 && args[2] == "off":
+		case len(msg.Photo) > 0:
+			fileID = msg.Photo[len(msg.Photo)-1].FileID
+		case msg.ReplyToMessage != nil && len(msg.ReplyToMessage.Photo) > 0:
+			fileID = msg.ReplyToMessage.Photo[len(msg.ReplyToMessage.Photo)-1].FileID
+		default:
+			reply("❌ Отправьте фото с подписью /master " + m.ID + " photo или ответьте этой командой на фото")
+			return
+		}
+		m.PhotoFileID, field, value = fileID, "photo_file_id", fileID
+	default:
+		reply(masterUsage)
+		return
+	}
+
+	if err := updateMasterProfile(msg.From.ID, m, field, value); err != nil {
+		slog.Error("failed to update master profile", "master", m.ID, "field", field, "err", err)
+		reply("❌ Ошибка при сохранении")
+		return
+	}
+	reply("✅ Профиль обновлён")
+	sendMasterCard(msg.Chat.ID, m)
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Messenger is the part of the Bot API that handlers use. Handlers talk to
+// bot; main and the update sources use api directly for polling and webhooks.
+type Messenger interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error)
+}
+
+var bot Messenger
+var api *tgbotapi.BotAPI
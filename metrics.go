@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// A minimal Prometheus text-format registry; the bot only needs counters,
+// histograms and a couple of gauges.
+
+type counterVec struct {
+	name, help, label string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, values: make(map[string]float64)}
+}
+
+func (c *counterVec) inc(labelValue string) {
+	c.mu.Lock()
+	c.values[labelValue]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if c.label == "" {
+		fmt.Fprintf(w, "%s %g\n", c.name, c.values[""])
+		return
+	}
+	for _, v := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s=%q} %g\n", c.name, c.label, v, c.values[v])
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name, help, label string
+	buckets           []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func newHistogramVec(name, help, label string) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, buckets: latencyBuckets, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(labelValue string, d time.Duration) {
+	seconds := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[labelValue]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[labelValue] = s
+	}
+	for i, b := range h.buckets {
+		if seconds <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += seconds
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"%g\"} %d\n", h.name, h.label, k, b, s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", h.name, h.label, k, s.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %g\n", h.name, h.label, k, s.sum)
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", h.name, h.label, k, s.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	metricUpdates          = newCounterVec("hgn_updates_total", "Updates processed by type.", "type")
+	metricHandlerDuration  = newHistogramVec("hgn_handler_duration_seconds", "Time spent handling an update.", "type")
+	metricSendErrors       = newCounterVec("hgn_telegram_send_errors_total", "Failed Telegram Bot API calls by request type.", "request")
+	metricDBDuration       = newHistogramVec("hgn_db_duration_seconds", "Supabase call latency by operation.", "op")
+	metricDBErrors         = newCounterVec("hgn_db_errors_total", "Failed Supabase calls by operation.", "op")
+	metricBookingsCreated  = newCounterVec("hgn_bookings_created_total", "Bookings created.", "")
+	metricBookingsCanceled = newCounterVec("hgn_bookings_cancelled_total", "Bookings cancelled.", "")
+)
+
+func updateType(update tgbotapi.Update) string {
+	switch {
+	case update.Message != nil:
+		return "message"
+	case update.CallbackQuery != nil:
+		return "callback_query"
+	case update.PreCheckoutQuery != nil:
+		return "pre_checkout_query"
+	default:
+		return "other"
+	}
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metricUpdates.write(w)
+	metricHandlerDuration.write(w)
+	metricSendErrors.write(w)
+	metricDBDuration.write(w)
+	metricDBErrors.write(w)
+	metricBookingsCreated.write(w)
+	metricBookingsCanceled.write(w)
+	fmt.Fprintf(w, "# HELP hgn_active_sessions Users in the middle of a dialog.\n# TYPE hgn_active_sessions gauge\nhgn_active_sessions %d\n", sessionCount())
+}
+
+// instrumentedMessenger counts failed Bot API calls.
+type instrumentedMessenger struct {
+	next Messenger
+}
+
+func (m instrumentedMessenger) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	msg, err := m.next.Send(c)
+	if err != nil {
+		metricSendErrors.inc(requestName(c))
+	}
+	return msg, err
+}
+
+func (m instrumentedMessenger) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	resp, err := m.next.Request(c)
+	if err != nil {
+		metricSendErrors.inc(requestName(c))
+	}
+	return resp, err
+}
+
+func requestName(c tgbotapi.Chattable) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", c), "tgbotapi.")
+}
+
+// dbMetricsTransport times every request that goes to Supabase. The op label
+// is the PostgREST verb and table, e.g. "select slots".
+type dbMetricsTransport struct {
+	base http.RoundTripper
+	host string
+}
+
+func (t *dbMetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host {
+		return t.base.RoundTrip(req)
+	}
+
+	op := dbOperation(req)
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	metricDBDuration.observe(op, time.Since(start))
+	if err != nil || resp.StatusCode >= 400 {
+		metricDBErrors.inc(op)
+	}
+	return resp, err
+}
+
+func dbOperation(req *http.Request) string {
+	verb := map[string]string{
+		http.MethodGet:    "select",
+		http.MethodHead:   "count",
+		http.MethodPost:   "insert",
+		http.MethodPatch:  "update",
+		http.MethodDelete: "delete",
+	}[req.Method]
+	if verb == "" {
+		verb = strings.ToLower(req.Method)
+	}
+	table := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+	return verb + " " + table
+}
+
+func instrumentDBTransport(supabaseURL string) {
+	u, err := url.Parse(supabaseURL)
+	if err != nil || u.Host == "" {
+		return
+	}
+	http.DefaultTransport = &dbMetricsTransport{base: http.DefaultTransport, host: u.Host}
+}
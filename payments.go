@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Prepayment goes through Telegram Payments: the bot sends an invoice,
+// Telegram asks the bot to confirm the order (pre_checkout_query) and then
+// reports a successful_payment. While the client pays, the slot is booked
+// with payment_status "pending" and holds the time; the payment_holds job
+// cancels holds that were not paid in time. What differs between payment
+// providers — the invoice token and refunds — is behind PaymentProvider.
+
+const (
+	paymentPending       = "pending"
+	paymentPaid          = "paid"
+	paymentRefundPending = "refund_pending"
+	paymentRefunded      = "refunded"
+	paymentExpired       = "expired"
+
+	paymentCurrency      = "RUB"
+	paymentPayloadPrefix = "slot:"
+)
+
+var paymentTitles = map[string]string{
+	paymentPending:       "ожидает оплаты",
+	paymentPaid:          "оплачена",
+	paymentRefundPending: "нужно вернуть",
+	paymentRefunded:      "возвращена",
+	paymentExpired:       "не оплачена, бронь снята",
+}
+
+// errManualRefund means the provider cannot refund through the API and staff
+// have to return the money in the provider's dashboard.
+var errManualRefund = errors.New("refund has to be made in the provider dashboard")
+
+// PaymentProvider sends invoices and returns payments.
+type PaymentProvider interface {
+	Name() string
+	// SendInvoice asks the client in chatID to pay amount rubles for slot.
+	SendInvoice(chatID int64, slot Slot, amount int) error
+	// Refund returns the payment captured for slot.
+	Refund(slot Slot) error
+}
+
+// payments is nil when prepayment is disabled.
+var payments PaymentProvider
+
+func initPayments() {
+	if cfg.PaymentToken != "" {
+		payments = telegramPayments{token: cfg.PaymentToken}
+	}
+	if payments != nil {
+		slog.Info("payments enabled", "provider", payments.Name(), "hold", cfg.PaymentHold)
+	}
+}
+
+// telegramPayments is a provider connected in @BotFather. Telegram has no
+// refund method for such payments, so refunds are made by staff.
+type telegramPayments struct {
+	token string
+}
+
+func (p telegramPayments) Name() string { return "telegram" }
+
+func (p telegramPayments) SendInvoice(chatID int64, slot Slot, amount int) error {
+	return sendInvoice(chatID, slot, amount, p.token)
+}
+
+func (p telegramPayments) Refund(slot Slot) error {
+	return errManualRefund
+}
+
+func sendInvoice(chatID int64, slot Slot, amount int, token string) error {
+	title := "Предоплата записи"
+	if amount >= slotPrice(slot) {
+		title = "Оплата записи"
+	}
+	description := fmt.Sprintf("%s, %s в %s, мастер %s", slot.PackageName, slot.Date, slot.Time, slot.MasterName)
+	invoice := tgbotapi.NewInvoice(chatID, title, description, paymentPayload(slot.ID), token, "", paymentCurrency,
+		[]tgbotapi.LabeledPrice{{Label: slot.PackageName, Amount: amount * 100}})
+	// nil is sent as "null", which Telegram rejects
+	invoice.SuggestedTipAmounts = []int{}
+	_, err := bot.Send(invoice)
+	return err
+}
+
+func paymentPayload(slotID int) string {
+	return paymentPayloadPrefix + strconv.Itoa(slotID)
+}
+
+func slotIDFromPayload(payload string) (int, bool) {
+	if !strings.HasPrefix(payload, paymentPayloadPrefix) {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(payload, paymentPayloadPrefix))
+	return id, err == nil
+}
+
+// prepaymentFor returns the rubles to ask in advance for pkg sold at price,
+// or 0 when payments are off or the package has no prepayment. Full
+// prepayment follows a discounted price.
+func prepaymentFor(pkg Package, price int) int {
+	if payments == nil || pkg.Prepayment <= 0 || price <= 0 {
+		return 0
+	}
+	if pkg.Prepayment >= pkg.Price || pkg.Prepayment > price {
+		return price
+	}
+	return pkg.Prepayment
+}
+
+func holdSlotForPayment(slot *Slot, amount int) error {
+	expires := time.Now().Add(cfg.PaymentHold)
+	update := map[string]interface{}{
+		"payment_status":  paymentPending,
+		"payment_amount":  amount,
+		"hold_expires_at": dbTimestamp(expires),
+	}
+	_, _, err := supabaseClient.From("slots").
+		Update(update, "", "").
+		Eq("id", strconv.Itoa(slot.ID)).
+		Execute()
+	if err != nil {
+		return err
+	}
+	slot.PaymentStatus = paymentPending
+	slot.PaymentAmount = amount
+	slot.HoldExpiresAt = expires
+	return nil
+}
+
+func paymentUpdate(payment *tgbotapi.SuccessfulPayment) map[string]interface{} {
+	return map[string]interface{}{
+		"payment_status":     paymentPaid,
+		"payment_charge_id":  payment.TelegramPaymentChargeID,
+		"provider_charge_id": payment.ProviderPaymentChargeID,
+		"paid_at":            dbTimestamp(time.Now()),
+	}
+}
+
+// markSlotPaid records the payment only while the slot is still held for it
+// and reports whether it did; like releaseHold it settles the race between
+// the two in the database.
+func markSlotPaid(slotID int, payment *tgbotapi.SuccessfulPayment) (bool, error) {
+	data, _, err := supabaseClient.From("slots").
+		Update(paymentUpdate(payment), "", "").
+		Eq("id", strconv.Itoa(slotID)).
+		Eq("status", "booked").
+		Eq("payment_status", paymentPending).
+		Execute()
+	if err != nil {
+		return false, err
+	}
+	var rows []Slot
+	json.Unmarshal(data, &rows)
+	return len(rows) > 0, nil
+}
+
+// saveLatePayment records a payment for a slot whose hold was already
+// released, so that it can be refunded.
+func saveLatePayment(slotID int, payment *tgbotapi.SuccessfulPayment) error {
+	_, _, err := supabaseClient.From("slots").
+		Update(paymentUpdate(payment), "", "").
+		Eq("id", strconv.Itoa(slotID)).
+		Execute()
+	return err
+}
+
+func setPaymentStatus(slotID int, status string) error {
+	_, _, err := supabaseClient.From("slots").
+		Update(map[string]interface{}{"payment_status": status}, "", "").
+		Eq("id", strconv.Itoa(slotID)).
+		Execute()
+	return err
+}
+
+// expiredHolds returns booked slots whose payment hold ran out before now.
+func expiredHolds(now time.Time) ([]Slot, error) {
+	data, _, err := supabaseClient.From("slots").
+		Select("*", "exact", false).
+		Eq("status", "booked").
+		Eq("payment_status", paymentPending).
+		Lt("hold_expires_at", dbTimestamp(now)).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+	var slots []Slot
+	err = json.Unmarshal(data, &slots)
+	return slots, err
+}
+
+// releaseHold cancels an unpaid slot. It only touches the slot while the
+// payment is still pending, so a payment that lands at the same moment wins.
+func releaseHold(slotID int) (bool, error) {
+	update := map[string]interface{}{
+		"status":         "cancelled",
+		"cancelled_at":   dbTimestamp(time.Now()),
+		"payment_status": paymentExpired,
+	}
+	data, _, err := supabaseClient.From("slots").
+		Update(update, "", "").
+		Eq("id", strconv.Itoa(slotID)).
+		Eq("payment_status", paymentPending).
+		Execute()
+	if err != nil {
+		return false, err
+	}
+	var rows []Slot
+	json.Unmarshal(data, &rows)
+	return len(rows) > 0, nil
+}
+
+// releaseExpiredHolds is the payment_holds job.
+func releaseExpiredHolds(ctx context.Context) {
+	slots, err := expiredHolds(time.Now())
+	if err != nil {
+		slog.Error("failed to load expired payment holds", "err", err)
+		return
+	}
+	for _, slot := range slots {
+		if ctx.Err() != nil {
+			return
+		}
+		released, err := releaseHold(slot.ID)
+		if err != nil {
+			slog.Error("failed to release payment hold", "slot_id", slot.ID, "err", err)
+			continue
+		}
+		if !released {
+			continue
+		}
+		metricBookingsCanceled.inc("")
+		after := slot
+		after.Status = "cancelled"
+		after.CancelledAt = time.Now().In(tz)
+		after.PaymentStatus = paymentExpired
+		auditSlot(0, auditBookingCancel, &slot, &after)
+		returnPoints(slot)
+		slog.Info("payment hold released", "slot_id", slot.ID)
+		notifyClient(slot, fmt.Sprintf("⌛ Бронь на %s в %s снята: предоплата не поступила.\n\nЧтобы выбрать время снова, нажмите «📍 Записаться на Хиджаму».", slot.Date, slot.Time))
+	}
+}
+
+// checkPayment validates an order before Telegram charges the client and
+// returns the reason to show if it must be declined.
+func checkPayment(userID int64, payload, currency string, total int) string {
+	slotID, ok := slotIDFromPayload(payload)
+	if !ok {
+		return "Счёт не найден"
+	}
+	slot, err := getBookingByID(slotID)
+	if err != nil || slot.UserID != strconv.FormatInt(userID, 10) {
+		return "Запись не найдена"
+	}
+	if slot.Status != "booked" || slot.PaymentStatus != paymentPending || time.Now().After(slot.HoldExpiresAt) {
+		return "Бронь истекла. Пожалуйста, запишитесь заново."
+	}
+	if currency != paymentCurrency || total != slot.PaymentAmount*100 {
+		return "Сумма счёта изменилась. Пожалуйста, запишитесь заново."
+	}
+	return ""
+}
+
+func handlePreCheckout(ctx context.Context, q *tgbotapi.PreCheckoutQuery) {
+	answer := tgbotapi.PreCheckoutConfig{PreCheckoutQueryID: q.ID, OK: true}
+	if reason := checkPayment(q.From.ID, q.InvoicePayload, q.Currency, q.TotalAmount); reason != "" {
+		logFrom(ctx).Info("pre-checkout declined", "payload", q.InvoicePayload, "reason", reason)
+		answer.OK = false
+		answer.ErrorMessage = reason
+	}
+	if _, err := bot.Request(answer); err != nil {
+		logFrom(ctx).Error("failed to answer pre-checkout", "err", err)
+	}
+}
+
+func handleSuccessfulPayment(ctx context.Context, msg *tgbotapi.Message) {
+	payment := msg.SuccessfulPayment
+	logger := logFrom(ctx).With("payload", payment.InvoicePayload, "charge_id", payment.TelegramPaymentChargeID)
+
+	slotID, _ := slotIDFromPayload(payment.InvoicePayload)
+	slot, err := getBookingByID(slotID)
+	if err != nil {
+		// The money is taken, so staff must sort it out by hand
+		logger.Error("payment for unknown slot", "err", err)
+		notifyStaff(0, fmt.Sprintf("⚠️ Оплата %d ₽ без записи\n\n💬 @%s\nПлатёж: %s", payment.TotalAmount/100, msg.From.UserName, payment.TelegramPaymentChargeID))
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "Оплата получена, но запись не найдена. Администратор свяжется с вами."))
+		return
+	}
+
+	paid, err := markSlotPaid(slot.ID, payment)
+	if err != nil {
+		logger.Error("failed to save payment", "slot_id", slot.ID, "err", err)
+	}
+	// The hold ran out while the client was paying
+	late := err == nil && !paid
+	if late {
+		if current, err := getBookingByID(slot.ID); err == nil {
+			if current.PaymentChargeID == payment.TelegramPaymentChargeID {
+				logger.Info("payment already recorded", "slot_id", slot.ID)
+				return
+			}
+			slot = current
+		}
+		if err := saveLatePayment(slot.ID, payment); err != nil {
+			logger.Error("failed to save late payment", "slot_id", slot.ID, "err", err)
+		}
+	}
+	after := *slot
+	after.PaymentStatus = paymentPaid
+	after.PaymentChargeID = payment.TelegramPaymentChargeID
+	after.ProviderChargeID = payment.ProviderPaymentChargeID
+	after.PaidAt = time.Now().In(tz)
+	auditSlot(msg.From.ID, auditBookingPayment, slot, &after)
+	logger.Info("booking paid", "slot_id", slot.ID, "amount", payment.TotalAmount)
+
+	if late {
+		text := fmt.Sprintf("Оплата получена, но бронь на %s в %s уже снята.", slot.Date, slot.Time)
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, text+" "+refundPayment(msg.From.ID, after)))
+		return
+	}
+
+	sendBookingConfirmation(msg.Chat.ID, after)
+	loc := slotLocation(after)
+	notify := fmt.Sprintf("🔔 Новая запись!\n\n📍 %s\n👨⚕️ %s\n📅 %s\n🕐 %s\n💼 %s\n💳 Оплачено %d ₽\n👤 %s\n📞 %s\n💬 @%s", loc.Name, slot.MasterName, slot.Date, slot.Time, slot.PackageName, payment.TotalAmount/100, slot.ClientName, slot.ClientPhone, msg.From.UserName)
+	if slot.HealthFlag {
+		notify += "\n\n" + healthText(*slot)
+	}
+	notifyStaff(msg.From.ID, notify)
+}
+
+// refundPayment returns the prepayment of a cancelled slot and tells what
+// the client should expect. Payments the provider cannot refund are left to
+// staff, who mark them in the booking card once the money is returned.
+func refundPayment(actorID int64, slot Slot) string {
+	if slot.PaymentStatus != paymentPaid {
+		return ""
+	}
+	err := errManualRefund
+	if payments != nil {
+		err = payments.Refund(slot)
+	}
+	status := paymentRefunded
+	if err != nil {
+		if !errors.Is(err, errManualRefund) {
+			slog.Error("refund failed", "slot_id", slot.ID, "provider", payments.Name(), "err", err)
+		}
+		status = paymentRefundPending
+	}
+	if err := setPaymentStatus(slot.ID, status); err != nil {
+		slog.Error("failed to save refund status", "slot_id", slot.ID, "err", err)
+	}
+	after := slot
+	after.PaymentStatus = status
+	auditSlot(actorID, auditBookingRefund, &slot, &after)
+
+	if status == paymentRefunded {
+		return fmt.Sprintf("Предоплата %d ₽ возвращена.", slot.PaymentAmount)
+	}
+	notifyStaff(0, fmt.Sprintf("💸 Верните предоплату %d ₽\n\n📋 Запись #%d\n📅 %s\n🕐 %s\n👤 %s\nПлатёж: %s\n\nПосле возврата отметьте его в карточке записи.", slot.PaymentAmount, slot.ID, slot.Date, slot.Time, slot.ClientName, slot.ProviderChargeID))
+	return fmt.Sprintf("Предоплату %d ₽ вернём в течение нескольких дней.", slot.PaymentAmount)
+}
+
+// markRefunded is the staff confirmation of a refund made by hand.
+func markRefunded(cb *tgbotapi.CallbackQuery, idStr string) {
+	slot, ok := loadSlotForStaff(cb, idStr)
+	if !ok {
+		return
+	}
+	if slot.PaymentStatus != paymentRefundPending {
+		showSlotCard(cb, idStr)
+		return
+	}
+	if err := setPaymentStatus(slot.ID, paymentRefunded); err != nil {
+		slog.Error("failed to save refund status", "slot_id", slot.ID, "err", err)
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Ошибка при сохранении", ShowAlert: true})
+		return
+	}
+	after := *slot
+	after.PaymentStatus = paymentRefunded
+	auditSlot(cb.From.ID, auditBookingRefund, slot, &after)
+	notifyClient(*slot, fmt.Sprintf("💸 Предоплата %d ₽ за запись на %s в %s возвращена.", slot.PaymentAmount, slot.Date, slot.Time))
+	showSlotCard(cb, idStr)
+}
+
+// resendInvoice sends the invoice again from "Мои записи" while the hold
+// is still active.
+func resendInvoice(cb *tgbotapi.CallbackQuery, idStr string) {
+	slotID, _ := strconv.Atoi(idStr)
+	slot, err := getBookingByID(slotID)
+	if err != nil || slot.UserID != strconv.FormatInt(cb.From.ID, 10) ||
+		slot.Status != "booked" || slot.PaymentStatus != paymentPending || time.Now().After(slot.HoldExpiresAt) || payments == nil {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Бронь истекла, запишитесь заново", ShowAlert: true})
+		return
+	}
+	if err := payments.SendInvoice(cb.Message.Chat.ID, *slot, slot.PaymentAmount); err != nil {
+		slog.Error("failed to send invoice", "slot_id", slot.ID, "err", err)
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Не удалось выставить счёт", ShowAlert: true})
+		return
+	}
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
+
+// paymentLine describes the slot's payment for cards and lists.
+func paymentLine(slot Slot) string {
+	if slot.PaymentStatus == "" {
+		return ""
+	}
+	line := fmt.Sprintf("💳 Предоплата %d ₽ — %s", slot.PaymentAmount, paymentTitles[slot.PaymentStatus])
+	if slot.PaymentStatus == paymentPending && !slot.HoldExpiresAt.IsZero() {
+		line += " до " + slot.HoldExpiresAt.In(slotLocation(slot).timezone()).Format("15:04")
+	}
+	return line
+}
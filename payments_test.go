@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// FakePaymentProvider records invoices and refunds instead of charging
+// anyone. Together with FakeBotAPI and FakeUser.PreCheckout/Pay it runs the
+// whole payment flow without a provider.
+type FakePaymentProvider struct {
+	mu       sync.Mutex
+	Invoices []Slot
+	Refunds  []Slot
+	// RefundErr, if set, is returned by Refund.
+	RefundErr error
+}
+
+func (p *FakePaymentProvider) Name() string { return "fake" }
+
+func (p *FakePaymentProvider) SendInvoice(chatID int64, slot Slot, amount int) error {
+	p.mu.Lock()
+	p.Invoices = append(p.Invoices, slot)
+	p.mu.Unlock()
+	return sendInvoice(chatID, slot, amount, "fake")
+}
+
+func (p *FakePaymentProvider) Refund(slot Slot) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.RefundErr != nil {
+		return p.RefundErr
+	}
+	p.Refunds = append(p.Refunds, slot)
+	return nil
+}
+
+// newPaymentBot is a testBot whose package asks 1000 ₽ in advance.
+func newPaymentBot(t *testing.T) (*testBot, *FakePaymentProvider) {
+	b := newTestBot(t)
+	provider := &FakePaymentProvider{}
+	payments = provider
+	pkg := packages["complex"]
+	pkg.Prepayment = 1000
+	packages["complex"] = pkg
+	return b, provider
+}
+
+// holdBooking books up to the invoice and returns the held slot.
+func (b *testBot) holdBooking(u *FakeUser) (date, slotTime, slotID, payload string) {
+	b.t.Helper()
+	date, slotTime, messageID := b.bookUntilConfirmation(u)
+	b.handle(u.Press(messageID, "confirm_booking"))
+
+	held := b.last("editMessageText").Text()
+	if want := fmt.Sprintf("⏳ Время забронировано\n\n📅 %s\n🕐 %s\n👨⚕️ Ахмед\n\nЦентр: HGN Москва\nАдрес: Мичуринский проспект, 19к1\n\nЧтобы подтвердить запись, оплатите 1000 ₽ по счёту ниже до ", date, slotTime); !strings.HasPrefix(held, want) {
+		b.t.Errorf("hold text = %q, want prefix %q", held, want)
+	}
+	invoice := b.last("sendInvoice")
+	if invoice.ChatID() != u.ID || invoice.Params.Get("currency") != paymentCurrency || invoice.Params.Get("prices") != `[{"label":"Комплекс","amount":100000}]` {
+		b.t.Errorf("invoice = %v", invoice.Params)
+	}
+	pending := b.db.rows("slots", map[string]string{"status": "booked", "payment_status": paymentPending, "payment_amount": "1000"})
+	if len(pending) != 1 {
+		b.t.Fatalf("held slots = %v", b.db.rows("slots", nil))
+	}
+	slotID, _ = fakeValue(pending[0]["id"])
+	if payload = invoice.Params.Get("payload"); payload != "slot:"+slotID {
+		b.t.Errorf("invoice payload = %q, want slot:%s", payload, slotID)
+	}
+	return date, slotTime, slotID, payload
+}
+
+// messagesTo returns the texts the bot sent to chatID since the latest update.
+func (b *testBot) messagesTo(chatID int64) []string {
+	var texts []string
+	for _, c := range b.api.Calls()[b.handled:] {
+		if c.Method == "sendMessage" && c.ChatID() == chatID {
+			texts = append(texts, c.Text())
+		}
+	}
+	return texts
+}
+
+func (b *testBot) expectPreCheckout(ok bool, message string) {
+	b.t.Helper()
+	answer := b.last("answerPreCheckoutQuery")
+	if got := answer.Params.Get("ok") == "true"; got != ok || answer.Params.Get("error_message") != message {
+		b.t.Errorf("pre-checkout answer = %v, want ok=%v %q", answer.Params, ok, message)
+	}
+}
+
+func (b *testBot) expectPaymentStatus(slotID, status string) {
+	b.t.Helper()
+	if got := b.db.rows("slots", map[string]string{"id": slotID}); len(got) != 1 || got[0]["payment_status"] != status {
+		b.t.Errorf("slot %s = %v, want payment_status %s", slotID, got, status)
+	}
+}
+
+// cancelAsClient cancels the client's booking from "Мои записи" and returns
+// the resulting text.
+func (b *testBot) cancelAsClient(u *FakeUser, slotID string) string {
+	b.t.Helper()
+	b.handle(u.Text("📋 Мои записи"))
+	b.handle(u.Press(b.last("sendMessage").MessageID, "cancel_booking_"+slotID))
+	b.expectAnswer("Запись отменена")
+	return b.last("editMessageText").Text()
+}
+
+func TestPrepaymentPaidAndRefunded(t *testing.T) {
+	b, provider := newPaymentBot(t)
+	client := &FakeUser{ID: 3001, UserName: "ivan"}
+	date, slotTime, slotID, payload := b.holdBooking(client)
+	if len(provider.Invoices) != 1 {
+		t.Errorf("invoices = %d, want 1", len(provider.Invoices))
+	}
+	if got := b.db.rows("slots", nil); len(got) != 1 {
+		t.Errorf("slots = %v, want only the held one", got)
+	}
+
+	b.handle(client.PreCheckout(payload, 900))
+	b.expectPreCheckout(false, "Сумма счёта изменилась. Пожалуйста, запишитесь заново.")
+	b.handle(client.PreCheckout(payload, 1000))
+	b.expectPreCheckout(true, "")
+
+	b.handle(client.Pay(payload, 1000))
+	b.expectPaymentStatus(slotID, paymentPaid)
+	want := fmt.Sprintf("✅ Вы записаны!\n\n📅 %s\n🕐 %s\n👨⚕️ Ахмед\n💼 Комплекс\n\nЦентр: HGN Москва\nАдрес: Мичуринский проспект, 19к1", date, slotTime)
+	if got := b.messagesTo(client.ID); len(got) != 1 || got[0] != want {
+		t.Errorf("client messages = %q, want %q", got, want)
+	}
+	if got := b.messagesTo(testOwnerID); len(got) != 1 || !strings.Contains(got[0], "💳 Оплачено 1000 ₽") {
+		t.Errorf("staff messages = %q", got)
+	}
+
+	if got := b.cancelAsClient(client, slotID); got != "✅ Запись отменена\n\nПредоплата 1000 ₽ возвращена." {
+		t.Errorf("cancel text = %q", got)
+	}
+	b.expectPaymentStatus(slotID, paymentRefunded)
+	if len(provider.Refunds) != 1 || fmt.Sprint(provider.Refunds[0].ID) != slotID {
+		t.Errorf("refunds = %v, want slot %s", provider.Refunds, slotID)
+	}
+}
+
+func TestPrepaymentHoldExpires(t *testing.T) {
+	b, provider := newPaymentBot(t)
+	client := &FakeUser{ID: 3002, UserName: "oleg"}
+	date, slotTime, slotID, payload := b.holdBooking(client)
+	b.db.set("slots", slotID, map[string]interface{}{"hold_expires_at": dbTimestamp(time.Now().Add(-time.Minute))})
+
+	b.handle(client.PreCheckout(payload, 1000))
+	b.expectPreCheckout(false, "Бронь истекла. Пожалуйста, запишитесь заново.")
+
+	b.handled = len(b.api.Calls())
+	releaseExpiredHolds(context.Background())
+	if got := b.db.rows("slots", map[string]string{"id": slotID, "status": "cancelled", "payment_status": paymentExpired}); len(got) != 1 {
+		t.Errorf("slot %s not released: %v", slotID, b.db.rows("slots", nil))
+	}
+	want := fmt.Sprintf("⌛ Бронь на %s в %s снята: предоплата не поступила.\n\nЧтобы выбрать время снова, нажмите «📍 Записаться на Хиджаму».", date, slotTime)
+	if got := b.messagesTo(client.ID); len(got) != 1 || got[0] != want {
+		t.Errorf("client messages = %q, want %q", got, want)
+	}
+	if !masterAvailable(locationByID("main"), "complex", date, slotTime, "Ахмед") {
+		t.Error("released time is still taken")
+	}
+
+	// A payment that Telegram completes after the release is returned
+	b.handle(client.Pay(payload, 1000))
+	want = fmt.Sprintf("Оплата получена, но бронь на %s в %s уже снята. Предоплата 1000 ₽ возвращена.", date, slotTime)
+	if got := b.messagesTo(client.ID); len(got) != 1 || got[0] != want {
+		t.Errorf("client messages = %q, want %q", got, want)
+	}
+	b.expectPaymentStatus(slotID, paymentRefunded)
+	if len(provider.Refunds) != 1 {
+		t.Errorf("refunds = %d, want 1", len(provider.Refunds))
+	}
+}
+
+func TestPrepaymentManualRefund(t *testing.T) {
+	b, provider := newPaymentBot(t)
+	provider.RefundErr = errManualRefund
+	client := &FakeUser{ID: 3003, UserName: "anna"}
+	owner := &FakeUser{ID: testOwnerID, UserName: "owner"}
+	date, slotTime, slotID, payload := b.holdBooking(client)
+	b.handle(client.Pay(payload, 1000))
+
+	if got := b.cancelAsClient(client, slotID); got != "✅ Запись отменена\n\nПредоплату 1000 ₽ вернём в течение нескольких дней." {
+		t.Errorf("cancel text = %q", got)
+	}
+	b.expectPaymentStatus(slotID, paymentRefundPending)
+	if got := b.messagesTo(testOwnerID); len(got) == 0 || !strings.HasPrefix(got[0], "💸 Верните предоплату 1000 ₽\n\n📋 Запись #"+slotID) {
+		t.Errorf("staff messages = %q", got)
+	}
+
+	b.handle(owner.Press(1, "admin_slot_refunded_"+slotID))
+	b.expectPaymentStatus(slotID, paymentRefunded)
+	want := fmt.Sprintf("💸 Предоплата 1000 ₽ за запись на %s в %s возвращена.", date, slotTime)
+	if got := b.messagesTo(client.ID); len(got) != 1 || got[0] != want {
+		t.Errorf("client messages = %q, want %q", got, want)
+	}
+	if !strings.Contains(b.last("editMessageText").Text(), "📋 Запись #"+slotID) {
+		t.Errorf("staff card not shown: %q", b.last("editMessageText").Text())
+	}
+}
+
+// TestPaymentRacesHoldRelease lands the payment after the bot has read the
+// still-booked slot but before it records the payment, with the hold job
+// releasing the slot in between.
+func TestPaymentRacesHoldRelease(t *testing.T) {
+	b, provider := newPaymentBot(t)
+	client := &FakeUser{ID: 3004, UserName: "ruslan"}
+	date, slotTime, slotID, payload := b.holdBooking(client)
+	b.db.set("slots", slotID, map[string]interface{}{"hold_expires_at": dbTimestamp(time.Now().Add(-time.Second))})
+	b.db.beforeNext("PATCH", "slots", func() { releaseExpiredHolds(context.Background()) })
+
+	b.handle(client.Pay(payload, 1000))
+	want := []string{
+		fmt.Sprintf("⌛ Бронь на %s в %s снята: предоплата не поступила.\n\nЧтобы выбрать время снова, нажмите «📍 Записаться на Хиджаму».", date, slotTime),
+		fmt.Sprintf("Оплата получена, но бронь на %s в %s уже снята. Предоплата 1000 ₽ возвращена.", date, slotTime),
+	}
+	if got := b.messagesTo(client.ID); !reflect.DeepEqual(got, want) {
+		t.Errorf("client messages = %q, want %q", got, want)
+	}
+	if got := b.db.rows("slots", map[string]string{"id": slotID, "status": "cancelled", "payment_status": paymentRefunded}); len(got) != 1 {
+		t.Errorf("slot %s = %v, want cancelled and refunded", slotID, b.db.rows("slots", nil))
+	}
+	if len(provider.Refunds) != 1 || provider.Refunds[0].PaymentChargeID == "" {
+		t.Errorf("refunds = %v, want the late charge", provider.Refunds)
+	}
+	if got := b.messagesTo(testOwnerID); len(got) != 0 {
+		t.Errorf("staff told about a released booking: %q", got)
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Promo codes are typed by the client on the booking confirmation screen.
+// A code is checked again when the booking is confirmed, and the slot keeps
+// the code, the discount and the final price, so later changes to the code
+// or the package price do not rewrite past bookings.
+
+const (
+	promoPercent = "percent"
+	promoFixed   = "fixed"
+)
+
+type PromoCode struct {
+	Code       string `json:"code"`
+	Kind       string `json:"kind"`
+	Value      int    `json:"value"`
+	ValidFrom  string `json:"valid_from,omitempty"`
+	ValidUntil string `json:"valid_until,omitempty"`
+	// MaxUses and MaxPerClient count bookings that are not cancelled; 0 means
+	// no limit.
+	MaxUses      int `json:"max_uses"`
+	MaxPerClient int `json:"max_per_client"`
+	// Packages are package keys the code applies to; empty means all.
+	Packages       []string `json:"packages"`
+	FirstVisitOnly bool     `json:"first_visit_only"`
+	Active         bool     `json:"active"`
+	CreatedBy      int64    `json:"created_by,omitempty"`
+}
+
+func (p PromoCode) discount(price int) int {
+	d := p.Value
+	if p.Kind == promoPercent {
+		d = price * p.Value / 100
+	}
+	if d > price {
+		return price
+	}
+	return d
+}
+
+func (p PromoCode) String() string {
+	text := p.Code + " — "
+	if p.Kind == promoPercent {
+		text += fmt.Sprintf("−%d%%", p.Value)
+	} else {
+		text += fmt.Sprintf("−%d ₽", p.Value)
+	}
+	if p.ValidFrom != "" {
+		text += ", с " + formatPromoDate(p.ValidFrom)
+	}
+	if p.ValidUntil != "" {
+		text += ", до " + formatPromoDate(p.ValidUntil)
+	}
+	if p.MaxUses > 0 {
+		text += fmt.Sprintf(", всего %d раз", p.MaxUses)
+	}
+	if p.MaxPerClient > 0 {
+		text += fmt.Sprintf(", %d раз на клиента", p.MaxPerClient)
+	}
+	if len(p.Packages) > 0 {
+		text += ", только " + strings.Join(p.Packages, ", ")
+	}
+	if p.FirstVisitOnly {
+		text += ", первый визит"
+	}
+	if !p.Active {
+		text += " (выключен)"
+	}
+	return text
+}
+
+func formatPromoDate(date string) string {
+	if d, err := time.Parse("2006-01-02", date); err == nil {
+		return d.Format("02.01.2006")
+	}
+	return date
+}
+
+// Quote is the price of a booking after an optional promo code, then the
+// every-Nth-visit discount, then points.
+type Quote struct {
+	ListPrice int
+	Discount  int
+	Price     int
+	PromoCode string
+
+	VisitNumber   int
+	VisitDiscount int
+	PointsBalance int
+	Points        int
+}
+
+func quoteFor(pkg Package, promo *PromoCode) Quote {
+	q := Quote{ListPrice: pkg.Price, Price: pkg.Price}
+	if promo != nil {
+		q.PromoCode = promo.Code
+		q.Discount = promo.discount(pkg.Price)
+		q.Price = pkg.Price - q.Discount
+	}
+	return q
+}
+
+func (q Quote) String() string {
+	if q.Price == q.ListPrice {
+		return fmt.Sprintf("💰 %d ₽", q.Price)
+	}
+	text := fmt.Sprintf("💰 %d ₽ вместо %d ₽", q.Price, q.ListPrice)
+	if q.Discount > 0 {
+		text += fmt.Sprintf("\n🎟 Промокод %s: −%d ₽", q.PromoCode, q.Discount)
+	}
+	if q.VisitDiscount > 0 {
+		text += fmt.Sprintf("\n⭐ %d-й визит: −%d ₽", q.VisitNumber, q.VisitDiscount)
+	}
+	if q.Points > 0 {
+		text += fmt.Sprintf("\n🎁 Баллами: −%d ₽", q.Points)
+	}
+	return text
+}
+
+// slotPrice is what the client pays for slot. Bookings made before prices
+// were stored on the slot fall back to the package's current price.
+func slotPrice(slot Slot) int {
+	if slot.Price == 0 && slot.PromoCode == "" && slot.VisitDiscount == 0 && slot.PointsSpent == 0 {
+		_, pkg := resolvePackage(slot.PackageName)
+		return pkg.Price
+	}
+	return slot.Price
+}
+
+func normalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func loadPromoCode(code string) (PromoCode, bool, error) {
+	data, _, err := supabaseClient.From("promo_codes").Select("*", "", false).
+		Eq("code", normalizePromoCode(code)).
+		Execute()
+	if err != nil {
+		return PromoCode{}, false, err
+	}
+	var rows []PromoCode
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return PromoCode{}, false, err
+	}
+	if len(rows) == 0 {
+		return PromoCode{}, false, nil
+	}
+	return rows[0], true, nil
+}
+
+func loadPromoCodes() ([]PromoCode, error) {
+	data, _, err := supabaseClient.From("promo_codes").Select("*", "", false).Execute()
+	if err != nil {
+		return nil, err
+	}
+	var rows []PromoCode
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, err
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Code < rows[j].Code })
+	return rows, nil
+}
+
+func savePromoCode(p PromoCode) error {
+	_, _, err := supabaseClient.From("promo_codes").Upsert(p, "code", "", "").Execute()
+	return err
+}
+
+func setPromoActive(code string, active bool) error {
+	_, _, err := supabaseClient.From("promo_codes").
+		Update(map[string]interface{}{"active": active}, "", "").
+		Eq("code", code).
+		Execute()
+	return err
+}
+
+// clientFilter matches the client's bookings by Telegram id or by the phone
+// staff wrote down for bookings made without Telegram.
+func clientFilter(userID int64, phone string) string {
+	filter := "user_id.eq." + strconv.FormatInt(userID, 10)
+	if phone = strings.ReplaceAll(phone, `"`, ""); phone != "" {
+		filter += `,client_phone.eq."` + phone + `"`
+	}
+	return filter
+}
+
+// countSlots counts bookings that are not cancelled, with the given promo
+// code (if any), of the given client (if userID is set) and with ids up to
+// upToID (if set).
+func countSlots(promoCode string, userID int64, phone string, upToID int) (int, error) {
+	query := supabaseClient.From("slots").Select("id", "exact", true).Neq("status", "cancelled")
+	if promoCode != "" {
+		query = query.Eq("promo_code", promoCode)
+	}
+	if userID != 0 {
+		query = query.Or(clientFilter(userID, phone), "")
+	}
+	if upToID != 0 {
+		query = query.Lte("id", strconv.Itoa(upToID))
+	}
+	_, count, err := query.Execute()
+	return int(count), err
+}
+
+// promoOverLimit re-counts the code's bookings once slotID is saved with it.
+// Concurrent bookings can all pass checkPromo; counting only rows up to
+// slotID keeps the earliest ones, and the reason is returned for the rest so
+// they are rolled back.
+func promoOverLimit(code string, slotID int, userID int64, phone string) string {
+	if code == "" {
+		return ""
+	}
+	p, ok, err := loadPromoCode(code)
+	if err != nil || !ok {
+		slog.Error("failed to recheck promo code", "code", code, "slot_id", slotID, "err", err)
+		return ""
+	}
+	if p.MaxUses > 0 {
+		if n, err := countSlots(p.Code, 0, "", slotID); err == nil && n > p.MaxUses {
+			return "Промокод уже использован максимальное число раз"
+		}
+	}
+	if p.MaxPerClient > 0 {
+		if n, err := countSlots(p.Code, userID, phone, slotID); err == nil && n > p.MaxPerClient {
+			return "Вы уже использовали этот промокод"
+		}
+	}
+	return ""
+}
+
+// checkPromo finds code and checks it for this booking. The second result
+// is the reason to show the client when the code cannot be used.
+func checkPromo(code, pkgKey string, userID int64, phone string, loc Location) (PromoCode, string) {
+	p, ok, err := loadPromoCode(code)
+	if err != nil {
+		slog.Error("failed to load promo code", "code", code, "err", err)
+		return p, "Не удалось проверить промокод, попробуйте позже"
+	}
+	if !ok || !p.Active {
+		return p, "Такого промокода нет"
+	}
+	today := loc.today().Format("2006-01-02")
+	if p.ValidFrom != "" && today < p.ValidFrom {
+		return p, "Промокод начнёт действовать " + formatPromoDate(p.ValidFrom)
+	}
+	if p.ValidUntil != "" && today > p.ValidUntil {
+		return p, "Срок действия промокода истёк"
+	}
+	if len(p.Packages) > 0 && !containsString(p.Packages, pkgKey) {
+		return p, "Промокод не действует на эту процедуру"
+	}
+	if p.MaxUses > 0 {
+		if n, err := countSlots(p.Code, 0, "", 0); err != nil || n >= p.MaxUses {
+			return p, "Промокод уже использован максимальное число раз"
+		}
+	}
+	if p.MaxPerClient > 0 {
+		if n, err := countSlots(p.Code, userID, phone, 0); err != nil || n >= p.MaxPerClient {
+			return p, "Вы уже использовали этот промокод"
+		}
+	}
+	if p.FirstVisitOnly {
+		if n, err := countSlots("", userID, phone, 0); err != nil || n > 0 {
+			return p, "Промокод действует только на первый визит"
+		}
+	}
+	return p, ""
+}
+
+// bookingQuote prices the booking in the client's session, checking the
+// promo code again. A code that no longer applies is dropped from the
+// session and its reason returned.
+func bookingQuote(userID int64, session UserSession, pkgKey string, loc Location) (Quote, string) {
+	var promo *PromoCode
+	var reason string
+	if code := sessionString(session, "promo"); code != "" {
+		p, r := checkPromo(code, pkgKey, userID, sessionString(session, "client_phone"), loc)
+		if r == "" {
+			promo = &p
+		} else {
+			delete(session.Data, "promo")
+			setSession(userID, session)
+			reason = r
+		}
+	}
+	q := quoteFor(packages[pkgKey], promo)
+	q.applyLoyalty(userID, sessionString(session, "use_points") == "1")
+	return q, reason
+}
+
+func startPromoEntry(cb *tgbotapi.CallbackQuery) {
+	session := getSession(cb.From.ID)
+	session.Step = "waiting_promo"
+	setSession(cb.From.ID, session)
+
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("← Назад", "promo_back")},
+	}
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, "Введите промокод:")
+	editMsg.ReplyMarkup = markup
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
+
+// enterPromo handles the code typed after "🎟 Промокод".
+func enterPromo(msg *tgbotapi.Message, session *UserSession) {
+	userID := msg.From.ID
+	pkgKey := sessionString(*session, "package")
+	loc := locationByID(sessionString(*session, "location"))
+	promo, reason := checkPromo(msg.Text, pkgKey, userID, sessionString(*session, "client_phone"), loc)
+	if reason != "" {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ "+reason+"\n\nВведите другой промокод или нажмите «← Назад»."))
+		return
+	}
+	session.Step = ""
+	session.Data["promo"] = promo.Code
+	saveUserSession(userID, session)
+
+	text, markup := bookingConfirmation(userID)
+	reply := tgbotapi.NewMessage(msg.Chat.ID, "✅ Промокод применён\n\n"+text)
+	reply.ReplyMarkup = markup
+	bot.Send(reply)
+}
+
+const promoUsage = "/promo — список промокодов\n" +
+	"/promo add КОД 10% [from=01.03.2026] [until=31.03.2026] [limit=100] [per_client=1] [packages=complex,upper] [first]\n" +
+	"/promo add КОД 500 … — скидка в рублях\n" +
+	"/promo off КОД — выключить"
+
+// parsePromo reads "КОД 10% option=value …" from /promo add.
+func parsePromo(args []string) (PromoCode, error) {
+	if len(args) < 2 {
+		return PromoCode{}, fmt.Errorf("code and discount are required")
+	}
+	p := PromoCode{Code: normalizePromoCode(args[0]), Kind: promoFixed, Active: true}
+	value := args[1]
+	if strings.HasSuffix(value, "%") {
+		p.Kind = promoPercent
+		value = strings.TrimSuffix(value, "%")
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 || (p.Kind == promoPercent && n > 100) {
+		return p, fmt.Errorf("bad discount %q", args[1])
+	}
+	p.Value = n
+
+	for _, arg := range args[2:] {
+		key, val, _ := strings.Cut(arg, "=")
+		switch key {
+		case "from", "until":
+			date, err := parseBlockDate(val)
+			if err != nil {
+				return p, err
+			}
+			if key == "from" {
+				p.ValidFrom = date
+			} else {
+				p.ValidUntil = date
+			}
+		case "limit", "per_client":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return p, fmt.Errorf("bad %s %q", key, val)
+			}
+			if key == "limit" {
+				p.MaxUses = n
+			} else {
+				p.MaxPerClient = n
+			}
+		case "packages":
+			for _, k := range strings.Split(val, ",") {
+				if _, ok := packages[k]; !ok {
+					return p, fmt.Errorf("unknown package %q", k)
+				}
+				p.Packages = append(p.Packages, k)
+			}
+		case "first":
+			p.FirstVisitOnly = true
+		default:
+			return p, fmt.Errorf("unknown option %q", arg)
+		}
+	}
+	return p, nil
+}
+
+func promoCodesText() string {
+	codes, err := loadPromoCodes()
+	if err != nil {
+		slog.Error("failed to load promo codes", "err", err)
+		return "❌ Ошибка при загрузке промокодов"
+	}
+	if len(codes) == 0 {
+		return "🎟 Промокодов нет"
+	}
+	text := "🎟 Промокоды:"
+	for _, p := range codes {
+		used, _ := countSlots(p.Code, 0, "", 0)
+		text += fmt.Sprintf("\n• %s — записей: %d", p, used)
+	}
+	return text
+}
+
+// promoCommand handles "/promo", "/promo add …" and "/promo off КОД".
+func promoCommand(msg *tgbotapi.Message) {
+	args := strings.Fields(msg.CommandArguments())
+	switch {
+	case len(args) == 0:
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, promoCodesText()+"\n\n"+promoUsage))
+	case args[0] == "add":
+		p, err := parsePromo(args[1:])
+		if err != nil {
+			bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Не понял промокод\n\n"+promoUsage))
+			return
+		}
+		p.CreatedBy = msg.From.ID
+		before, existed, _ := loadPromoCode(p.Code)
+		if err := savePromoCode(p); err != nil {
+			slog.Error("failed to save promo code", "code", p.Code, "err", err)
+			bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Ошибка при сохранении"))
+			return
+		}
+		var b interface{}
+		if existed {
+			b = before
+		}
+		writeAudit(msg.From.ID, auditPromoUpdate, "promo_code", p.Code, 0, b, p)
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "✅ "+p.String()))
+	case args[0] == "off" && len(args) == 2:
+		code := normalizePromoCode(args[1])
+		before, ok, err := loadPromoCode(code)
+		if err == nil && ok {
+			err = setPromoActive(code, false)
+		}
+		if err != nil || !ok {
+			bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Промокод не найден"))
+			return
+		}
+		after := before
+		after.Active = false
+		writeAudit(msg.From.ID, auditPromoUpdate, "promo_code", code, 0, before, after)
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "✅ Промокод "+code+" выключен"))
+	default:
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, promoUsage))
+	}
+}
+
+func showAdminPromos(cb *tgbotapi.CallbackQuery) {
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("← Назад", "admin_back")},
+	}
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, promoCodesText()+"\n\n"+promoUsage)
+	editMsg.ReplyMarkup = markup
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
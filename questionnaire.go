@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/supabase-community/postgrest-go"
+)
+
+// The health questionnaire runs after the 18+ check. Questions live in
+// health_questions; a yes/no answer equal to trigger_answer either stops the
+// booking with advice to consult a doctor first (block) or lets it through
+// marked for the master (flag). Answers are stored with the slot.
+
+const (
+	questionYesNo = "yes_no"
+
+	healthBlock = "block"
+	healthFlag  = "flag"
+
+	stepHealthText = "health_text"
+)
+
+type HealthQuestion struct {
+	ID            int    `json:"id"`
+	Position      int    `json:"position"`
+	Question      string `json:"question"`
+	Kind          string `json:"kind"`
+	Gender        string `json:"gender"`
+	TriggerAnswer string `json:"trigger_answer"`
+	Action        string `json:"action"`
+	Advice        string `json:"advice"`
+	Active        bool   `json:"active"`
+}
+
+type HealthAnswer struct {
+	QuestionID int    `json:"question_id,omitempty"`
+	Question   string `json:"question"`
+	Answer     string `json:"answer"`
+	Flag       bool   `json:"flag,omitempty"`
+}
+
+// loadHealthQuestions returns the active questions for the client's gender
+// in order. They are read on every step so edits apply without a restart.
+func loadHealthQuestions(gender string) ([]HealthQuestion, error) {
+	data, _, err := supabaseClient.From("health_questions").Select("*", "", false).
+		Eq("active", "true").
+		Order("position", &postgrest.OrderOpts{Ascending: true}).
+		Order("id", &postgrest.OrderOpts{Ascending: true}).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+	var all []HealthQuestion
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	var questions []HealthQuestion
+	for _, q := range all {
+		if q.Gender == "" || q.Gender == gender {
+			questions = append(questions, q)
+		}
+	}
+	return questions, nil
+}
+
+func sessionHealthAnswers(session UserSession) []HealthAnswer {
+	var answers []HealthAnswer
+	if s := sessionString(session, "health"); s != "" {
+		json.Unmarshal([]byte(s), &answers)
+	}
+	return answers
+}
+
+func healthAnswerTitle(q HealthQuestion, answer string) string {
+	if q.Kind != questionYesNo {
+		return answer
+	}
+	if answer == "yes" {
+		return "Да"
+	}
+	return "Нет"
+}
+
+// editOrSend edits the questionnaire message after a button and sends a new
+// one after a typed answer.
+func editOrSend(chatID int64, messageID int, text string, markup *tgbotapi.InlineKeyboardMarkup) {
+	if messageID == 0 {
+		msg := tgbotapi.NewMessage(chatID, text)
+		msg.ReplyMarkup = markup
+		bot.Send(msg)
+		return
+	}
+	editMsg := tgbotapi.NewEditMessageText(chatID, messageID, text)
+	editMsg.ReplyMarkup = markup
+	bot.Send(editMsg)
+}
+
+// askClientName is the step after the questionnaire.
+func askClientName(userID, chatID int64, messageID int) {
+	session := getSession(userID)
+	session.Step = "waiting_name"
+	setSession(userID, session)
+
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("← Назад", "back_to_gender")},
+	}
+	editOrSend(chatID, messageID, "Прежде чем начать запись, укажите свое имя:", markup)
+}
+
+func startQuestionnaire(cb *tgbotapi.CallbackQuery) {
+	session := getSession(cb.From.ID)
+	session.Data["health"] = ""
+	session.Data["health_step"] = "0"
+	setSession(cb.From.ID, session)
+	showHealthQuestion(cb.From.ID, cb.Message.Chat.ID, cb.Message.MessageID)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
+
+// showHealthQuestion asks the current question, or moves on to the client's
+// name once all are answered.
+func showHealthQuestion(userID, chatID int64, messageID int) {
+	session := getSession(userID)
+	questions, err := loadHealthQuestions(sessionString(session, "gender"))
+	if err != nil {
+		// Without the questions nobody may skip them
+		slog.Error("failed to load health questions", "err", err)
+		markup := &tgbotapi.InlineKeyboardMarkup{}
+		markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+			{tgbotapi.NewInlineKeyboardButtonData("🔄 Повторить", "age_yes")},
+			{tgbotapi.NewInlineKeyboardButtonData("← Назад", "back_to_gender")},
+		}
+		editOrSend(chatID, messageID, "❌ Не удалось загрузить анкету о здоровье. Попробуйте ещё раз чуть позже.", markup)
+		return
+	}
+	step, _ := strconv.Atoi(sessionString(session, "health_step"))
+	if step >= len(questions) {
+		askClientName(userID, chatID, messageID)
+		return
+	}
+	q := questions[step]
+
+	text := fmt.Sprintf("🩺 Анкета о здоровье (%d из %d)\n\n%s", step+1, len(questions), q.Question)
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	if q.Kind == questionYesNo {
+		markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{{
+			tgbotapi.NewInlineKeyboardButtonData("Да", "health_yes"),
+			tgbotapi.NewInlineKeyboardButtonData("Нет", "health_no"),
+		}}
+	} else {
+		session.Step = stepHealthText
+		setSession(userID, session)
+		text += "\n\nНапишите ответ сообщением."
+		markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+			{tgbotapi.NewInlineKeyboardButtonData("Нечего добавить", "health_skip")},
+		}
+	}
+	markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("← Назад", "back_to_gender"),
+	})
+	editOrSend(chatID, messageID, text, markup)
+}
+
+// answerHealthQuestion records the answer to the current question and shows
+// the next one, or stops the booking if the answer blocks it.
+func answerHealthQuestion(userID, chatID int64, messageID int, answer string) {
+	session := getSession(userID)
+	questions, err := loadHealthQuestions(sessionString(session, "gender"))
+	step, _ := strconv.Atoi(sessionString(session, "health_step"))
+	if err != nil || step >= len(questions) {
+		showHealthQuestion(userID, chatID, messageID)
+		return
+	}
+	q := questions[step]
+	triggered := q.Kind == questionYesNo && q.TriggerAnswer != "" && answer == q.TriggerAnswer
+
+	if triggered && q.Action == healthBlock {
+		slog.Info("booking stopped by health questionnaire", "user_id", userID, "question_id", q.ID)
+		clearSession(userID)
+		text := "⛔ По вашим ответам хиджаму сейчас делать нельзя без консультации врача."
+		if q.Advice != "" {
+			text += "\n\n" + q.Advice
+		}
+		text += "\n\nЕсли врач разрешит процедуру, запишитесь снова или свяжитесь с центром."
+		editOrSend(chatID, messageID, text, nil)
+		return
+	}
+
+	answers := append(sessionHealthAnswers(session), HealthAnswer{
+		QuestionID: q.ID,
+		Question:   q.Question,
+		Answer:     healthAnswerTitle(q, answer),
+		Flag:       triggered && q.Action == healthFlag,
+	})
+	encoded, _ := json.Marshal(answers)
+	session.Data["health"] = string(encoded)
+	session.Data["health_step"] = strconv.Itoa(step + 1)
+	if session.Step == stepHealthText {
+		session.Step = ""
+	}
+	setSession(userID, session)
+
+	if triggered && q.Action == healthFlag && q.Advice != "" {
+		// Keep the advice on screen and ask the next question below it
+		editOrSend(chatID, messageID, "⚠️ "+q.Advice, nil)
+		messageID = 0
+	}
+	showHealthQuestion(userID, chatID, messageID)
+}
+
+// handleHealthCallback handles health_yes, health_no and health_skip.
+func handleHealthCallback(cb *tgbotapi.CallbackQuery, data string) {
+	answer := strings.TrimPrefix(data, "health_")
+	if answer == "skip" {
+		answer = "—"
+	}
+	answerHealthQuestion(cb.From.ID, cb.Message.Chat.ID, cb.Message.MessageID, answer)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
+
+func enterHealthAnswer(msg *tgbotapi.Message) {
+	answer := strings.TrimSpace(msg.Text)
+	if answer == "" {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "Напишите ответ текстом или нажмите «Нечего добавить»."))
+		return
+	}
+	if len([]rune(answer)) > 500 {
+		answer = string([]rune(answer)[:500])
+	}
+	answerHealthQuestion(msg.From.ID, msg.Chat.ID, 0, answer)
+}
+
+// questionnaireComplete checks the session's answers against the current
+// questions before booking: every question answered and none with a blocking
+// answer. The buttons can't be trusted for that alone, since an old message
+// can still send confirm_booking.
+func questionnaireComplete(session UserSession) (bool, error) {
+	questions, err := loadHealthQuestions(sessionString(session, "gender"))
+	if err != nil {
+		return false, err
+	}
+	step, _ := strconv.Atoi(sessionString(session, "health_step"))
+	if step < len(questions) {
+		return false, nil
+	}
+	answers := make(map[int]HealthAnswer)
+	for _, a := range sessionHealthAnswers(session) {
+		answers[a.QuestionID] = a
+	}
+	for _, q := range questions {
+		a, ok := answers[q.ID]
+		if !ok {
+			return false, nil
+		}
+		if q.Kind == questionYesNo && q.Action == healthBlock && q.TriggerAnswer != "" && a.Answer == healthAnswerTitle(q, q.TriggerAnswer) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// saveHealthAnswers stores the questionnaire from the session with the slot.
+func saveHealthAnswers(slot *Slot, session UserSession) {
+	answers := sessionHealthAnswers(session)
+	if len(answers) == 0 {
+		return
+	}
+	flagged := false
+	for _, a := range answers {
+		flagged = flagged || a.Flag
+	}
+	update := map[string]interface{}{"health_answers": answers, "health_flag": flagged}
+	_, _, err := supabaseClient.From("slots").
+		Update(update, "", "").
+		Eq("id", strconv.Itoa(slot.ID)).
+		Execute()
+	if err != nil {
+		slog.Error("failed to save health answers", "slot_id", slot.ID, "err", err)
+		return
+	}
+	slot.HealthAnswers, slot.HealthFlag = answers, flagged
+}
+
+// healthText lists the answers for staff and the master; flagged ones are
+// marked.
+func healthText(slot Slot) string {
+	if len(slot.HealthAnswers) == 0 {
+		return ""
+	}
+	text := "🩺 Анкета:"
+	if slot.HealthFlag {
+		text = "🩺 Анкета ⚠️ требует внимания:"
+	}
+	for _, a := range slot.HealthAnswers {
+		mark := ""
+		if a.Flag {
+			mark = " ⚠️"
+		}
+		text += fmt.Sprintf("\n• %s — %s%s", a.Question, a.Answer, mark)
+	}
+	return text
+}
+
+// showMasterBookings lists the master's upcoming bookings with the clients'
+// questionnaires.
+func showMasterBookings(cb *tgbotapi.CallbackQuery, data string) {
+	masterID := strings.TrimPrefix(data, "master_bookings_")
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("← Назад", "master_back_"+masterID)},
+	}
+
+	text := "📋 Ближайшие записи"
+	master, _ := getMaster(masterID)
+	slots, err := getSlots(SlotFilter{From: time.Now().In(tz).Format("2006-01-02"), MasterName: master.Name, Status: "booked"})
+	if err != nil {
+		slog.Error("failed to load master bookings", "master", masterID, "err", err)
+		text += "\n\n❌ Ошибка при загрузке"
+	} else if len(slots) == 0 {
+		text += "\n\nЗаписей нет"
+	}
+	for i, slot := range slots {
+		if i == 10 {
+			text += fmt.Sprintf("\n\n…и ещё %d", len(slots)-i)
+			break
+		}
+		text += fmt.Sprintf("\n\n📅 %s %s · %s\n👤 %s", slot.Date, slot.Time, slot.PackageName, slot.ClientName)
+		if health := healthText(slot); health != "" {
+			text += "\n" + health
+		}
+	}
+
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, text)
+	editMsg.ReplyMarkup = markup
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/supabase-community/postgrest-go"
+)
+
+// Every client has a personal link t.me/<bot>?start=ref_<code>. A user who
+// starts the bot through someone else's link is recorded as a pending
+// referral; when staff mark their first visit as completed, both clients get
+// LoyaltyRules.ReferralPoints. Referrals from the client themselves, from
+// users who already booked before, and between clients with the same phone
+// are rejected.
+
+const (
+	referralPrefix   = "ref_"
+	referralAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	referralCodeLen  = 7
+
+	referralPending  = "pending"
+	referralRewarded = "rewarded"
+	referralRejected = "rejected"
+)
+
+var referralStatusTitles = map[string]string{
+	referralPending:  "ждут первого визита",
+	referralRewarded: "награждены",
+	referralRejected: "отклонены",
+}
+
+var referralRejectReasons = map[string]string{
+	"self":       "свой код",
+	"not_new":    "уже был клиентом",
+	"same_phone": "тот же телефон",
+}
+
+type Referral struct {
+	ID           int       `json:"id"`
+	ReferrerID   int64     `json:"referrer_id"`
+	ReferredID   int64     `json:"referred_id"`
+	Code         string    `json:"code"`
+	Status       string    `json:"status"`
+	RejectReason string    `json:"reject_reason"`
+	SlotID       int       `json:"slot_id"`
+	CreatedAt    time.Time `json:"created_at"`
+	RewardedAt   time.Time `json:"rewarded_at"`
+}
+
+func newReferralCode() string {
+	code := make([]byte, referralCodeLen)
+	for i := range code {
+		n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(referralAlphabet))))
+		code[i] = referralAlphabet[n.Int64()]
+	}
+	return string(code)
+}
+
+// referralCode returns the client's code, creating it on first use.
+func referralCode(userID int64) (string, error) {
+	data, _, err := supabaseClient.From("referral_codes").Select("code", "", false).
+		Eq("user_id", strconv.FormatInt(userID, 10)).
+		Execute()
+	if err != nil {
+		return "", err
+	}
+	var rows []struct {
+		Code string `json:"code"`
+	}
+	json.Unmarshal(data, &rows)
+	if len(rows) > 0 {
+		return rows[0].Code, nil
+	}
+
+	// A clash with another client's code is unlikely; retry a few times
+	for i := 0; i < 3; i++ {
+		code := newReferralCode()
+		row := map[string]interface{}{"user_id": userID, "code": code}
+		if _, _, err = supabaseClient.From("referral_codes").Insert(row, false, "", "", "").Execute(); err == nil {
+			return code, nil
+		}
+	}
+	return "", err
+}
+
+func referrerByCode(code string) (int64, bool) {
+	data, _, err := supabaseClient.From("referral_codes").Select("user_id", "", false).
+		Eq("code", code).
+		Execute()
+	if err != nil {
+		slog.Error("failed to look up referral code", "code", code, "err", err)
+		return 0, false
+	}
+	var rows []struct {
+		UserID int64 `json:"user_id"`
+	}
+	json.Unmarshal(data, &rows)
+	if len(rows) == 0 {
+		return 0, false
+	}
+	return rows[0].UserID, true
+}
+
+func referralLink(code string) string {
+	return fmt.Sprintf("https://t.me/%s?start=%s%s", api.Self.UserName, referralPrefix, code)
+}
+
+func loadReferrals(column string, value int64) ([]Referral, error) {
+	query := supabaseClient.From("referrals").Select("*", "", false)
+	if column != "" {
+		query = query.Eq(column, strconv.FormatInt(value, 10))
+	}
+	data, _, err := query.Order("created_at", &postgrest.OrderOpts{Ascending: false}).Execute()
+	if err != nil {
+		return nil, err
+	}
+	var rows []Referral
+	err = json.Unmarshal(data, &rows)
+	return rows, err
+}
+
+func insertReferral(r Referral) error {
+	row := map[string]interface{}{
+		"referrer_id": r.ReferrerID,
+		"referred_id": r.ReferredID,
+		"code":        r.Code,
+		"status":      r.Status,
+	}
+	if r.RejectReason != "" {
+		row["reject_reason"] = r.RejectReason
+	}
+	_, _, err := supabaseClient.From("referrals").Insert(row, false, "", "", "").Execute()
+	return err
+}
+
+// updateReferral changes the referral only while it still has status from
+// and reports whether it did, so two staff marking the same visit at once
+// don't both pay or take back the reward.
+func updateReferral(id int, from string, update map[string]interface{}) (bool, error) {
+	data, _, err := supabaseClient.From("referrals").
+		Update(update, "", "").
+		Eq("id", strconv.Itoa(id)).
+		Eq("status", from).
+		Execute()
+	if err != nil {
+		return false, err
+	}
+	var rows []Referral
+	json.Unmarshal(data, &rows)
+	return len(rows) > 0, nil
+}
+
+// startReferral handles /start ref_<code> and tells the new user whether the
+// invitation counts.
+func startReferral(msg *tgbotapi.Message, code string) {
+	userID := msg.From.ID
+	referrerID, ok := referrerByCode(strings.ToLower(code))
+	if !ok {
+		return
+	}
+	r := Referral{ReferrerID: referrerID, ReferredID: userID, Code: code, Status: referralPending}
+
+	if existing, err := loadReferrals("referred_id", userID); err != nil {
+		slog.Error("failed to load referrals", "user_id", userID, "err", err)
+		return
+	} else if len(existing) > 0 {
+		// Only the first invitation is recorded; later links change nothing
+		return
+	}
+	switch {
+	case referrerID == userID:
+		r.Status, r.RejectReason = referralRejected, "self"
+	case hadBookings(userID):
+		r.Status, r.RejectReason = referralRejected, "not_new"
+	}
+	if err := insertReferral(r); err != nil {
+		slog.Error("failed to save referral", "referrer_id", referrerID, "user_id", userID, "err", err)
+		return
+	}
+	slog.Info("referral recorded", "referrer_id", referrerID, "user_id", userID, "status", r.Status, "reason", r.RejectReason)
+
+	points := getLoyaltyRules().ReferralPoints
+	if r.Status == referralPending && points > 0 {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, fmt.Sprintf("🤝 Вас пригласил друг. После первого визита вы оба получите по %d баллов.", points)))
+	}
+}
+
+func hadBookings(userID int64) bool {
+	n, err := countSlots("", userID, "", 0)
+	return err != nil || n > 0
+}
+
+// clientPhones returns the normalized phones the client booked with.
+func clientPhones(userID int64) map[string]bool {
+	phones := make(map[string]bool)
+	data, _, err := supabaseClient.From("slots").Select("client_phone", "", false).
+		Eq("user_id", strconv.FormatInt(userID, 10)).
+		Execute()
+	if err != nil {
+		slog.Error("failed to load client phones", "user_id", userID, "err", err)
+		return phones
+	}
+	var rows []struct {
+		Phone string `json:"client_phone"`
+	}
+	json.Unmarshal(data, &rows)
+	for _, r := range rows {
+		if p := normalizePhone(r.Phone); p != "" {
+			phones[p] = true
+		}
+	}
+	return phones
+}
+
+// rewardReferral is called when a visit is marked completed and rewards the
+// pending referral of that client on their first visit.
+func rewardReferral(slot Slot) {
+	userID, _ := strconv.ParseInt(slot.UserID, 10, 64)
+	points := getLoyaltyRules().ReferralPoints
+	if userID == 0 || points <= 0 {
+		return
+	}
+	referrals, err := loadReferrals("referred_id", userID)
+	if err != nil || len(referrals) == 0 || referrals[0].Status != referralPending {
+		return
+	}
+	r := referrals[0]
+
+	if normalizePhone(slot.ClientPhone) != "" && clientPhones(r.ReferrerID)[normalizePhone(slot.ClientPhone)] {
+		if _, err := updateReferral(r.ID, referralPending, map[string]interface{}{"status": referralRejected, "reject_reason": "same_phone", "slot_id": slot.ID}); err != nil {
+			slog.Error("failed to reject referral", "referral_id", r.ID, "err", err)
+		}
+		slog.Warn("referral rejected: same phone", "referral_id", r.ID, "referrer_id", r.ReferrerID, "user_id", userID)
+		return
+	}
+
+	update := map[string]interface{}{"status": referralRewarded, "slot_id": slot.ID, "rewarded_at": dbTimestamp(time.Now())}
+	rewarded, err := updateReferral(r.ID, referralPending, update)
+	if err != nil {
+		slog.Error("failed to reward referral", "referral_id", r.ID, "err", err)
+		return
+	}
+	if !rewarded {
+		return
+	}
+	addPoints(userID, slot.ID, points, pointsReferral)
+	addPoints(r.ReferrerID, slot.ID, points, pointsReferral)
+	notifyClient(slot, fmt.Sprintf("🤝 За визит по приглашению друга начислено %d баллов.", points))
+	bot.Send(tgbotapi.NewMessage(r.ReferrerID, fmt.Sprintf("🤝 Приглашённый вами друг пришёл на первый визит. Начислено %d баллов.", points)))
+}
+
+// revokeReferral undoes the reward paid for this visit when it is no longer
+// marked completed; the referral waits for the next completed visit again.
+func revokeReferral(slot Slot) {
+	userID, _ := strconv.ParseInt(slot.UserID, 10, 64)
+	if userID == 0 {
+		return
+	}
+	referrals, err := loadReferrals("referred_id", userID)
+	if err != nil || len(referrals) == 0 || referrals[0].Status != referralRewarded || referrals[0].SlotID != slot.ID {
+		return
+	}
+	r := referrals[0]
+
+	revoked, err := updateReferral(r.ID, referralRewarded, map[string]interface{}{"status": referralPending, "slot_id": nil, "rewarded_at": nil})
+	if err != nil {
+		slog.Error("failed to revoke referral", "referral_id", r.ID, "err", err)
+		return
+	}
+	if !revoked {
+		return
+	}
+	for _, id := range []int64{userID, r.ReferrerID} {
+		if credited := slotPoints(id, slot.ID, pointsReferral, pointsReferralReversed); credited > 0 {
+			addPoints(id, slot.ID, -credited, pointsReferralReversed)
+		}
+	}
+	slog.Info("referral reward revoked", "referral_id", r.ID, "slot_id", slot.ID)
+}
+
+// referralProfileText is the invitation part of the client profile.
+func referralProfileText(userID int64) string {
+	points := getLoyaltyRules().ReferralPoints
+	if points <= 0 {
+		return ""
+	}
+	code, err := referralCode(userID)
+	if err != nil {
+		slog.Error("failed to get referral code", "user_id", userID, "err", err)
+		return ""
+	}
+	text := fmt.Sprintf("\n\n🤝 Пригласите друга по ссылке — после его первого визита вы оба получите по %d баллов:\n%s", points, referralLink(code))
+	if invited, err := loadReferrals("referrer_id", userID); err == nil && len(invited) > 0 {
+		counts := make(map[string]int)
+		for _, r := range invited {
+			counts[r.Status]++
+		}
+		text += fmt.Sprintf("\nПриглашено: %d, пришли: %d", counts[referralPending]+counts[referralRewarded], counts[referralRewarded])
+	}
+	return text
+}
+
+func referralReportText() string {
+	referrals, err := loadReferrals("", 0)
+	if err != nil {
+		slog.Error("failed to load referrals", "err", err)
+		return "❌ Ошибка при загрузке рефералов"
+	}
+	text := "🤝 Рефералы"
+	if points := getLoyaltyRules().ReferralPoints; points > 0 {
+		text += fmt.Sprintf(" (награда %d баллов каждому)", points)
+	} else {
+		text += " (награда выключена: /loyalty referral <баллы>)"
+	}
+	if len(referrals) == 0 {
+		return text + "\n\nПриглашений пока нет"
+	}
+
+	counts := make(map[string]int)
+	byReferrer := make(map[int64]int)
+	var rejected []Referral
+	for _, r := range referrals {
+		counts[r.Status]++
+		switch r.Status {
+		case referralRewarded:
+			byReferrer[r.ReferrerID]++
+		case referralRejected:
+			rejected = append(rejected, r)
+		}
+	}
+	text += "\n"
+	for _, status := range []string{referralPending, referralRewarded, referralRejected} {
+		text += fmt.Sprintf("\n%s: %d", referralStatusTitles[status], counts[status])
+	}
+
+	if len(byReferrer) > 0 {
+		type top struct {
+			id int64
+			n  int
+		}
+		var tops []top
+		for id, n := range byReferrer {
+			tops = append(tops, top{id, n})
+		}
+		sort.Slice(tops, func(i, j int) bool {
+			return tops[i].n > tops[j].n || (tops[i].n == tops[j].n && tops[i].id < tops[j].id)
+		})
+		text += "\n\nЛучшие:"
+		for i, t := range tops {
+			if i == 10 {
+				break
+			}
+			text += fmt.Sprintf("\n%d. %d — %d", i+1, t.id, t.n)
+		}
+	}
+	if len(rejected) > 0 {
+		text += "\n\nПоследние отклонённые:"
+		for i, r := range rejected {
+			if i == 10 {
+				break
+			}
+			text += fmt.Sprintf("\n%s  %d → %d: %s", r.CreatedAt.In(tz).Format("02.01"), r.ReferrerID, r.ReferredID, referralRejectReasons[r.RejectReason])
+		}
+	}
+	return text
+}
+
+func referralsCommand(msg *tgbotapi.Message) {
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, referralReportText()))
+}
+
+func showAdminReferrals(cb *tgbotapi.CallbackQuery) {
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("← Назад", "admin_back")},
+	}
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, referralReportText())
+	editMsg.ReplyMarkup = markup
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestReferralRewardedOnce(t *testing.T) {
+	b := newTestBot(t)
+	loyaltyRules = LoyaltyRules{ReferralPoints: 100}
+	b.db.seed("referrals", map[string]interface{}{"id": 1, "referrer_id": 4101, "referred_id": 4102, "code": "abc", "status": referralPending})
+	slot := Slot{ID: 7, UserID: "4102", ClientPhone: "+79991234567", Status: "completed"}
+
+	b.db.beforeNext("PATCH", "referrals", func() { rewardReferral(slot) })
+	rewardReferral(slot)
+
+	if got := b.db.rows("loyalty_points", nil); len(got) != 2 {
+		t.Errorf("loyalty points = %v, want one credit for each client", got)
+	}
+	if got := b.db.rows("referrals", map[string]string{"status": referralRewarded}); len(got) != 1 {
+		t.Errorf("rewarded referrals = %v, want 1", got)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+type Role string
+
+const (
+	roleOwner        Role = "owner"
+	roleAdmin        Role = "admin"
+	roleMaster       Role = "master"
+	roleDeveloper    Role = "developer"
+	roleReceptionist Role = "receptionist"
+)
+
+var roleTitles = map[Role]string{
+	roleOwner:        "Владелец",
+	roleAdmin:        "Администратор",
+	roleMaster:       "Мастер",
+	roleDeveloper:    "Разработчик",
+	roleReceptionist: "Ресепшн",
+}
+
+type permission string
+
+const (
+	permAdminPanel    permission = "admin_panel"
+	permManageMasters permission = "manage_masters"
+	permExport        permission = "export"
+	permDeveloper     permission = "developer"
+	permManageRoles   permission = "manage_roles"
+	permNotifications permission = "notifications"
+	permMasterCabinet permission = "master_cabinet"
+	permAudit         permission = "audit"
+	permBookClients   permission = "book_clients"
+	permManageBooking permission = "manage_bookings"
+	permManageBlocks  permission = "manage_blocks"
+	permManagePromos  permission = "manage_promos"
+	permReviews       permission = "reviews"
+)
+
+var rolePermissions = map[Role][]permission{
+	roleOwner:        {permAdminPanel, permManageMasters, permExport, permDeveloper, permManageRoles, permNotifications, permAudit, permBookClients, permManageBooking, permManageBlocks, permManagePromos, permReviews},
+	roleAdmin:        {permAdminPanel, permManageMasters, permExport, permNotifications, permAudit, permBookClients, permManageBooking, permManageBlocks, permManagePromos, permReviews},
+	roleReceptionist: {permAdminPanel, permNotifications, permBookClients, permManageBooking},
+	roleDeveloper:    {permAdminPanel, permDeveloper},
+	roleMaster:       {permMasterCabinet},
+}
+
+// callbackPermissions is the single place where admin callbacks are guarded:
+// handleCallback calls authorizeCallback before dispatching anything, and the
+// first matching prefix wins. Callbacks without an entry are client flows.
+var callbackPermissions = []struct {
+	prefix string
+	perm   permission
+}{
+	{"admin_masters_btn", permManageMasters},
+	{"add_master_start", permManageMasters},
+	{"gender_master_", permManageMasters},
+	{"master_profile_", permManageMasters},
+	{"admin_export", permExport},
+	{"export_", permExport},
+	{"admin_roles", permManageRoles},
+	{"admin_audit", permAudit},
+	{"admin_book_", permBookClients},
+	{"admin_day_", permManageBooking},
+	{"admin_slot_", permManageBooking},
+	{"admin_move_", permManageBooking},
+	{"admin_block", permManageBlocks},
+	{"admin_holidays", permManageBlocks},
+	{"admin_promos", permManagePromos},
+	{"admin_referrals", permManagePromos},
+	{"admin_", permAdminPanel},
+}
+
+// masterCallbacks open a master's cabinet; the master linked to the profile
+// may use them as well as staff who manage masters.
+var masterCallbacks = []string{"master_bookings_", "master_profit_", "master_notify_", "master_calendar_", "master_blocks_", "master_back_"}
+
+type UserRole struct {
+	UserID    int64  `json:"user_id"`
+	Role      Role   `json:"role"`
+	MasterID  string `json:"master_id,omitempty"`
+	GrantedBy int64  `json:"granted_by,omitempty"`
+}
+
+var (
+	rolesMu   sync.RWMutex
+	userRoles = make(map[int64][]UserRole)
+)
+
+func loadRolesFromDB() {
+	data, _, err := supabaseClient.From("user_roles").Select("*", "exact", false).Execute()
+	if err != nil {
+		slog.Error("failed to load roles", "err", err)
+		return
+	}
+	var results []UserRole
+	if err := json.Unmarshal(data, &results); err != nil {
+		slog.Error("failed to decode roles", "err", err)
+		return
+	}
+
+	loaded := make(map[int64][]UserRole)
+	for _, r := range results {
+		loaded[r.UserID] = append(loaded[r.UserID], r)
+	}
+	rolesMu.Lock()
+	userRoles = loaded
+	rolesMu.Unlock()
+	slog.Debug("roles loaded", "grants", len(results))
+}
+
+// rolesOf includes the bootstrap owners from ADMINS, which are never stored in the DB.
+func rolesOf(userID int64) []UserRole {
+	rolesMu.RLock()
+	roles := append([]UserRole{}, userRoles[userID]...)
+	rolesMu.RUnlock()
+	for _, id := range cfg.Admins {
+		if id == userID {
+			roles = append(roles, UserRole{UserID: userID, Role: roleOwner})
+		}
+	}
+	return roles
+}
+
+func hasRole(userID int64, role Role) bool {
+	for _, r := range rolesOf(userID) {
+		if r.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+func can(userID int64, perm permission) bool {
+	for _, r := range rolesOf(userID) {
+		for _, p := range rolePermissions[r.Role] {
+			if p == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isAdmin(userID int64) bool {
+	return can(userID, permAdminPanel)
+}
+
+// masterIDOf returns the master profile linked to the user's master role.
+func masterIDOf(userID int64) string {
+	for _, r := range rolesOf(userID) {
+		if r.Role == roleMaster && r.MasterID != "" {
+			return r.MasterID
+		}
+	}
+	return ""
+}
+
+func authorizeCallback(userID int64, data string) bool {
+	for _, prefix := range masterCallbacks {
+		if strings.HasPrefix(data, prefix) {
+			masterID := strings.TrimPrefix(data, prefix)
+			return can(userID, permManageMasters) || (masterID != "" && masterIDOf(userID) == masterID)
+		}
+	}
+	for _, c := range callbackPermissions {
+		if strings.HasPrefix(data, c.prefix) {
+			return can(userID, c.perm)
+		}
+	}
+	return true
+}
+
+func usersWith(perm permission) []int64 {
+	seen := make(map[int64]bool)
+	var ids []int64
+	add := func(id int64) {
+		if !seen[id] && can(id, perm) {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range cfg.Admins {
+		add(id)
+	}
+	rolesMu.RLock()
+	var granted []int64
+	for id := range userRoles {
+		granted = append(granted, id)
+	}
+	rolesMu.RUnlock()
+	for _, id := range granted {
+		add(id)
+	}
+	return ids
+}
+
+// notifyStaff sends text to everyone who receives booking notifications,
+// except the user who made the change.
+func notifyStaff(actorID int64, text string) {
+	for _, id := range usersWith(permNotifications) {
+		if id != actorID {
+			bot.Send(tgbotapi.NewMessage(id, text))
+		}
+	}
+}
+
+func grantRole(ur UserRole) error {
+	row := map[string]interface{}{
+		"user_id":    ur.UserID,
+		"role":       ur.Role,
+		"granted_by": ur.GrantedBy,
+		"granted_at": time.Now().In(tz).Format(time.RFC3339),
+	}
+	if ur.MasterID != "" {
+		row["master_id"] = ur.MasterID
+	}
+	_, _, err := supabaseClient.From("user_roles").Upsert(row, "user_id,role", "", "").Execute()
+	if err != nil {
+		return err
+	}
+
+	rolesMu.Lock()
+	var before interface{}
+	roles := userRoles[ur.UserID][:0:0]
+	for _, r := range userRoles[ur.UserID] {
+		if r.Role != ur.Role {
+			roles = append(roles, r)
+		} else {
+			before = r
+		}
+	}
+	userRoles[ur.UserID] = append(roles, ur)
+	rolesMu.Unlock()
+
+	writeAudit(ur.GrantedBy, auditRoleGrant, "user_role", fmt.Sprintf("%d:%s", ur.UserID, ur.Role), ur.UserID, before, ur)
+	return nil
+}
+
+func revokeRole(actorID, userID int64, role Role) error {
+	_, _, err := supabaseClient.From("user_roles").
+		Delete("", "").
+		Eq("user_id", strconv.FormatInt(userID, 10)).
+		Eq("role", string(role)).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	rolesMu.Lock()
+	var roles []UserRole
+	var before interface{}
+	for _, r := range userRoles[userID] {
+		if r.Role != role {
+			roles = append(roles, r)
+		} else {
+			before = r
+		}
+	}
+	if len(roles) == 0 {
+		delete(userRoles, userID)
+	} else {
+		userRoles[userID] = roles
+	}
+	rolesMu.Unlock()
+
+	if before != nil {
+		writeAudit(actorID, auditRoleRevoke, "user_role", fmt.Sprintf("%d:%s", userID, role), userID, before, nil)
+	}
+	return nil
+}
+
+const rolesUsage = "Команды владельца:\n/grant <user_id> <роль> [master_id]\n/revoke <user_id> <роль>\n/roles\n\nРоли: owner, admin, master, developer, receptionist"
+
+func parseRole(s string) (Role, bool) {
+	r := Role(strings.ToLower(s))
+	_, ok := rolePermissions[r]
+	return r, ok
+}
+
+// grantCommand handles "/grant <user_id> <role> [master_id]".
+func grantCommand(msg *tgbotapi.Message) {
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) < 2 {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, rolesUsage))
+		return
+	}
+	userID, err := strconv.ParseInt(args[0], 10, 64)
+	role, ok := parseRole(args[1])
+	if err != nil || !ok {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Неверный user_id или роль\n\n"+rolesUsage))
+		return
+	}
+
+	ur := UserRole{UserID: userID, Role: role, GrantedBy: msg.From.ID}
+	if role == roleMaster {
+		if len(args) < 3 {
+			bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Для роли master укажите master_id"))
+			return
+		}
+		if _, ok := getMaster(args[2]); !ok {
+			bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Мастер не найден: "+args[2]))
+			return
+		}
+		ur.MasterID = args[2]
+	}
+
+	if err := grantRole(ur); err != nil {
+		slog.Error("failed to grant role", "target_user_id", userID, "role", role, "err", err)
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Ошибка при выдаче роли"))
+		return
+	}
+	slog.Info("role granted", "target_user_id", userID, "role", role, "granted_by", msg.From.ID)
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, fmt.Sprintf("✅ %d: выдана роль «%s»", userID, roleTitles[role])))
+	bot.Send(tgbotapi.NewMessage(userID, fmt.Sprintf("Вам выдана роль «%s». Нажмите /start, чтобы обновить меню.", roleTitles[role])))
+}
+
+// revokeCommand handles "/revoke <user_id> <role>".
+func revokeCommand(msg *tgbotapi.Message) {
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) < 2 {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, rolesUsage))
+		return
+	}
+	userID, err := strconv.ParseInt(args[0], 10, 64)
+	role, ok := parseRole(args[1])
+	if err != nil || !ok {
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Неверный user_id или роль\n\n"+rolesUsage))
+		return
+	}
+
+	if err := revokeRole(msg.From.ID, userID, role); err != nil {
+		slog.Error("failed to revoke role", "target_user_id", userID, "role", role, "err", err)
+		bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "❌ Ошибка при отзыве роли"))
+		return
+	}
+	slog.Info("role revoked", "target_user_id", userID, "role", role, "revoked_by", msg.From.ID)
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, fmt.Sprintf("✅ %d: роль «%s» отозвана", userID, roleTitles[role])))
+}
+
+func rolesListText() string {
+	rolesMu.RLock()
+	var lines []string
+	for userID, roles := range userRoles {
+		for _, r := range roles {
+			line := fmt.Sprintf("%d — %s", userID, roleTitles[r.Role])
+			if r.MasterID != "" {
+				line += " (" + r.MasterID + ")"
+			}
+			lines = append(lines, line)
+		}
+	}
+	rolesMu.RUnlock()
+	sort.Strings(lines)
+
+	text := "👥 Роли\n\n"
+	for _, id := range cfg.Admins {
+		text += fmt.Sprintf("%d — %s (ADMINS)\n", id, roleTitles[roleOwner])
+	}
+	if len(lines) > 0 {
+		text += strings.Join(lines, "\n") + "\n"
+	}
+	return text + "\n" + rolesUsage
+}
+
+func rolesCommand(msg *tgbotapi.Message) {
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, rolesListText()))
+}
+
+func showRoles(cb *tgbotapi.CallbackQuery) {
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("← Назад", "admin_back")},
+	}
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, rolesListText())
+	editMsg.ReplyMarkup = markup
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Day view for staff: a time × master grid of one day with a button per
+// booking that opens its card (cancel, move, status).
+
+const gridColumnWidth = 7
+
+var statusTitles = map[string]string{
+	"booked":    "Записан",
+	"completed": "Пришёл",
+	"no_show":   "Не пришёл",
+	"cancelled": "Отменена",
+}
+
+func handleScheduleCallback(cb *tgbotapi.CallbackQuery, data string) {
+	switch {
+	case strings.HasPrefix(data, "admin_day_"):
+		date, locationID, _ := strings.Cut(strings.TrimPrefix(data, "admin_day_"), "_")
+		showDaySchedule(cb, date, locationByID(locationID))
+	case strings.HasPrefix(data, "admin_slot_status_"):
+		parts := strings.SplitN(strings.TrimPrefix(data, "admin_slot_status_"), "_", 2)
+		if len(parts) == 2 {
+			changeBookingStatus(cb, parts[0], parts[1])
+		}
+	case strings.HasPrefix(data, "admin_slot_cancelyes_"):
+		cancelBookingByStaff(cb, strings.TrimPrefix(data, "admin_slot_cancelyes_"))
+	case strings.HasPrefix(data, "admin_slot_cancel_"):
+		confirmStaffCancel(cb, strings.TrimPrefix(data, "admin_slot_cancel_"))
+	case strings.HasPrefix(data, "admin_slot_refunded_"):
+		markRefunded(cb, strings.TrimPrefix(data, "admin_slot_refunded_"))
+	case strings.HasPrefix(data, "admin_slot_"):
+		showSlotCard(cb, strings.TrimPrefix(data, "admin_slot_"))
+	case strings.HasPrefix(data, "admin_move_"):
+		handleMoveCallback(cb, data)
+	}
+}
+
+// dayCallback opens the schedule of date; with several centres it names the
+// centre since each one has its own grid.
+func dayCallback(date, locationID string) string {
+	if !multipleLocations() {
+		return "admin_day_" + date
+	}
+	return "admin_day_" + date + "_" + locationID
+}
+
+func showDaySchedule(cb *tgbotapi.CallbackQuery, date string, loc Location) {
+	day, err := time.ParseInLocation("2006-01-02", date, tz)
+	if err != nil {
+		day = time.Now().In(tz)
+		date = day.Format("2006-01-02")
+	}
+
+	slots, err := getSlots(SlotFilter{From: date, To: date})
+	if err != nil {
+		slog.Error("failed to load day schedule", "date", date, "err", err)
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Не удалось загрузить расписание", ShowAlert: true})
+		return
+	}
+	var active []Slot
+	for _, slot := range slots {
+		if slot.Status != "cancelled" && slot.Status != "free" && slotLocation(slot).ID == loc.ID {
+			active = append(active, slot)
+		}
+	}
+
+	weekday := []string{"Вс", "Пн", "Вт", "Ср", "Чт", "Пт", "Сб"}[int(day.Weekday())]
+	text := fmt.Sprintf("🗓 <b>%s (%s)</b> — записей: %d\n", day.Format("02.01.2006"), weekday, len(active))
+	if multipleLocations() {
+		text += "📍 " + html.EscapeString(loc.Name) + "\n"
+	}
+	if closed, ok := loadClosedDays(date, date, loc.ID)[date]; ok {
+		text += "📆 " + html.EscapeString(closed.String()) + "\n"
+	}
+	text += "\n" + buildDayGrid(active, mastersAt(loc.ID, ""))
+
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	for _, slot := range active {
+		label := fmt.Sprintf("%s · %s · %s", slot.Time, slot.MasterName, slot.ClientName)
+		if slot.Status != "booked" {
+			label += " · " + statusTitles[slot.Status]
+		}
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(label, fmt.Sprintf("admin_slot_%d", slot.ID)),
+		})
+	}
+	if multipleLocations() {
+		var row []tgbotapi.InlineKeyboardButton
+		for _, l := range sortedLocations() {
+			label := l.Name
+			if l.ID == loc.ID {
+				label = "• " + label
+			}
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData(label, dayCallback(date, l.ID)))
+		}
+		markup.InlineKeyboard = append(markup.InlineKeyboard, row)
+	}
+	markup.InlineKeyboard = append(markup.InlineKeyboard,
+		[]tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("◀", dayCallback(day.AddDate(0, 0, -1).Format("2006-01-02"), loc.ID)),
+			tgbotapi.NewInlineKeyboardButtonData("Сегодня", dayCallback(time.Now().In(tz).Format("2006-01-02"), loc.ID)),
+			tgbotapi.NewInlineKeyboardButtonData("▶", dayCallback(day.AddDate(0, 0, 1).Format("2006-01-02"), loc.ID)),
+		},
+		[]tgbotapi.InlineKeyboardButton{tgbotapi.NewInlineKeyboardButtonData("← Назад", "admin_back")},
+	)
+
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, text)
+	editMsg.ParseMode = tgbotapi.ModeHTML
+	editMsg.ReplyMarkup = markup
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
+
+// buildDayGrid renders the day as a monospace table: one row per time, one
+// column per master, the client's name in booked cells.
+func buildDayGrid(slots []Slot, masters map[string]Master) string {
+	names := make(map[string]bool)
+	for _, m := range masters {
+		names[m.Name] = true
+	}
+	cells := make(map[string]Slot)
+	times := make(map[string]bool)
+	for _, t := range bookingTimes {
+		times[t] = true
+	}
+	for _, slot := range slots {
+		names[slot.MasterName] = true
+		times[slot.Time] = true
+		cells[slot.Time+"|"+slot.MasterName] = slot
+	}
+
+	masterNames := make([]string, 0, len(names))
+	for name := range names {
+		masterNames = append(masterNames, name)
+	}
+	sort.Strings(masterNames)
+	timeRows := make([]string, 0, len(times))
+	for t := range times {
+		timeRows = append(timeRows, t)
+	}
+	sort.Strings(timeRows)
+
+	var b strings.Builder
+	b.WriteString(padCell("", 5))
+	for _, name := range masterNames {
+		b.WriteString(" " + padCell(name, gridColumnWidth))
+	}
+	b.WriteString("\n")
+	for _, t := range timeRows {
+		b.WriteString(t)
+		for _, name := range masterNames {
+			cell := "·"
+			if slot, ok := cells[t+"|"+name]; ok {
+				cell = slot.ClientName
+				if cell == "" {
+					cell = "занято"
+				}
+				switch slot.Status {
+				case "completed":
+					cell = "✓" + cell
+				case "no_show":
+					cell = "✗" + cell
+				}
+			}
+			b.WriteString(" " + padCell(cell, gridColumnWidth))
+		}
+		b.WriteString("\n")
+	}
+	return "<pre>" + html.EscapeString(b.String()) + "</pre>"
+}
+
+func padCell(s string, width int) string {
+	if utf8.RuneCountInString(s) > width {
+		s = string([]rune(s)[:width])
+	}
+	return s + strings.Repeat(" ", width-utf8.RuneCountInString(s))
+}
+
+func loadSlotForStaff(cb *tgbotapi.CallbackQuery, idStr string) (*Slot, bool) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return nil, false
+	}
+	slot, err := getBookingByID(id)
+	if err != nil {
+		slog.Error("failed to load booking", "slot_id", id, "err", err)
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Запись не найдена", ShowAlert: true})
+		return nil, false
+	}
+	return slot, true
+}
+
+func slotCardText(slot Slot) string {
+	source := bookingSources[slot.Source]
+	if source == "" {
+		source = "Telegram"
+	}
+	text := fmt.Sprintf("📋 Запись #%d\n\n📅 %s\n🕐 %s\n👨⚕️ %s\n💼 %s\n👤 %s\n📞 %s\n", slot.ID, slot.Date, slot.Time, slot.MasterName, slot.PackageName, slot.ClientName, slot.ClientPhone)
+	if slot.Username != "" {
+		text += "💬 @" + slot.Username + "\n"
+	}
+	text += fmt.Sprintf("💰 %d ₽\n", slotPrice(slot))
+	if slot.PromoCode != "" {
+		text += fmt.Sprintf("🎟 %s: −%d ₽\n", slot.PromoCode, slot.Discount)
+	}
+	if slot.VisitDiscount > 0 {
+		text += fmt.Sprintf("⭐ Скидка за визит: −%d ₽\n", slot.VisitDiscount)
+	}
+	if slot.PointsSpent > 0 {
+		text += fmt.Sprintf("🎁 Баллами: −%d ₽\n", slot.PointsSpent)
+	}
+	if multipleLocations() {
+		text += "📍 " + slotLocation(slot).Name + "\n"
+	}
+	if line := paymentLine(slot); line != "" {
+		text += line + "\n"
+	}
+	if health := healthText(slot); health != "" {
+		text += "\n" + health + "\n"
+	}
+	return text + fmt.Sprintf("\nИсточник: %s\nСтатус: %s", source, statusTitles[slot.Status])
+}
+
+func showSlotCard(cb *tgbotapi.CallbackQuery, idStr string) {
+	slot, ok := loadSlotForStaff(cb, idStr)
+	if !ok {
+		return
+	}
+	id := strconv.Itoa(slot.ID)
+
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	switch slot.Status {
+	case "booked":
+		markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+			{
+				tgbotapi.NewInlineKeyboardButtonData("✅ Пришёл", "admin_slot_status_"+id+"_completed"),
+				tgbotapi.NewInlineKeyboardButtonData("🚫 Не пришёл", "admin_slot_status_"+id+"_no_show"),
+			},
+			{
+				tgbotapi.NewInlineKeyboardButtonData("🔁 Перенести", "admin_move_"+id),
+				tgbotapi.NewInlineKeyboardButtonData("❌ Отменить", "admin_slot_cancel_"+id),
+			},
+		}
+	case "completed", "no_show":
+		markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+			{tgbotapi.NewInlineKeyboardButtonData("↩️ Вернуть в записанные", "admin_slot_status_"+id+"_booked")},
+		}
+	}
+	if slot.PaymentStatus == paymentRefundPending {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData("💸 Возврат выполнен", "admin_slot_refunded_"+id),
+		})
+	}
+	markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("← К расписанию", dayCallback(slot.Date, slotLocation(*slot).ID)),
+	})
+
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, slotCardText(*slot))
+	editMsg.ReplyMarkup = markup
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
+
+func changeBookingStatus(cb *tgbotapi.CallbackQuery, idStr, status string) {
+	if status != "booked" && status != "completed" && status != "no_show" {
+		return
+	}
+	slot, ok := loadSlotForStaff(cb, idStr)
+	if !ok {
+		return
+	}
+	if slot.Status == "cancelled" {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Запись уже отменена", ShowAlert: true})
+		return
+	}
+
+	if err := setSlotStatus(slot.ID, status); err != nil {
+		slog.Error("failed to change booking status", "slot_id", slot.ID, "status", status, "err", err)
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Ошибка при сохранении", ShowAlert: true})
+		return
+	}
+	after := *slot
+	after.Status = status
+	auditSlot(cb.From.ID, auditBookingStatus, slot, &after)
+	visitStatusChanged(*slot, status)
+	showSlotCard(cb, idStr)
+}
+
+func confirmStaffCancel(cb *tgbotapi.CallbackQuery, idStr string) {
+	slot, ok := loadSlotForStaff(cb, idStr)
+	if !ok {
+		return
+	}
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	markup.InlineKeyboard = [][]tgbotapi.InlineKeyboardButton{
+		{tgbotapi.NewInlineKeyboardButtonData("Да, отменить", "admin_slot_cancelyes_"+idStr)},
+		{tgbotapi.NewInlineKeyboardButtonData("← Назад", "admin_slot_"+idStr)},
+	}
+	editMsg := tgbotapi.NewEditMessageText(cb.Message.Chat.ID, cb.Message.MessageID, slotCardText(*slot)+"\n\nОтменить эту запись? Клиент получит уведомление.")
+	editMsg.ReplyMarkup = markup
+	bot.Send(editMsg)
+	bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, ShowAlert: false})
+}
+
+func cancelBookingByStaff(cb *tgbotapi.CallbackQuery, idStr string) {
+	slot, ok := loadSlotForStaff(cb, idStr)
+	if !ok {
+		return
+	}
+	if slot.Status != "booked" {
+		showSlotCard(cb, idStr)
+		return
+	}
+	if err := cancelBooking(slot.ID); err != nil {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Ошибка при отмене", ShowAlert: true})
+		return
+	}
+	metricBookingsCanceled.inc("")
+	after := *slot
+	after.Status = "cancelled"
+	after.CancelledAt = time.Now().In(tz)
+	auditSlot(cb.From.ID, auditBookingCancel, slot, &after)
+	returnPoints(*slot)
+
+	text := fmt.Sprintf("❌ Ваша запись на %s в %s отменена центром.", slot.Date, slot.Time)
+	if refund := refundPayment(cb.From.ID, *slot); refund != "" {
+		text += " " + refund
+	}
+	notifyClient(*slot, text+"\n\nЧтобы выбрать другое время, нажмите «📍 Записаться на Хиджаму».")
+	notifyStaff(cb.From.ID, fmt.Sprintf("❌ Отмена записи администратором\n\n👨⚕️ %s\n📅 %s\n🕐 %s\n👤 %s", slot.MasterName, slot.Date, slot.Time, slot.ClientName))
+	showDaySchedule(cb, slot.Date, slotLocation(*slot))
+}
+
+// notifyClient messages the client if the booking is linked to Telegram.
+func notifyClient(slot Slot, text string) {
+	userID, err := strconv.ParseInt(slot.UserID, 10, 64)
+	if err != nil || userID == 0 {
+		return
+	}
+	bot.Send(tgbotapi.NewMessage(userID, text))
+}
+
+// Moving a booking keeps the slot id in the staff member's session while
+// they pick a new date, time and master.
+
+func handleMoveCallback(cb *tgbotapi.CallbackQuery, data string) {
+	userID := cb.From.ID
+	session := getSession(userID)
+
+	switch {
+	case strings.HasPrefix(data, "admin_move_page_"):
+		page, _ := strconv.Atoi(strings.TrimPrefix(data, "admin_move_page_"))
+		showMoveDates(cb, page)
+	case strings.HasPrefix(data, "admin_move_date_"):
+		date := strings.TrimPrefix(data, "admin_move_date_")
+		session.Data["date"] = date
+		setSession(userID, session)
+		showMoveTimes(cb, date)
+	case strings.HasPrefix(data, "admin_move_time_"):
+		session.Data["time"] = strings.TrimPrefix(data, "admin_move_time_")
+		setSession(userID, session)
+		showMoveMasters(cb, session)
+	case strings.HasPrefix(data, "admin_move_master_"):
+		moveBooking(cb, session, strings.TrimPrefix(data, "admin_move_master_"))
+	default:
+		idStr := strings.TrimPrefix(data, "admin_move_")
+		slot, ok := loadSlotForStaff(cb, idStr)
+		if !ok {
+			return
+		}
+		// A booking moves within its own centre and to masters who perform its package
+		pkgKey, _ := resolvePackage(slot.PackageName)
+		saveUserSession(userID, &UserSession{Step: "move_slot", Data: map[string]interface{}{"slot_id": idStr, "location": slot.LocationID, "package": pkgKey}})
+		showMoveDates(cb, 0)
+	}
+}
+
+func moveBackButton(cb *tgbotapi.CallbackQuery) tgbotapi.InlineKeyboardButton {
+	session := getSession(cb.From.ID)
+	return tgbotapi.NewInlineKeyboardButtonData("Отмена", "admin_slot_"+sessionString(session, "slot_id"))
+}
+
+func showMoveDates(cb *tgbotapi.CallbackQuery, page int) {
+	session := getSession(cb.From.ID)
+	markup := datePageMarkup(manualLocation(session), sessionString(session, "package"), page, "admin_move_date_", "admin_move_page_", false)
+	markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{moveBackButton(cb)})
+	editManual(cb, "🔁 Перенос записи\n\nВыберите новую дату:", markup)
+}
+
+func showMoveTimes(cb *tgbotapi.CallbackQuery, date string) {
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	session := getSession(cb.From.ID)
+	for _, t := range availableTimes(manualLocation(session), sessionString(session, "package"), date) {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(t, "admin_move_time_"+t),
+		})
+	}
+	markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("← Назад", "admin_move_page_0"),
+		moveBackButton(cb),
+	})
+	editManual(cb, fmt.Sprintf("🔁 Перенос записи\n\nВремя на %s:", date), markup)
+}
+
+func showMoveMasters(cb *tgbotapi.CallbackQuery, session UserSession) {
+	date := sessionString(session, "date")
+	slotTime := sessionString(session, "time")
+
+	markup := &tgbotapi.InlineKeyboardMarkup{}
+	slotID, _ := strconv.Atoi(sessionString(session, "slot_id"))
+	for _, master := range availableMastersExcept(manualLocation(session), sessionString(session, "package"), date, slotTime, slotID) {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+			tgbotapi.NewInlineKeyboardButtonData(master, "admin_move_master_"+master),
+		})
+	}
+	markup.InlineKeyboard = append(markup.InlineKeyboard, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData("← Назад", "admin_move_date_"+date),
+		moveBackButton(cb),
+	})
+
+	text := fmt.Sprintf("🔁 Перенос записи\n\nСвободные мастера на %s %s:", date, slotTime)
+	if len(markup.InlineKeyboard) == 1 {
+		text = fmt.Sprintf("🔁 Перенос записи\n\nНа %s %s все мастера заняты", date, slotTime)
+	}
+	editManual(cb, text, markup)
+}
+
+func moveBooking(cb *tgbotapi.CallbackQuery, session UserSession, master string) {
+	date := sessionString(session, "date")
+	slotTime := sessionString(session, "time")
+	slot, ok := loadSlotForStaff(cb, sessionString(session, "slot_id"))
+	if !ok || date == "" || slotTime == "" {
+		return
+	}
+	if slot.Status != "booked" {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Перенести можно только активную запись", ShowAlert: true})
+		return
+	}
+	if slotStarted(Slot{Date: date, Time: slotTime, LocationID: slot.LocationID}) {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Это время уже прошло", ShowAlert: true})
+		showMoveDates(cb, 0)
+		return
+	}
+	// Same rules as the pickers: bookings, blocks, closed days and the package
+	if !containsString(availableMastersExcept(manualLocation(session), sessionString(session, "package"), date, slotTime, slot.ID), master) {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Мастер уже занят на это время", ShowAlert: true})
+		showMoveMasters(cb, session)
+		return
+	}
+
+	masterID := resolveMaster(Slot{MasterName: master, LocationID: slot.LocationID}).ID
+	err := rescheduleSlot(*slot, date, slotTime, master, masterID)
+	if errors.Is(err, errSlotTaken) {
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Мастер уже занят на это время", ShowAlert: true})
+		showMoveMasters(cb, session)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to move booking", "slot_id", slot.ID, "err", err)
+		bot.Request(tgbotapi.CallbackConfig{CallbackQueryID: cb.ID, Text: "Ошибка при переносе", ShowAlert: true})
+		return
+	}
+	deleteUserSession(cb.From.ID)
+
+	after := *slot
+	after.Date, after.Time, after.MasterName, after.MasterID = date, slotTime, master, masterID
+	auditSlot(cb.From.ID, auditBookingReschedule, slot, &after)
+
+	if userID, err := strconv.ParseInt(after.UserID, 10, 64); err == nil && userID != 0 {
+		bot.Send(tgbotapi.NewMessage(userID, fmt.Sprintf("🔁 Ваша запись перенесена\n\nБыло: %s %s\nСтало: %s %s\n👨⚕️ %s", slot.Date, slot.Time, date, slotTime, master)))
+		sendBookingICS(userID, after)
+	}
+	notifyStaff(cb.From.ID, fmt.Sprintf("🔁 Перенос записи\n\n👤 %s\nБыло: %s %s, %s\nСтало: %s %s, %s", slot.ClientName, slot.Date, slot.Time, slot.MasterName, date, slotTime, master))
+	showSlotCard(cb, strconv.Itoa(slot.ID))
+}
@@ -17,6 +17,7 @@ CREATE TABLE IF NOT EXISTS packages (
     name TEXT NOT NULL,
     description TEXT,
     price INTEGER NOT NULL,
+    duration_minutes INTEGER DEFAULT 60,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 
@@ -33,12 +34,279 @@ CREATE TABLE IF NOT EXISTS slots (
     username TEXT,
     client_name TEXT,
     client_phone TEXT,
+    package_name TEXT,
     booked_at TIMESTAMP WITH TIME ZONE,
-    source TEXT CHECK (source IN ('nfc', 'qr', 'link', 'bot')),
+    cancelled_at TIMESTAMP WITH TIME ZONE,
+    source TEXT CHECK (source IN ('nfc', 'qr', 'link', 'bot', 'phone', 'walk_in')),
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     FOREIGN KEY (master_id) REFERENCES masters(id)
 );
 
+-- Columns added after the first release
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS client_name TEXT;
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS client_phone TEXT;
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS package_name TEXT;
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS cancelled_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE packages ADD COLUMN IF NOT EXISTS duration_minutes INTEGER DEFAULT 60;
+ALTER TABLE slots DROP CONSTRAINT IF EXISTS slots_source_check;
+ALTER TABLE slots ADD CONSTRAINT slots_source_check CHECK (source IN ('nfc', 'qr', 'link', 'bot', 'phone', 'walk_in'));
+
+-- Centres; masters with location_id NULL work at every centre
+CREATE TABLE IF NOT EXISTS locations (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    address TEXT NOT NULL,
+    latitude DOUBLE PRECISION,
+    longitude DOUBLE PRECISION,
+    timezone TEXT,
+    opens TEXT,
+    closes TEXT,
+    active BOOLEAN DEFAULT true,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+ALTER TABLE masters ADD COLUMN IF NOT EXISTS location_id TEXT REFERENCES locations(id);
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS location_id TEXT REFERENCES locations(id);
+
+-- date/time stay the centre's local wall clock; starts_at/ends_at are the same
+-- moment for comparisons. Existing rows are filled from their centre's zone.
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS starts_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS ends_at TIMESTAMP WITH TIME ZONE;
+UPDATE slots s SET
+    starts_at = (s.date || ' ' || s.time)::timestamp AT TIME ZONE COALESCE(l.timezone, 'Europe/Moscow'),
+    ends_at = ((s.date || ' ' || s.time)::timestamp + make_interval(mins => COALESCE(p.duration_minutes, 60))) AT TIME ZONE COALESCE(l.timezone, 'Europe/Moscow')
+FROM slots s2
+LEFT JOIN locations l ON l.id = s2.location_id
+LEFT JOIN packages p ON p.name = s2.package_name
+WHERE s2.id = s.id AND s.starts_at IS NULL;
+
+-- Online prepayment: rubles asked in advance (0 = none, price = full)
+ALTER TABLE packages ADD COLUMN IF NOT EXISTS prepayment INTEGER NOT NULL DEFAULT 0;
+
+-- Payment of a slot booked with prepayment; NULL when nothing is due
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS payment_status TEXT
+    CHECK (payment_status IN ('pending', 'paid', 'refund_pending', 'refunded', 'expired'));
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS payment_amount INTEGER;
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS payment_charge_id TEXT;
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS provider_charge_id TEXT;
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS hold_expires_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS paid_at TIMESTAMP WITH TIME ZONE;
+CREATE INDEX IF NOT EXISTS idx_slots_payment_holds ON slots(hold_expires_at) WHERE payment_status = 'pending';
+
+-- Promo codes; value is a percentage or rubles depending on kind
+CREATE TABLE IF NOT EXISTS promo_codes (
+    code TEXT PRIMARY KEY,
+    kind TEXT NOT NULL CHECK (kind IN ('percent', 'fixed')),
+    value INTEGER NOT NULL CHECK (value > 0),
+    valid_from DATE,
+    valid_until DATE,
+    max_uses INTEGER NOT NULL DEFAULT 0,
+    max_per_client INTEGER NOT NULL DEFAULT 0,
+    packages TEXT[] NOT NULL DEFAULT '{}',
+    first_visit_only BOOLEAN NOT NULL DEFAULT false,
+    active BOOLEAN NOT NULL DEFAULT true,
+    created_by BIGINT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Final price of the booking after the promo code
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS price INTEGER;
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS discount INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS promo_code TEXT REFERENCES promo_codes(code);
+UPDATE slots s SET price = p.price
+FROM packages p
+WHERE p.name = s.package_name AND s.price IS NULL;
+CREATE INDEX IF NOT EXISTS idx_slots_promo_code ON slots(promo_code) WHERE promo_code IS NOT NULL;
+
+-- Loyalty: every-Nth-visit discount and points paid for the booking
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS visit_discount INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS points_spent INTEGER NOT NULL DEFAULT 0;
+
+-- Points ledger (1 point = 1 ₽); the balance is the sum of a client's rows
+CREATE TABLE IF NOT EXISTS loyalty_points (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    slot_id INTEGER REFERENCES slots(id),
+    points INTEGER NOT NULL,
+    reason TEXT NOT NULL CHECK (reason IN ('visit', 'visit_undone', 'booking', 'booking_cancelled')),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_loyalty_points_user ON loyalty_points(user_id);
+
+-- Referral links t.me/<bot>?start=ref_<code>
+CREATE TABLE IF NOT EXISTS referral_codes (
+    user_id BIGINT PRIMARY KEY,
+    code TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS referrals (
+    id SERIAL PRIMARY KEY,
+    referrer_id BIGINT NOT NULL,
+    referred_id BIGINT NOT NULL UNIQUE,
+    code TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'rewarded', 'rejected')),
+    reject_reason TEXT,
+    slot_id INTEGER REFERENCES slots(id),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    rewarded_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS idx_referrals_referrer ON referrals(referrer_id);
+
+ALTER TABLE loyalty_points DROP CONSTRAINT IF EXISTS loyalty_points_reason_check;
+ALTER TABLE loyalty_points ADD CONSTRAINT loyalty_points_reason_check
+    CHECK (reason IN ('visit', 'visit_undone', 'booking', 'booking_cancelled', 'referral', 'referral_undone'));
+
+-- Post-visit feedback; one review per visit
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS feedback_requested_at TIMESTAMP WITH TIME ZONE;
+
+CREATE TABLE IF NOT EXISTS reviews (
+    id SERIAL PRIMARY KEY,
+    slot_id INTEGER NOT NULL UNIQUE REFERENCES slots(id),
+    master_id TEXT REFERENCES masters(id),
+    master_name TEXT,
+    user_id BIGINT NOT NULL,
+    rating INTEGER NOT NULL CHECK (rating BETWEEN 1 AND 5),
+    comment TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_reviews_master ON reviews(master_id);
+
+-- Bot bookings used to be saved without master_id; fill it in where the name
+-- names one master at the slot's centre, then carry it over to the reviews
+UPDATE slots s SET master_id = m.id
+FROM masters m
+WHERE s.master_id IS NULL AND m.name = s.master_name
+  AND (m.location_id IS NULL OR s.location_id IS NULL OR m.location_id = s.location_id)
+  AND NOT EXISTS (
+    SELECT 1 FROM masters o
+    WHERE o.id <> m.id AND o.name = m.name
+      AND (o.location_id IS NULL OR s.location_id IS NULL OR o.location_id = s.location_id)
+  );
+UPDATE reviews r SET master_id = s.master_id
+FROM slots s
+WHERE r.master_id IS NULL AND r.slot_id = s.id AND s.master_id IS NOT NULL;
+
+-- Ratings shown next to masters, summed in the database
+CREATE OR REPLACE VIEW master_ratings AS
+SELECT master_id, COUNT(*) AS count, SUM(rating) AS sum
+FROM reviews
+WHERE master_id IS NOT NULL
+GROUP BY master_id;
+
+-- Master profiles; an empty packages list means every package
+ALTER TABLE masters ADD COLUMN IF NOT EXISTS photo_file_id TEXT;
+ALTER TABLE masters ADD COLUMN IF NOT EXISTS bio TEXT;
+ALTER TABLE masters ADD COLUMN IF NOT EXISTS experience_years INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE masters ADD COLUMN IF NOT EXISTS packages TEXT[] NOT NULL DEFAULT '{}';
+
+-- Health questionnaire asked before booking; a yes/no answer equal to
+-- trigger_answer blocks the booking or flags it for the master
+CREATE TABLE IF NOT EXISTS health_questions (
+    id SERIAL PRIMARY KEY,
+    position INTEGER NOT NULL DEFAULT 0,
+    question TEXT NOT NULL,
+    kind TEXT NOT NULL DEFAULT 'yes_no' CHECK (kind IN ('yes_no', 'text')),
+    gender TEXT CHECK (gender IN ('male', 'female')),
+    trigger_answer TEXT CHECK (trigger_answer IN ('yes', 'no')),
+    action TEXT CHECK (action IN ('block', 'flag')),
+    advice TEXT,
+    active BOOLEAN NOT NULL DEFAULT true,
+    CHECK (kind = 'yes_no' OR action IS NULL),
+    CHECK ((trigger_answer IS NULL) = (action IS NULL))
+);
+
+INSERT INTO health_questions (position, question, kind, gender, trigger_answer, action, advice)
+SELECT * FROM (VALUES
+    (10, 'Принимаете ли вы препараты, разжижающие кровь (варфарин, аспирин, ксарелто и др.)?', 'yes_no', NULL, 'yes', 'block', 'Эти препараты повышают риск кровотечения. Обсудите процедуру с лечащим врачом.'),
+    (20, 'Есть ли у вас анемия (низкий гемоглобин)?', 'yes_no', NULL, 'yes', 'block', 'При анемии кровопускание может ухудшить самочувствие. Сначала сдайте анализ крови и проконсультируйтесь с врачом.'),
+    (30, 'Вы беременны?', 'yes_no', 'female', 'yes', 'block', 'Во время беременности хиджама не проводится.'),
+    (40, 'У вас сахарный диабет?', 'yes_no', NULL, 'yes', 'flag', 'Мастер учтёт это на процедуре. Поешьте перед визитом и возьмите с собой то, что обычно помогает при низком сахаре.'),
+    (50, 'Есть ли другие хронические заболевания, аллергии или лекарства, о которых стоит знать мастеру?', 'text', NULL, NULL, NULL, NULL)
+) AS q(position, question, kind, gender, trigger_answer, action, advice)
+WHERE NOT EXISTS (SELECT 1 FROM health_questions);
+
+-- Questionnaire answers of the booking
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS health_answers JSONB;
+ALTER TABLE slots ADD COLUMN IF NOT EXISTS health_flag BOOLEAN NOT NULL DEFAULT false;
+
+-- Staff roles; users from ADMINS are owners without a row here
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id BIGINT NOT NULL,
+    role TEXT NOT NULL CHECK (role IN ('owner', 'admin', 'master', 'developer', 'receptionist')),
+    master_id TEXT REFERENCES masters(id),
+    granted_by BIGINT,
+    granted_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (user_id, role),
+    CHECK (role <> 'master' OR master_id IS NOT NULL)
+);
+
+-- Unavailable time: master_id NULL blocks the whole centre, start_time NULL
+-- the whole day, ends_on NULL repeats on weekdays (0 = Sunday) indefinitely
+CREATE TABLE IF NOT EXISTS slot_blocks (
+    id SERIAL PRIMARY KEY,
+    master_id TEXT REFERENCES masters(id),
+    starts_on DATE NOT NULL,
+    ends_on DATE,
+    start_time TEXT,
+    end_time TEXT,
+    weekdays INTEGER[],
+    reason TEXT,
+    created_by BIGINT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    CHECK (ends_on IS NULL OR ends_on >= starts_on),
+    CHECK ((start_time IS NULL) = (end_time IS NULL))
+);
+
+-- Holidays; opens/closes set the hours of a shortened day
+CREATE TABLE IF NOT EXISTS closed_days (
+    date DATE PRIMARY KEY,
+    opens TEXT,
+    closes TEXT,
+    note TEXT,
+    CHECK ((opens IS NULL) = (closes IS NULL))
+);
+
+-- Blocks and closed days with location_id NULL apply to every centre; a
+-- centre's own closed day overrides the common one
+ALTER TABLE slot_blocks ADD COLUMN IF NOT EXISTS location_id TEXT REFERENCES locations(id);
+ALTER TABLE closed_days ADD COLUMN IF NOT EXISTS location_id TEXT REFERENCES locations(id);
+ALTER TABLE closed_days DROP CONSTRAINT IF EXISTS closed_days_pkey;
+ALTER TABLE closed_days DROP CONSTRAINT IF EXISTS closed_days_date_location_key;
+ALTER TABLE closed_days ADD CONSTRAINT closed_days_date_location_key UNIQUE NULLS NOT DISTINCT (date, location_id);
+
+-- Bot settings changed by staff at runtime
+CREATE TABLE IF NOT EXISTS settings (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL,
+    updated_by BIGINT,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Append-only history of state changes; actor_id 0 is the bot itself
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    actor_id BIGINT NOT NULL,
+    action TEXT NOT NULL,
+    entity TEXT NOT NULL,
+    entity_id TEXT NOT NULL,
+    subject_user_id BIGINT,
+    before JSONB,
+    after JSONB
+);
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only
+    BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
 -- Insert initial masters
 INSERT INTO masters (id, name, code, contact, gender, active) VALUES
 ('adam', 'Адам', '1846', '', 'male', true),
@@ -48,6 +316,11 @@ INSERT INTO masters (id, name, code, contact, gender, active) VALUES
 ('muhammad', 'Мухаммад', '1231', '+79637149002', 'male', true)
 ON CONFLICT (id) DO NOTHING;
 
+-- The original centre; set latitude/longitude to attach a map pin
+INSERT INTO locations (id, name, address, timezone, opens, closes) VALUES
+('main', 'HGN Москва', 'Мичуринский проспект, 19к1', 'Europe/Moscow', '09:00', '21:00')
+ON CONFLICT (id) DO NOTHING;
+
 -- Insert initial packages
 INSERT INTO packages (key, name, description, price) VALUES
 ('complex', 'Комплексная хиджама', 'Перезапуск общего состояния и регуляции организма.', 3500),
@@ -62,3 +335,25 @@ CREATE INDEX IF NOT EXISTS idx_slots_date_time ON slots(date, time);
 CREATE INDEX IF NOT EXISTS idx_slots_status ON slots(status);
 CREATE INDEX IF NOT EXISTS idx_slots_user_id ON slots(user_id);
 CREATE INDEX IF NOT EXISTS idx_masters_active ON masters(active);
+CREATE INDEX IF NOT EXISTS idx_slots_location ON slots(location_id);
+CREATE INDEX IF NOT EXISTS idx_slots_starts_at ON slots(starts_at);
+-- One active booking per master and time; concurrent bookings fail with 23505.
+-- Keyed on master_id, so namesakes at different centres don't collide; slots
+-- without one fall back to the name. Existing double bookings must be
+-- cancelled first (see README, «Двойные записи»).
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM slots WHERE status = 'booked'
+        GROUP BY COALESCE(master_id, master_name), date, time
+        HAVING COUNT(*) > 1
+    ) THEN
+        RAISE EXCEPTION 'slots has double bookings: cancel the extra ones and run schema.sql again';
+    END IF;
+END $$;
+DROP INDEX IF EXISTS idx_slots_master_booked;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_slots_master_id_booked ON slots(COALESCE(master_id, master_name), date, time) WHERE status = 'booked';
+CREATE INDEX IF NOT EXISTS idx_slot_blocks_dates ON slot_blocks(starts_on, ends_on);
+CREATE INDEX IF NOT EXISTS idx_audit_log_entity ON audit_log(entity, entity_id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log(actor_id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_subject ON audit_log(subject_user_id);
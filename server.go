@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// httpMux collects every HTTP handler the bot exposes (ICS feeds and friends).
+var httpMux = http.NewServeMux()
+
+func startHTTPServer() *http.Server {
+	if cfg.HTTPAddr == "" {
+		return nil
+	}
+
+	srv := &http.Server{
+		Addr:              cfg.HTTPAddr,
+		Handler:           httpMux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		slog.Info("HTTP server listening", "addr", cfg.HTTPAddr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("HTTP server failed", "err", err)
+		}
+	}()
+	return srv
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Slots keep their date and time as text in the centre's local time, which is
+// what clients and staff see and what the UI matches on. starts_at/ends_at
+// store the same moment as timestamptz for the database. Every comparison
+// with "now" goes through slotStartTime, which reads the text in the slot's
+// location timezone rather than UTC or the server's zone.
+
+const cancelBefore = 2 * time.Hour
+
+// localTime returns date ("2006-01-02") and clock ("15:04") as a moment in
+// zone. ok is false for wall times skipped by a DST change; a wall time that
+// repeats when clocks go back resolves to the earlier moment.
+func localTime(zone *time.Location, date, clock string) (time.Time, bool) {
+	const layout = "2006-01-02 15:04"
+	wall := date + " " + clock
+	t, err := time.ParseInLocation(layout, wall, zone)
+	if err != nil || t.Format(layout) != wall {
+		return time.Time{}, false
+	}
+	if earlier := t.Add(-time.Hour); earlier.Format(layout) == wall {
+		t = earlier
+	}
+	return t, true
+}
+
+func slotStartTime(slot Slot) (time.Time, error) {
+	start, ok := localTime(slotLocation(slot).timezone(), slot.Date, slot.Time)
+	if !ok {
+		return time.Time{}, fmt.Errorf("no such local time %s %s", slot.Date, slot.Time)
+	}
+	return start, nil
+}
+
+func slotEndTime(slot Slot) (time.Time, error) {
+	start, err := slotStartTime(slot)
+	if err != nil {
+		return start, err
+	}
+	_, pkg := resolvePackage(slot.PackageName)
+	return start.Add(packageDuration(pkg)), nil
+}
+
+// slotStarted reports whether the slot's start has passed; slots with an
+// invalid local time count as started.
+func slotStarted(slot Slot) bool {
+	start, err := slotStartTime(slot)
+	return err != nil || !start.After(time.Now())
+}
+
+// setSlotInstants fills starts_at and ends_at of a slot row from slot's local
+// date, time, location and package.
+func setSlotInstants(row map[string]interface{}, slot Slot) {
+	start, err := slotStartTime(slot)
+	if err != nil {
+		return
+	}
+	end, _ := slotEndTime(slot)
+	row["starts_at"] = dbTimestamp(start)
+	row["ends_at"] = dbTimestamp(end)
+}
+
+// dbTimestamp formats t for a timestamptz column with an explicit offset, so
+// the database never assumes its own session zone.
+func dbTimestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// In Europe/Berlin clocks jump from 02:00 to 03:00 on 28 March 2027 and fall
+// back from 03:00 to 02:00 on 31 October 2027.
+func berlinLocation(t *testing.T) Location {
+	t.Helper()
+	zone, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no tzdata:", err)
+	}
+	loc := Location{ID: "berlin", Name: "HGN Берлин", Address: "Sonnenallee 1", Timezone: "Europe/Berlin", Active: true, zone: zone}
+	setLocations(map[string]Location{loc.ID: loc})
+	return loc
+}
+
+func utc(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestLocalTimeDST(t *testing.T) {
+	loc := berlinLocation(t)
+	tests := []struct {
+		date, clock string
+		want        string // UTC, empty if the wall time doesn't exist
+	}{
+		{"2027-03-28", "01:30", "2027-03-28T00:30:00Z"},
+		{"2027-03-28", "02:00", ""},
+		{"2027-03-28", "02:30", ""},
+		{"2027-03-28", "03:00", "2027-03-28T01:00:00Z"},
+		{"2027-10-31", "01:30", "2027-10-30T23:30:00Z"},
+		{"2027-10-31", "02:30", "2027-10-31T00:30:00Z"}, // repeated, the earlier one
+		{"2027-10-31", "03:00", "2027-10-31T02:00:00Z"},
+	}
+	for _, tt := range tests {
+		got, ok := localTime(loc.timezone(), tt.date, tt.clock)
+		switch {
+		case tt.want == "" && ok:
+			t.Errorf("localTime(%s %s) = %v, want no such time", tt.date, tt.clock, got.UTC())
+		case tt.want != "" && (!ok || !got.Equal(utc(tt.want))):
+			t.Errorf("localTime(%s %s) = %v, %v; want %s", tt.date, tt.clock, got.UTC(), ok, tt.want)
+		}
+	}
+}
+
+func TestCanCancelAcrossDST(t *testing.T) {
+	berlinLocation(t)
+	tests := []struct {
+		name        string
+		date, clock string
+		now         string
+		want        bool
+	}{
+		// 04:00 CEST is 02:00 UTC; by the wall clock 01:30 CET looks 2.5 hours early
+		{"spring forward, 2h left by the clock only", "2027-03-28", "04:00", "2027-03-28T00:30:00Z", false},
+		{"spring forward, in time", "2027-03-28", "04:00", "2027-03-27T23:59:00Z", true},
+		{"spring forward, skipped time", "2027-03-28", "02:30", "2027-03-27T12:00:00Z", false},
+		// 03:00 CET is 02:00 UTC; by the wall clock 01:30 CEST looks 1.5 hours early
+		{"fall back, 2h left in real time", "2027-10-31", "03:00", "2027-10-30T23:30:00Z", true},
+		{"fall back, too late", "2027-10-31", "03:00", "2027-10-31T00:30:00Z", false},
+		{"fall back, repeated hour counts from the first", "2027-10-31", "02:30", "2027-10-30T23:00:00Z", false},
+		{"fall back, repeated hour in time", "2027-10-31", "02:30", "2027-10-30T22:00:00Z", true},
+	}
+	for _, tt := range tests {
+		slot := Slot{Date: tt.date, Time: tt.clock, LocationID: "berlin"}
+		if got := canCancelAt(slot, utc(tt.now)); got != tt.want {
+			t.Errorf("%s: canCancelAt(%s %s, %s) = %v, want %v", tt.name, tt.date, tt.clock, tt.now, got, tt.want)
+		}
+	}
+}
+
+// icsReminder returns when the calendar app fires the event's alarm: DTSTART
+// plus the TRIGGER offset, as written by the code under test.
+func icsReminder(ics []byte) (time.Time, error) {
+	var start time.Time
+	var trigger time.Duration
+	for _, line := range strings.Split(string(ics), "\r\n") {
+		if v, ok := strings.CutPrefix(line, "DTSTART:"); ok {
+			var err error
+			if start, err = time.Parse("20060102T150405Z", v); err != nil {
+				return time.Time{}, err
+			}
+		}
+		if v, ok := strings.CutPrefix(line, "TRIGGER:"); ok {
+			// -PT120M, -PT2H, ...
+			d, err := time.ParseDuration(strings.ToLower(strings.Replace(v, "PT", "", 1)))
+			if err != nil {
+				return time.Time{}, err
+			}
+			trigger = d
+		}
+	}
+	if start.IsZero() || trigger == 0 {
+		return time.Time{}, fmt.Errorf("no DTSTART or TRIGGER")
+	}
+	return start.Add(trigger), nil
+}
+
+func TestReminderAcrossDST(t *testing.T) {
+	berlinLocation(t)
+	tests := []struct {
+		date, clock     string
+		start, reminder string
+	}{
+		{"2027-03-28", "04:00", "20270328T020000Z", "2027-03-28T00:00:00Z"},
+		{"2027-03-28", "01:00", "20270328T000000Z", "2027-03-27T22:00:00Z"},
+		{"2027-10-31", "02:30", "20271031T003000Z", "2027-10-30T22:30:00Z"},
+		{"2027-10-31", "04:00", "20271031T030000Z", "2027-10-31T01:00:00Z"},
+	}
+	for _, tt := range tests {
+		slot := Slot{ID: 7, Date: tt.date, Time: tt.clock, LocationID: "berlin", MasterName: "Ахмед"}
+		ics, err := buildBookingICS(slot, Package{Name: "Комплекс", Duration: 60})
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.date, tt.clock, err)
+		}
+		if reminder, err := icsReminder(ics); err != nil || !reminder.Equal(utc(tt.reminder)) {
+			t.Errorf("%s %s: reminder at %v (%v), want %s\n%s", tt.date, tt.clock, reminder, err, tt.reminder, ics)
+		}
+		if !containsString(strings.Split(string(ics), "\r\n"), "DTSTART:"+tt.start) {
+			t.Errorf("%s %s: want DTSTART %s, got\n%s", tt.date, tt.clock, tt.start, ics)
+		}
+	}
+
+	if _, err := buildBookingICS(Slot{Date: "2027-03-28", Time: "02:30", LocationID: "berlin"}, Package{}); err == nil {
+		t.Error("calendar event built for a skipped wall time")
+	}
+}
+
+// TestBookedAcrossDST books a two-hour procedure at 01:00 on the night clocks
+// jump forward: it ends at 04:00 CEST, so the 03:00 slot is still taken
+// although by the wall clock two hours have passed.
+func TestBookedAcrossDST(t *testing.T) {
+	newTestBot(t)
+	loc := berlinLocation(t)
+	packages["long"] = Package{Key: "long", Name: "Долгая", Price: 7000, Duration: 120}
+	if _, err := bookSlotForClient("2027-03-28", "01:00", "Ахмед", "Клиент", "+79990000000", "Долгая", "phone", loc.ID, 7000); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		clock  string
+		length time.Duration
+		booked bool
+	}{
+		{"00:00", time.Hour, false},
+		{"00:30", time.Hour, true},
+		{"03:00", time.Hour, true},
+		{"03:30", time.Hour, true},
+		{"04:00", time.Hour, false},
+		{"23:30", 2 * time.Hour, true}, // the day before, ends at 01:30
+	}
+	for _, tt := range tests {
+		date := "2027-03-28"
+		if tt.clock == "23:30" {
+			date = "2027-03-27"
+		}
+		start, _ := localTime(loc.timezone(), date, tt.clock)
+		if got := getBookedMasters(loc.ID, start, start.Add(tt.length), 0)["Ахмед"]; got != tt.booked {
+			t.Errorf("%s %s for %v: booked = %v, want %v", date, tt.clock, tt.length, got, tt.booked)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+)
+
+// Updates are processed concurrently, so every map shared between handlers
+// is guarded here. packages is written once at startup and only read after.
+var (
+	sessionsMu      sync.Mutex
+	mastersMu       sync.RWMutex
+	locationsMu     sync.RWMutex
+	notificationsMu sync.Mutex
+)
+
+func getMaster(masterID string) (Master, bool) {
+	mastersMu.RLock()
+	defer mastersMu.RUnlock()
+	m, ok := masters[masterID]
+	return m, ok
+}
+
+func mastersSnapshot() map[string]Master {
+	mastersMu.RLock()
+	defer mastersMu.RUnlock()
+	snapshot := make(map[string]Master, len(masters))
+	for id, m := range masters {
+		snapshot[id] = m
+	}
+	return snapshot
+}
+
+func setMaster(m Master) {
+	mastersMu.Lock()
+	defer mastersMu.Unlock()
+	masters[m.ID] = m
+}
+
+func setMasters(loaded map[string]Master) {
+	mastersMu.Lock()
+	defer mastersMu.Unlock()
+	masters = loaded
+}
+
+func getLocation(id string) (Location, bool) {
+	locationsMu.RLock()
+	defer locationsMu.RUnlock()
+	l, ok := locations[id]
+	return l, ok
+}
+
+func locationsSnapshot() map[string]Location {
+	locationsMu.RLock()
+	defer locationsMu.RUnlock()
+	snapshot := make(map[string]Location, len(locations))
+	for id, l := range locations {
+		snapshot[id] = l
+	}
+	return snapshot
+}
+
+func setLocations(loaded map[string]Location) {
+	locationsMu.Lock()
+	defer locationsMu.Unlock()
+	locations = loaded
+}
+
+func toggleNotifications(masterID string) bool {
+	notificationsMu.Lock()
+	defer notificationsMu.Unlock()
+	masterNotifications[masterID] = !masterNotifications[masterID]
+	return masterNotifications[masterID]
+}
+
+func sessionCount() int {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	return len(userSessions)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const maxUpdateSize = 1 << 20
+
+func pollingUpdates() tgbotapi.UpdatesChannel {
+	// Delete webhook to ensure polling works
+	_, err := bot.Request(tgbotapi.DeleteWebhookConfig{})
+	if err != nil {
+		slog.Error("failed to delete webhook", "err", err)
+	}
+
+	// Check webhook status
+	webhookInfo, err := api.GetWebhookInfo()
+	if err == nil && webhookInfo.URL != "" {
+		slog.Warn("webhook still active", "url", webhookInfo.URL)
+	} else if err != nil {
+		slog.Error("failed to get webhook info", "err", err)
+	} else {
+		slog.Debug("no active webhook")
+	}
+
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 10
+	u.AllowedUpdates = allowedUpdates
+
+	return api.GetUpdatesChan(u)
+}
+
+// webhookUpdates registers cfg.WebhookURL with Telegram and serves it on the shared HTTP mux.
+// Once ctx is done new updates are refused with 503 so Telegram redelivers them.
+func webhookUpdates(ctx context.Context) (tgbotapi.UpdatesChannel, error) {
+	hookURL, err := url.Parse(cfg.WebhookURL)
+	if err != nil {
+		return nil, err
+	}
+	if hookURL.Scheme != "https" {
+		return nil, errors.New("WEBHOOK_URL must be https")
+	}
+	// Without the secret anyone who finds the path could post updates
+	if cfg.WebhookSecret == "" {
+		return nil, errors.New("WEBHOOK_SECRET is required in webhook mode")
+	}
+
+	allowed, _ := json.Marshal(allowedUpdates)
+	params := tgbotapi.Params{
+		"url":             cfg.WebhookURL,
+		"allowed_updates": string(allowed),
+		"secret_token":    cfg.WebhookSecret,
+	}
+	if _, err := api.MakeRequest("setWebhook", params); err != nil {
+		return nil, err
+	}
+
+	path := hookURL.Path
+	if path == "" {
+		path = "/"
+	}
+	ch := make(chan tgbotapi.Update, api.Buffer)
+	httpMux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		update, err := readWebhookUpdate(w, r)
+		if err != nil {
+			slog.Warn("rejected webhook request", "remote_addr", r.RemoteAddr, "err", err)
+			http.Error(w, err.Error(), webhookErrorStatus(err))
+			return
+		}
+		select {
+		case ch <- update:
+			w.WriteHeader(http.StatusOK)
+		case <-ctx.Done():
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		}
+	})
+	return ch, nil
+}
+
+var errBadSecret = errors.New("invalid secret token")
+
+// readWebhookUpdate checks the secret header and decodes the update.
+// webhookUpdates refuses to start without WEBHOOK_SECRET, so it is never empty here.
+func readWebhookUpdate(w http.ResponseWriter, r *http.Request) (tgbotapi.Update, error) {
+	got := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare([]byte(got), []byte(cfg.WebhookSecret)) != 1 {
+		return tgbotapi.Update{}, errBadSecret
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUpdateSize)
+	update, err := api.HandleUpdate(r)
+	if err != nil {
+		return tgbotapi.Update{}, err
+	}
+	if update.UpdateID <= 0 {
+		return tgbotapi.Update{}, fmt.Errorf("invalid update_id %d", update.UpdateID)
+	}
+	return *update, nil
+}
+
+func webhookErrorStatus(err error) int {
+	if errors.Is(err, errBadSecret) {
+		return http.StatusUnauthorized
+	}
+	return http.StatusBadRequest
+}
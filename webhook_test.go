@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadWebhookUpdate(t *testing.T) {
+	newTestBot(t)
+	cfg.WebhookSecret = "s3cret"
+	const body = `{"update_id":42,"message":{"message_id":1,"chat":{"id":7},"text":"/start"}}`
+	tests := []struct {
+		name   string
+		secret string
+		body   string
+		ok     bool
+	}{
+		{"valid", "s3cret", body, true},
+		{"wrong secret", "guess", body, false},
+		{"no secret", "", body, false},
+		{"too large", "s3cret", `{"update_id":42,"message":{"text":"` + strings.Repeat("x", maxUpdateSize) + `"}}`, false},
+		{"no update_id", "s3cret", `{"message":{"text":"/start"}}`, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/telegram/webhook", strings.NewReader(tt.body))
+		if tt.secret != "" {
+			r.Header.Set("X-Telegram-Bot-Api-Secret-Token", tt.secret)
+		}
+		update, err := readWebhookUpdate(httptest.NewRecorder(), r)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if tt.ok && (update.UpdateID != 42 || update.Message.Text != "/start") {
+			t.Errorf("%s: update = %+v", tt.name, update)
+		}
+		if tt.secret != "s3cret" && !errors.Is(err, errBadSecret) {
+			t.Errorf("%s: err = %v, want errBadSecret", tt.name, err)
+		}
+	}
+}